@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// AckOpts : where the devices send their acknowledgements and how long they have to do so
+type AckOpts struct {
+	Exchange    string        // fanout exchange devices publish CmdAck on
+	Queue       string        // durable queue the registry consumes acks from, shared across replicas
+	Timeout     time.Duration // pushes not acknowledged within this are marked expired
+	ExpireEvery time.Duration // interval at which pending pushes are checked for expiry
+}
+
+func (opts *AckOpts) defaults() {
+	if opts.Exchange == "" {
+		opts.Exchange = "configs_acks"
+	}
+	if opts.Queue == "" {
+		opts.Queue = "devicereg_acks"
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 2 * time.Minute
+	}
+	if opts.ExpireEvery == 0 {
+		opts.ExpireEvery = 30 * time.Second
+	}
+}
+
+// AckTracker : correlates acknowledgements from the devices with the config pushes
+// status of each push is kept on the device record - pending, acked, nacked or expired
+type AckTracker struct {
+	store PushTracker
+	opts  AckOpts
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewAckTracker : starts expiring the pushes that arent acknowledged in time
+// acks are received through the Subscription, hand that over to the consumer
+func NewAckTracker(store PushTracker, opts AckOpts) *AckTracker {
+	opts.defaults()
+	at := &AckTracker{
+		store: store,
+		opts:  opts,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go at.run()
+	return at
+}
+
+// Subscription : consumes CmdAck from the devices on the ack exchange
+func (at *AckTracker) Subscription() Subscription {
+	return Subscription{
+		Name: "acks",
+		Setup: func(ch *amqp.Channel) (string, error) {
+			if err := ch.ExchangeDeclare(at.opts.Exchange, "fanout", true, false, false, false, nil); err != nil {
+				return "", err
+			}
+			q, err := ch.QueueDeclare(at.opts.Queue, true, false, false, false, nil)
+			if err != nil {
+				return "", err
+			}
+			return q.Name, ch.QueueBind(q.Name, "", at.opts.Exchange, false, nil)
+		},
+		Handle: at.handle,
+	}
+}
+
+// handle : marks the push acked / nacked
+// message id of the push is read from the correlation id, and from the payload when that is empty
+func (at *AckTracker) handle(d amqp.Delivery) error {
+	ack := CmdAck{}
+	if err := json.Unmarshal(d.Body, &ack); err != nil {
+		return fmt.Errorf("invalid ack payload %s", err)
+	}
+	msgID := d.CorrelationId
+	if msgID == "" {
+		msgID = ack.MsgID
+	}
+	if msgID == "" || !DevMacID(ack.DevcMacId).IsValid() {
+		return fmt.Errorf("ack from %s missing message id or has invalid mac", ack.DevcMacId)
+	}
+	status := PushNacked
+	if ack.Ack {
+		status = PushAcked
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := at.store.SetPushStatus(DevMacID(ack.DevcMacId), msgID, PushUpdate{Status: status}, ctx); err != nil {
+		return fmt.Errorf("failed to set push status, %v", err)
+	}
+	log.WithFields(log.Fields{
+		"mac":    ack.DevcMacId,
+		"msgid":  msgID,
+		"reqid":  d.Headers["x-request-id"], // when the device passes on the header of the push
+		"status": status,
+	}).Debug("config push acknowledged by device")
+	return nil
+}
+
+func (at *AckTracker) run() {
+	defer close(at.done)
+	tick := time.NewTicker(at.opts.ExpireEvery)
+	defer tick.Stop()
+	for {
+		select {
+		case <-at.stop:
+			return
+		case <-tick.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			n, err := at.store.ExpirePushes(time.Now().Add(-at.opts.Timeout), ctx)
+			cancel()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("failed to expire pending config pushes")
+			} else if n > 0 {
+				log.WithFields(log.Fields{
+					"devices": n,
+				}).Warn("config pushes expired without acknowledgement")
+			}
+		}
+	}
+}
+
+// Close : stops expiring the pushes
+func (at *AckTracker) Close() {
+	close(at.stop)
+	<-at.done
+}
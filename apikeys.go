@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	ApiKeysCollc = func(db *mongo.Database) ApiKeyStore {
+		return &qryApiKeys{Collection: db.Collection("apikeys")}
+	}
+)
+
+const (
+	apiKeyPrefix = "dvk_"      // keys are dvk_<id>_<secret>
+	apiKeyHeader = "X-API-Key" // header the devices send the key in
+)
+
+// ApiKeyStore : keys issued for the devices, only the hash of the secret is stored
+type ApiKeyStore interface {
+	AddKey(key *ApiKey, ctx context.Context) httperr.HttpErr
+	KeysOf(mac DevMacID, result *[]ApiKey, ctx context.Context) httperr.HttpErr
+	KeyOf(id string, result *ApiKey, ctx context.Context) httperr.HttpErr
+	// RotateKey : replaces the secret of the key, errors when the key isnt of the device or is revoked
+	RotateKey(mac DevMacID, id, hash string, at time.Time, ctx context.Context) httperr.HttpErr
+	// RevokeKey : key is no longer accepted, errors when the key isnt of the device or is already revoked
+	RevokeKey(mac DevMacID, id string, at time.Time, ctx context.Context) httperr.HttpErr
+	// TouchKey : records the use of the key
+	TouchKey(id string, at time.Time, ctx context.Context) error
+}
+
+// ApiKeyIndexes : creates the indexes on the apikeys collection, called once on startup
+func ApiKeyIndexes(db *mongo.Database, ctx context.Context) error {
+	_, err := db.Collection("apikeys").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"mac": 1},
+	})
+	return err
+}
+
+type qryApiKeys struct {
+	*mongo.Collection
+}
+
+// AddKey : key is inserted as is, id and hash are generated by the caller
+func (qk *qryApiKeys) AddKey(key *ApiKey, ctx context.Context) httperr.HttpErr {
+	if key == nil || !key.MacID.IsValid() || key.ID == "" || key.Hash == "" {
+		return httperr.ErrInvalidParam(fmt.Errorf("one or more fields on the api key is invalid"))
+	}
+	if _, err := qk.InsertOne(ctx, key); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return httperr.DuplicateResourceErr(fmt.Errorf("api key %s already exists", key.ID))
+		}
+		return httperr.ErrDBQuery(err)
+	}
+	return nil
+}
+
+// KeysOf : keys of the device, revoked ones included, oldest first
+// result		: list of keys, wiped clean before planting results into it
+func (qk *qryApiKeys) KeysOf(mac DevMacID, result *[]ApiKey, ctx context.Context) httperr.HttpErr {
+	if !mac.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid mac id %s for api keys", mac))
+	}
+	*result = []ApiKey{}
+	cursor, err := qk.Find(ctx, bson.M{"mac": mac}, options.Find().SetSort(bson.M{"createdat": 1}))
+	if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	if err := cursor.All(ctx, result); err != nil {
+		return httperr.ErrBinding(err)
+	}
+	return nil
+}
+
+// KeyOf : single key by its id, errors when not found
+func (qk *qryApiKeys) KeyOf(id string, result *ApiKey, ctx context.Context) httperr.HttpErr {
+	*result = ApiKey{}
+	sr := qk.FindOne(ctx, bson.M{"_id": id})
+	if sr.Err() != nil {
+		if errors.Is(sr.Err(), mongo.ErrNoDocuments) {
+			return httperr.ErrResourceNotFound(fmt.Errorf("api key %s not found", id))
+		}
+		return httperr.ErrDBQuery(sr.Err())
+	}
+	if err := sr.Decode(result); err != nil {
+		return httperr.ErrBinding(err)
+	}
+	return nil
+}
+
+func (qk *qryApiKeys) RotateKey(mac DevMacID, id, hash string, at time.Time, ctx context.Context) httperr.HttpErr {
+	ur, err := qk.UpdateOne(ctx, bson.M{"_id": id, "mac": mac, "revokedat": nil}, bson.M{"$set": bson.M{"hash": hash, "rotatedat": at}})
+	if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	if ur.MatchedCount == 0 {
+		return httperr.ErrResourceNotFound(fmt.Errorf("active api key %s not found for device %s", id, mac))
+	}
+	return nil
+}
+
+func (qk *qryApiKeys) RevokeKey(mac DevMacID, id string, at time.Time, ctx context.Context) httperr.HttpErr {
+	ur, err := qk.UpdateOne(ctx, bson.M{"_id": id, "mac": mac, "revokedat": nil}, bson.M{"$set": bson.M{"revokedat": at}})
+	if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	if ur.MatchedCount == 0 {
+		return httperr.ErrResourceNotFound(fmt.Errorf("active api key %s not found for device %s", id, mac))
+	}
+	return nil
+}
+
+func (qk *qryApiKeys) TouchKey(id string, at time.Time, ctx context.Context) error {
+	_, err := qk.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"lastusedat": at}})
+	return err
+}
+
+// IssuedKey : key as sent out when issued or rotated, the only time the full key is seen
+type IssuedKey struct {
+	ApiKey
+	Key string `json:"key"`
+}
+
+// randomHex : n random bytes as hex, ids are 8 bytes and secrets 32
+func randomHex(n int) (string, error) {
+	byt := make([]byte, n)
+	if _, err := rand.Read(byt); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(byt), nil
+}
+
+// newSecret : secret for the key of id, full key to hand out and the hash of the secret to store
+func newSecret(id string) (key, hash string, err error) {
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", "", err
+	}
+	return apiKeyPrefix + id + "_" + secret, hashSecret(secret), nil
+}
+
+// splitApiKey : id and secret of the key, false when the key isnt of the format
+func splitApiKey(raw string) (id, secret string, ok bool) {
+	rest, ok := strings.CutPrefix(raw, apiKeyPrefix)
+	if !ok {
+		return "", "", false
+	}
+	id, secret, ok = strings.Cut(rest, "_")
+	return id, secret, ok && id != "" && secret != ""
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// keyOfRequest : verifies the api key sent, revoked keys and keys with a wrong secret are not accepted
+// errors are 401, but for when the key couldnt be got from the store
+// use of the key is recorded atmost once a minute
+func (app *App) keyOfRequest(c *gin.Context, raw string) (*ApiKey, httperr.HttpErr) {
+	id, secret, ok := splitApiKey(raw)
+	if !ok {
+		return nil, httperr.ErrAuthentication(errors.New("malformed api key"))
+	}
+	if app.Keys == nil {
+		return nil, httperr.ErrAuthentication(errors.New("no store for the api keys"))
+	}
+	ctx, cancel := app.opCtx(c.Request.Context())
+	defer cancel()
+	key := &ApiKey{}
+	if err := app.Keys.KeyOf(id, key, ctx); err != nil {
+		if err.HttpStatusCode() == http.StatusNotFound {
+			return nil, httperr.ErrAuthentication(fmt.Errorf("unknown api key %s", id))
+		}
+		return nil, err
+	}
+	if key.RevokedAt != nil {
+		return nil, httperr.ErrAuthentication(fmt.Errorf("api key %s is revoked", id))
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(key.Hash)) != 1 {
+		return nil, httperr.ErrAuthentication(fmt.Errorf("invalid secret for api key %s", id))
+	}
+	now := time.Now()
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > time.Minute {
+		if err := app.Keys.TouchKey(id, now, ctx); err != nil {
+			reqLog(c).WithFields(log.Fields{
+				"keyid": id,
+				"err":   err,
+			}).Warn("failed to record use of api key")
+		}
+	}
+	return key, nil
+}
+
+// apiKeyOf : api key the request was authenticated with, nil when its a user's token
+func apiKeyOf(c *gin.Context) *ApiKey {
+	val, _ := c.Get("apikey")
+	key, _ := val.(*ApiKey)
+	return key
+}
+
+// UsersOnly : routes that are not of a single device - listing, trash, managing keys - are not for api keys
+func UsersOnly(c *gin.Context) {
+	if key := apiKeyOf(c); key != nil {
+		forbidden(c, fmt.Errorf("api key %s can only be used on the calls of device %s", key.ID, key.MacID), "UsersOnly")
+		return
+	}
+	c.Next()
+}
+
+// Reporting : routes the device calls itself - heartbeats, reported config - the only ones its api keys are good for
+func Reporting(c *gin.Context) {
+	c.Set("reporting", true)
+	c.Next()
+}
+
+// HndlApiKeys : api keys of the device, only the owners manage them
+// GET lists the keys, POST issues a new one
+// POST /:keyid/rotate replaces the secret of the key, DELETE /:keyid revokes it
+// the full key is sent out only when issued / rotated, it cannot be got back later
+func (app *App) HndlApiKeys(c *gin.Context) {
+	ctx, cancel := app.opCtx(c.Request.Context())
+	defer cancel()
+	val, _ := c.Get("device")
+	deviceDetails, _ := val.(*Device)
+	if !permitted(c, deviceDetails, RoleOwner, "HndlApiKeys") {
+		return
+	}
+	keyID := c.Param("keyid")
+	now := time.Now()
+	switch {
+	case c.Request.Method == "GET":
+		result := []ApiKey{}
+		if err := app.Keys.KeysOf(deviceDetails.MacID, &result, ctx); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+				"stack_trace": "HndlApiKeys/GET",
+				"mac":         deviceDetails.MacID,
+			}))
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusOK, result)
+		return
+	case c.Request.Method == "POST" && keyID == "":
+		// name is optional, what the key is for
+		payload := struct {
+			Name string `json:"name"`
+		}{}
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBind(&payload); err != nil {
+				httperr.HttpErrOrOkDispatch(c, httperr.ErrBinding(err), reqLog(c).WithFields(log.Fields{
+					"stack_trace": "HndlApiKeys/POST",
+				}))
+				return
+			}
+		}
+		id, err := randomHex(8)
+		raw, hash := "", ""
+		if err == nil {
+			raw, hash, err = newSecret(id)
+		}
+		if err != nil {
+			httperr.HttpErrOrOkDispatch(c, httperr.ErrDBQuery(err), reqLog(c).WithFields(log.Fields{
+				"stack_trace": "HndlApiKeys/POST",
+			}))
+			return
+		}
+		key := ApiKey{ID: id, MacID: deviceDetails.MacID, Name: payload.Name, Hash: hash, CreatedBy: actorOf(c), CreatedAt: now}
+		if err := app.Keys.AddKey(&key, ctx); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+				"stack_trace": "HndlApiKeys/POST",
+				"mac":         deviceDetails.MacID,
+			}))
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusCreated, IssuedKey{ApiKey: key, Key: raw})
+		return
+	case c.Request.Method == "POST" && strings.HasSuffix(c.FullPath(), "/rotate"):
+		// id stays the same, only the secret changes
+		raw, hash, err := newSecret(keyID)
+		if err != nil {
+			httperr.HttpErrOrOkDispatch(c, httperr.ErrDBQuery(err), reqLog(c).WithFields(log.Fields{
+				"stack_trace": "HndlApiKeys/rotate",
+			}))
+			return
+		}
+		if err := app.Keys.RotateKey(deviceDetails.MacID, keyID, hash, now, ctx); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+				"stack_trace": "HndlApiKeys/rotate",
+				"mac":         deviceDetails.MacID,
+				"keyid":       keyID,
+			}))
+			return
+		}
+		key := ApiKey{}
+		if err := app.Keys.KeyOf(keyID, &key, ctx); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+				"stack_trace": "HndlApiKeys/rotate",
+			}))
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusOK, IssuedKey{ApiKey: key, Key: raw})
+		return
+	case c.Request.Method == "DELETE" && keyID != "":
+		if err := app.Keys.RevokeKey(deviceDetails.MacID, keyID, now, ctx); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+				"stack_trace": "HndlApiKeys/DELETE",
+				"mac":         deviceDetails.MacID,
+				"keyid":       keyID,
+			}))
+			return
+		}
+		c.AbortWithStatus(http.StatusOK)
+		return
+	}
+	c.AbortWithStatus(http.StatusMethodNotAllowed)
+}
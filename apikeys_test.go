@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// issueKey : issues a key on the device as testUser, fails the test if it couldnt be
+func (ts *testServer) issueKey(t *testing.T, mac DevMacID) IssuedKey {
+	t.Helper()
+	rec := ts.do("POST", "/api/devices/"+string(mac)+"/keys", gin.H{"name": "firmware"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("failed to issue key for %s: %d %s", mac, rec.Code, rec.Body)
+	}
+	issued := IssuedKey{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &issued); err != nil {
+		t.Fatal(err)
+	}
+	return issued
+}
+
+func TestApiKeys(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, test200MacID)
+	other := DevMacID("52-3C-42-D4-A9-F0")
+	ts.register(t, other)
+	path := "/api/devices/" + string(test200MacID)
+	newCfg := gin.H{"tickat": "05:00", "config": 1, "interval": 60, "pulsegap": 1800}
+
+	issued := ts.issueKey(t, test200MacID)
+	if !strings.HasPrefix(issued.Key, "dvk_"+issued.ID+"_") || issued.MacID != test200MacID || issued.CreatedBy != testUser {
+		t.Fatalf("unexpected key issued %+v", issued)
+	}
+	t.Run("secret not stored", func(t *testing.T) {
+		stored := ApiKey{}
+		if err := ts.store.KeyOf(issued.ID, &stored, context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if stored.Hash == "" || strings.Contains(issued.Key, stored.Hash) {
+			t.Errorf("key stored as is %+v", stored)
+		}
+		rec := ts.do("GET", path+"/keys", nil)
+		if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), stored.Hash) || strings.Contains(rec.Body.String(), issued.Key) {
+			t.Errorf("listing keys gave out the secret %d %s", rec.Code, rec.Body)
+		}
+	})
+	t.Run("only owners manage keys", func(t *testing.T) {
+		if rec := ts.do("POST", path+"/keys", nil, "Authorization", bearer("stranger@eensymachines.in")); rec.Code != http.StatusForbidden {
+			t.Errorf("stranger issuing, expected 403 got %d", rec.Code)
+		}
+		if rec := ts.do("POST", path+"/keys", nil); rec.Code != http.StatusCreated {
+			t.Errorf("issuing without a name, expected 201 got %d %s", rec.Code, rec.Body)
+		}
+	})
+	t.Run("good on its own device", func(t *testing.T) {
+		for _, c := range []struct {
+			method, path string
+			body         interface{}
+			want         int
+		}{
+			{"POST", path + "/heartbeat", gin.H{"firmware": "1.2.0"}, http.StatusOK},
+			{"POST", path + "/reported", newCfg, http.StatusOK},
+			{"GET", path + "/shadow", nil, http.StatusForbidden},
+			{"GET", path, nil, http.StatusForbidden},
+			{"PATCH", path + "?path=config&action=replace", newCfg, http.StatusForbidden},
+			{"POST", path + "/revisions/1/rollback", nil, http.StatusForbidden},
+			{"PATCH", path + "?path=enckey&action=replace", gin.H{"encKey": nil}, http.StatusForbidden},
+			{"POST", "/api/devices/" + string(other) + "/heartbeat", gin.H{}, http.StatusForbidden},
+			{"GET", "/api/devices/" + string(other), nil, http.StatusForbidden},
+			{"DELETE", path, nil, http.StatusForbidden},
+			{"PATCH", path + "?path=users&action=append", []string{"someone@eensymachines.in"}, http.StatusForbidden},
+			{"GET", "/api/devices?filter=users", nil, http.StatusForbidden},
+			{"GET", "/api/devices/trash", nil, http.StatusForbidden},
+			{"POST", "/api/devices", registration("52-3C-42-D4-A9-F1"), http.StatusForbidden},
+			{"GET", path + "/keys", nil, http.StatusForbidden},
+			{"POST", path + "/keys", nil, http.StatusForbidden},
+		} {
+			if rec := ts.do(c.method, c.path, c.body, "X-API-Key", issued.Key); rec.Code != c.want {
+				t.Errorf("%s %s, expected %d got %d %s", c.method, c.path, c.want, rec.Code, rec.Body)
+			}
+		}
+		stored := ApiKey{}
+		ts.store.KeyOf(issued.ID, &stored, context.Background())
+		if stored.LastUsedAt == nil {
+			t.Error("use of the key not recorded")
+		}
+	})
+	t.Run("unknown keys", func(t *testing.T) {
+		for _, key := range []string{"dvk_", "not-a-key", "dvk_0000000000000000_00", issued.Key[:len(issued.Key)-4] + "zzzz"} {
+			if rec := ts.do("GET", path, nil, "X-API-Key", key); rec.Code != http.StatusUnauthorized {
+				t.Errorf("key %q, expected 401 got %d", key, rec.Code)
+			}
+		}
+	})
+	t.Run("rotate", func(t *testing.T) {
+		rec := ts.do("POST", path+"/keys/"+issued.ID+"/rotate", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body)
+		}
+		rotated := IssuedKey{}
+		json.Unmarshal(rec.Body.Bytes(), &rotated)
+		if rotated.ID != issued.ID || rotated.Key == issued.Key || rotated.RotatedAt == nil {
+			t.Fatalf("key not rotated %+v", rotated)
+		}
+		if rec := ts.do("GET", path, nil, "X-API-Key", issued.Key); rec.Code != http.StatusUnauthorized {
+			t.Errorf("old key after rotation, expected 401 got %d", rec.Code)
+		}
+		if rec := ts.do("POST", path+"/heartbeat", gin.H{}, "X-API-Key", rotated.Key); rec.Code != http.StatusOK {
+			t.Errorf("rotated key, expected 200 got %d", rec.Code)
+		}
+		if rec := ts.do("POST", "/api/devices/"+string(other)+"/keys/"+issued.ID+"/rotate", nil); rec.Code != http.StatusNotFound {
+			t.Errorf("rotating the key on another device, expected 404 got %d", rec.Code)
+		}
+		issued = rotated
+	})
+	t.Run("revoke", func(t *testing.T) {
+		if rec := ts.do("DELETE", path+"/keys/"+issued.ID, nil); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body)
+		}
+		if rec := ts.do("GET", path, nil, "X-API-Key", issued.Key); rec.Code != http.StatusUnauthorized {
+			t.Errorf("revoked key, expected 401 got %d", rec.Code)
+		}
+		if rec := ts.do("DELETE", path+"/keys/"+issued.ID, nil); rec.Code != http.StatusNotFound {
+			t.Errorf("revoking again, expected 404 got %d", rec.Code)
+		}
+		if rec := ts.do("POST", path+"/keys/"+issued.ID+"/rotate", nil); rec.Code != http.StatusNotFound {
+			t.Errorf("rotating revoked key, expected 404 got %d", rec.Code)
+		}
+	})
+	t.Run("purged with the device", func(t *testing.T) {
+		live := ts.issueKey(t, other)
+		ts.do("DELETE", "/api/devices/"+string(other), nil)
+		if rec := ts.do("DELETE", "/api/devices/trash/"+string(other), nil); rec.Code != http.StatusOK {
+			t.Fatalf("purging, expected 200 got %d", rec.Code)
+		}
+		ts.register(t, other)
+		if rec := ts.do("GET", "/api/devices/"+string(other), nil, "X-API-Key", live.Key); rec.Code != http.StatusUnauthorized {
+			t.Errorf("key of the purged device, expected 401 got %d", rec.Code)
+		}
+	})
+}
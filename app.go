@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// App : dependencies shared by all the handlers for the life of the process
+// Handlers are methods on the App, so nothing is connected / disconnected per request
+type App struct {
+	Mongo     *MongoPool           // shared mongo client with its pool, nil when running on any other store
+	Devices   QueryDevices         // devices collection over the shared client
+	Outbox    ConfigOutbox         // config changes with their outgoing messages
+	Revisions RevisionStore        // history of the config changes
+	Relay     *OutboxRelay         // delivers the outbox messages to the devices
+	Acks      *AckTracker          // acknowledgements from the devices for the config pushes
+	Presence  *Presences           // heartbeats from the devices and their online status
+	Shadows   *Shadows             // reported config from the devices and reconciliation with the desired
+	Purger    *Purger              // purges the devices past their time in the trash
+	Health    *Health              // dependencies reported on /status and /readyz
+	Metrics   *prometheus.Registry // served on /metrics
+	Auth      *Authenticator       // verifies the bearer tokens on /api/devices, all requests are turned away when nil
+	Keys      ApiKeyStore          // api keys of the devices, for calls made without a user's token
+	Signing   SigningKeyStore      // keys the config pushes are signed with
+
+	trashFor time.Duration // deleted devices are kept in the trash this long
+}
+
+// AppOpts : tuning for the background workers of the app
+type AppOpts struct {
+	Relay    RelayOpts
+	Acks     AckOpts
+	Presence PresenceOpts
+	Shadow   ShadowOpts
+	Purge    PurgeOpts
+	TrashFor time.Duration // how long deleted devices are kept before purging, 30 days when zero
+}
+
+// NewApp : wires up the handlers' dependencies over the stores and publisher
+// pool is the mongo pool the stores are on, nil when they arent
+// mongo and the publisher, if it reports its health, are what the api's readiness goes by
+// background workers are started here, call Close on the way out
+func NewApp(pool *MongoPool, stores Stores, pub CfgPublisher, opts AppOpts) *App {
+	if opts.TrashFor == 0 {
+		opts.TrashFor = 30 * 24 * time.Hour
+	}
+	health := NewHealth()
+	if pool != nil {
+		health.Watch("mongo", pool, true)
+	}
+	if hr, ok := pub.(HealthReporter); ok {
+		health.Watch("amqp-publisher", hr, true)
+	}
+	presence := NewPresences(stores.Presence, opts.Presence)
+	// stores are timed and traced on each operation
+	devices := observedDevices{stores.Devices}
+	outbox := observedOutbox{stores.Outbox}
+	pushes := observedPushes{stores.Pushes}
+	signing := observedSigning{stores.Signing}
+	return &App{
+		Mongo:     pool,
+		Devices:   devices,
+		Outbox:    outbox,
+		Revisions: observedRevisions{stores.Revisions},
+		Keys:      observedKeys{stores.Keys},
+		Signing:   signing,
+		Relay:     NewOutboxRelay(outbox, pushes, NewSigner(signing), pub, opts.Relay),
+		Acks:      NewAckTracker(pushes, opts.Acks),
+		Presence:  presence,
+		Shadows:   NewShadows(stores.Shadows, outbox, opts.Shadow),
+		Purger:    NewPurger(devices, opts.Purge),
+		Health:    health,
+		Metrics:   NewMetrics(stores.Fleet, presence.opts.OnlineWithin),
+		trashFor:  opts.TrashFor,
+	}
+}
+
+// Subscriptions : queues the app consumes from, hand these over to the amqp consumer
+func (app *App) Subscriptions() []Subscription {
+	return []Subscription{app.Acks.Subscription(), app.Presence.Subscription(), app.Shadows.Subscription()}
+}
+
+// Close : stops the background workers
+func (app *App) Close() {
+	app.Relay.Close()
+	app.Acks.Close()
+	app.Shadows.Close()
+	app.Purger.Close()
+}
+
+// opCtx : context for the store operations of a request, bounded by the op timeout when on mongo
+func (app *App) opCtx(parent context.Context) (context.Context, context.CancelFunc) {
+	if app.Mongo != nil {
+		return app.Mongo.OpCtx(parent)
+	}
+	return context.WithCancel(parent)
+}
+
+// decorate : fields on the device derived at the time of dispatch - status and shadow
+func (app *App) decorate(dev *Device, now time.Time) {
+	dev.Status = app.Presence.StatusOf(dev, now)
+	dev.Shadow = ShadowOf(dev)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// AuthOpts : keys the bearer tokens are verified with, at least one of Secret / PubKey is required
+// Tokens are issued elsewhere, the subject of the token is the email of the user as on Device.Users
+type AuthOpts struct {
+	Secret   string        // HS256 shared secret
+	PubKey   string        // RS256 public key of the issuer, PEM
+	Issuer   string        // iss the tokens must have, not checked when empty
+	Audience string        // aud the tokens must have, not checked when empty
+	Leeway   time.Duration // clock skew allowed on exp / nbf, 30s when zero
+}
+
+func (opts *AuthOpts) defaults() {
+	if opts.Leeway == 0 {
+		opts.Leeway = 30 * time.Second
+	}
+}
+
+// Authenticator : verifies the bearer tokens on the requests
+type Authenticator struct {
+	secret []byte
+	pubKey *rsa.PublicKey
+	parser *jwt.Parser
+}
+
+// NewAuthenticator : errors when there is no key or the public key cannot be parsed
+// only the algorithms there is a key for are accepted, tokens without expiry are not
+func NewAuthenticator(opts AuthOpts) (*Authenticator, error) {
+	opts.defaults()
+	au := &Authenticator{}
+	methods := []string{}
+	if opts.Secret != "" {
+		au.secret = []byte(opts.Secret)
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if opts.PubKey != "" {
+		key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(opts.PubKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key for the tokens: %w", err)
+		}
+		au.pubKey = key
+		methods = append(methods, jwt.SigningMethodRS256.Alg())
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no key to verify the tokens with")
+	}
+	popts := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(opts.Leeway),
+	}
+	if opts.Issuer != "" {
+		popts = append(popts, jwt.WithIssuer(opts.Issuer))
+	}
+	if opts.Audience != "" {
+		popts = append(popts, jwt.WithAudience(opts.Audience))
+	}
+	au.parser = jwt.NewParser(popts...)
+	return au, nil
+}
+
+// keyOf : key for the algorithm of the token, methods are already narrowed down by the parser
+func (au *Authenticator) keyOf(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		return au.secret, nil
+	case *jwt.SigningMethodRSA:
+		return au.pubKey, nil
+	}
+	return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+}
+
+// Subject : verifies the token and gets the user it was issued for
+func (au *Authenticator) Subject(raw string) (string, error) {
+	claims := jwt.RegisteredClaims{}
+	if _, err := au.parser.ParseWithClaims(raw, &claims, au.keyOf); err != nil {
+		return "", err
+	}
+	if claims.Subject == "" {
+		return "", fmt.Errorf("token has no subject")
+	}
+	return claims.Subject, nil
+}
+
+// Authenticated : requests without a valid bearer token or api key are turned away with 401
+// subject of the token is set in the context as the user, the api key as is, preflights are let through as is
+func (app *App) Authenticated(c *gin.Context) {
+	if c.Request.Method == "OPTIONS" {
+		c.Next()
+		return
+	}
+	if raw := c.GetHeader(apiKeyHeader); raw != "" {
+		key, herr := app.keyOfRequest(c, raw)
+		if herr != nil {
+			if herr.HttpStatusCode() == http.StatusUnauthorized {
+				c.Header("WWW-Authenticate", `Bearer realm="devicereg"`)
+			}
+			httperr.HttpErrOrOkDispatch(c, herr, reqLog(c).WithFields(log.Fields{
+				"stack_trace": "Authenticated/apikey",
+			}))
+			return
+		}
+		c.Set("apikey", key)
+		c.Next()
+		return
+	}
+	raw, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	var err error
+	user := ""
+	if !ok || raw == "" {
+		err = errors.New("missing bearer token")
+	} else if app.Auth == nil {
+		err = errors.New("no authenticator for the tokens")
+	} else {
+		user, err = app.Auth.Subject(raw)
+	}
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer realm="devicereg"`)
+		httperr.HttpErrOrOkDispatch(c, httperr.ErrAuthentication(err), reqLog(c).WithFields(log.Fields{
+			"stack_trace": "Authenticated",
+		}))
+		return
+	}
+	c.Set("user", user)
+	c.Next()
+}
+
+// userOf : user the request was authenticated for, empty when not
+func userOf(c *gin.Context) string {
+	return c.GetString("user")
+}
+
+// forbidden : aborts with 403, user is authenticated but not allowed on the device
+func forbidden(c *gin.Context, err error, stack string) {
+	httperr.HttpErrOrOkDispatch(c, httperr.ErrForbidden(err), reqLog(c).WithFields(log.Fields{
+		"stack_trace": stack,
+		"user":        actorOf(c),
+	}))
+}
+
+// roleOf : role of the caller on the device, api keys are the device itself on the device they are of and nothing elsewhere
+func roleOf(c *gin.Context, dev *Device) string {
+	if key := apiKeyOf(c); key != nil {
+		if key.MacID == dev.MacID {
+			return RoleDevice
+		}
+		return ""
+	}
+	return dev.RoleOf(userOf(c))
+}
+
+// permitted : caller of the request has atleast the role needed on the device, aborts with 403 when not
+func permitted(c *gin.Context, dev *Device, need string, stack string) bool {
+	role := roleOf(c, dev)
+	if RoleAtLeast(role, need) || (role == RoleDevice && c.GetBool("reporting")) {
+		return true
+	}
+	if role == "" {
+		forbidden(c, fmt.Errorf("%s is not a user of device %s", actorOf(c), dev.MacID), stack)
+	} else {
+		forbidden(c, fmt.Errorf("%s is %s on device %s, has to be %s", actorOf(c), role, dev.MacID, need), stack)
+	}
+	return false
+}
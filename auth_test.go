@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestAuthentication(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, test200MacID)
+	path := "/api/devices/" + string(test200MacID)
+	signed := func(method jwt.SigningMethod, key interface{}, claims jwt.RegisteredClaims) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + token
+	}
+	for name, auth := range map[string]string{
+		"no token":     "",
+		"not bearer":   "Basic a25lZXJ1bmp1bjpwYXNz",
+		"wrong secret": signed(jwt.SigningMethodHS256, []byte("not-the-secret"), jwt.RegisteredClaims{Subject: testUser, ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}),
+		"expired":      signed(jwt.SigningMethodHS256, []byte(testJWTSecret), jwt.RegisteredClaims{Subject: testUser, ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Hour))}),
+		"no expiry":    signed(jwt.SigningMethodHS256, []byte(testJWTSecret), jwt.RegisteredClaims{Subject: testUser}),
+		"no subject":   signed(jwt.SigningMethodHS256, []byte(testJWTSecret), jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}),
+		"alg none":     signed(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, jwt.RegisteredClaims{Subject: testUser, ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := ts.do("GET", path, nil, "Authorization", auth)
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("expected 401, got %d %s", rec.Code, rec.Body)
+			}
+			if rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate on 401")
+			}
+		})
+	}
+	if rec := ts.do("OPTIONS", path, nil, "Authorization", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("preflight without token, expected 204 got %d", rec.Code)
+	}
+	if rec := ts.do("GET", path, nil); rec.Code != http.StatusOK {
+		t.Errorf("valid token, expected 200 got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAuthenticationRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	auth, err := NewAuthenticator(AuthOpts{PubKey: string(pubPEM), Issuer: "auth.eensymachines.in"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range map[string]struct {
+		method jwt.SigningMethod
+		key    interface{}
+		iss    string
+		ok     bool
+	}{
+		"rs256":          {jwt.SigningMethodRS256, key, "auth.eensymachines.in", true},
+		"other issuer":   {jwt.SigningMethodRS256, key, "elsewhere", false},
+		"hs256 no key":   {jwt.SigningMethodHS256, []byte(testJWTSecret), "auth.eensymachines.in", false},
+		"pubkey as hmac": {jwt.SigningMethodHS256, pubPEM, "auth.eensymachines.in", false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			raw, err := jwt.NewWithClaims(c.method, jwt.RegisteredClaims{
+				Subject:   testUser,
+				Issuer:    c.iss,
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			}).SignedString(c.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sub, err := auth.Subject(raw)
+			if c.ok && (err != nil || sub != testUser) {
+				t.Errorf("expected token for %s, got %q %v", testUser, sub, err)
+			} else if !c.ok && err == nil {
+				t.Error("expected token to be rejected")
+			}
+		})
+	}
+	if _, err := NewAuthenticator(AuthOpts{}); err == nil {
+		t.Error("expected error without any key")
+	}
+	if _, err := NewAuthenticator(AuthOpts{PubKey: "not a pem"}); err == nil {
+		t.Error("expected error for an invalid public key")
+	}
+}
+
+// TestOwnership : users not on the device cannot see or change it
+func TestOwnership(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, test200MacID)
+	path := "/api/devices/" + string(test200MacID)
+	stranger := bearer("behenkaloda@gmail.com")
+	newCfg := gin.H{"tickat": "05:00", "config": 1, "interval": 60, "pulsegap": 1800}
+
+	for _, req := range []struct {
+		method, path string
+		body         interface{}
+	}{
+		{"GET", path, nil},
+		{"PATCH", path + "?path=config&action=replace", newCfg},
+		{"PATCH", path + "?path=users&action=append", []string{"behenkaloda@gmail.com"}},
+		{"DELETE", path, nil},
+		{"GET", path + "/shadow", nil},
+		{"GET", path + "/revisions", nil},
+		{"POST", path + "/heartbeat", gin.H{}},
+	} {
+		if rec := ts.do(req.method, req.path, req.body, "Authorization", stranger); rec.Code != http.StatusForbidden {
+			t.Errorf("%s %s by a stranger, expected 403 got %d", req.method, req.path, rec.Code)
+		}
+	}
+	if ts.pub.count() != 0 {
+		t.Error("config pushed by a stranger")
+	}
+	reg := registration("52-3C-42-D4-A9-F0")
+	if rec := ts.do("POST", "/api/devices", reg, "Authorization", stranger); rec.Code != http.StatusForbidden {
+		t.Errorf("registering for others, expected 403 got %d", rec.Code)
+	}
+
+	t.Run("list of the token's user", func(t *testing.T) {
+		rec := ts.do("GET", "/api/devices?filter=users&user="+testUser, nil, "Authorization", stranger)
+		devs := []Device{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &devs); err != nil || len(devs) != 0 {
+			t.Errorf("stranger got the devices of another user %s", rec.Body)
+		}
+	})
+	t.Run("trash of the token's user", func(t *testing.T) {
+		if rec := ts.do("DELETE", path, nil); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		rec := ts.do("GET", "/api/devices/trash?user="+testUser, nil, "Authorization", stranger)
+		devs := []Device{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &devs); err != nil || len(devs) != 0 {
+			t.Errorf("stranger got the trash of another user %s", rec.Body)
+		}
+		if rec := ts.do("POST", "/api/devices/trash/"+string(test200MacID)+"/restore", nil, "Authorization", stranger); rec.Code != http.StatusNotFound {
+			t.Errorf("stranger restoring, expected 404 got %d", rec.Code)
+		}
+		if rec := ts.do("DELETE", "/api/devices/trash/"+string(test200MacID), nil, "Authorization", stranger); rec.Code != http.StatusNotFound {
+			t.Errorf("stranger purging, expected 404 got %d", rec.Code)
+		}
+		if rec := ts.do("POST", "/api/devices/trash/"+string(test200MacID)+"/restore", nil); rec.Code != http.StatusOK {
+			t.Errorf("user restoring, expected 200 got %d", rec.Code)
+		}
+	})
+	t.Run("changes by the token's user", func(t *testing.T) {
+		if rec := ts.do("PATCH", path+"?path=config&action=replace", newCfg, "Authorization", bearer("awatiniranjan@gmail.com"), "X-Operator", "someone@else.com"); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body)
+		}
+		revs := []CfgRevision{}
+		ts.store.Revisions(test200MacID, &revs, context.Background())
+		if len(revs) != 1 || revs[0].By != "awatiniranjan@gmail.com" {
+			t.Errorf("change not recorded against the token's user %+v", revs)
+		}
+	})
+}
+
+// TestRoles : what each role can do on the device, owners are never all removed
+func TestRoles(t *testing.T) {
+	ts := newTestServer(t)
+	path := "/api/devices/" + string(test200MacID)
+	reg := registration(test200MacID)
+	reg["users"] = []interface{}{
+		testUser,
+		gin.H{"email": "operator@eensymachines.in", "role": RoleOperator},
+		gin.H{"email": "viewer@eensymachines.in", "role": RoleViewer},
+	}
+	rec := ts.do("POST", "/api/devices", reg)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("failed to register device: %d %s", rec.Code, rec.Body)
+	}
+	if dev := decodeDevice(t, rec); dev.Users[0].Role != RoleOwner || dev.Users[2].Role != RoleViewer || dev.Users[1].AddedBy != testUser || dev.Users[1].AddedAt.IsZero() {
+		t.Fatalf("users not registered with their roles %+v", dev.Users)
+	}
+	operator, viewer := bearer("operator@eensymachines.in"), bearer("viewer@eensymachines.in")
+	newCfg := gin.H{"tickat": "05:00", "config": 1, "interval": 60, "pulsegap": 1800}
+
+	for _, c := range []struct {
+		token, method, path string
+		body                interface{}
+		want                int
+	}{
+		{viewer, "GET", path, nil, http.StatusOK},
+		{viewer, "GET", path + "/revisions", nil, http.StatusOK},
+		{viewer, "GET", path + "/shadow", nil, http.StatusOK},
+		{viewer, "PATCH", path + "?path=config&action=replace", newCfg, http.StatusForbidden},
+		{viewer, "POST", path + "/revisions/1/rollback", nil, http.StatusForbidden},
+		{viewer, "POST", path + "/heartbeat", gin.H{}, http.StatusForbidden},
+		{viewer, "POST", path + "/reported", newCfg, http.StatusForbidden},
+		{operator, "PATCH", path + "?path=config&action=replace", newCfg, http.StatusOK},
+		{operator, "PATCH", path + "?path=users&action=append", []string{"operator@eensymachines.in"}, http.StatusForbidden},
+		{operator, "DELETE", path, nil, http.StatusForbidden},
+		{viewer, "DELETE", path, nil, http.StatusForbidden},
+	} {
+		if rec := ts.do(c.method, c.path, c.body, "Authorization", c.token); rec.Code != c.want {
+			t.Errorf("%s %s, expected %d got %d %s", c.method, c.path, c.want, rec.Code, rec.Body)
+		}
+	}
+
+	t.Run("never without an owner", func(t *testing.T) {
+		noOwner := []gin.H{{"email": testUser, "role": RoleOperator}}
+		if rec := ts.do("PATCH", path+"?path=users&action=replace", noOwner); rec.Code != http.StatusBadRequest {
+			t.Fatalf("replacing with no owner, expected 400 got %d", rec.Code)
+		}
+		handover := []gin.H{
+			{"email": "operator@eensymachines.in", "role": RoleOwner},
+			{"email": testUser, "role": RoleViewer},
+		}
+		rec := ts.do("PATCH", path+"?path=users&action=replace", handover)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body)
+		}
+		dev := decodeDevice(t, rec)
+		if usersOf(dev.Users) != "[operator@eensymachines.in:owner kneerunjun@gmail.com:viewer]" {
+			t.Fatalf("users not replaced %+v", dev.Users)
+		}
+		if dev.Users[1].AddedBy != testUser {
+			t.Errorf("user already on the device lost who added it %+v", dev.Users[1])
+		}
+		// the one time owner is a viewer now
+		if rec := ts.do("DELETE", path, nil); rec.Code != http.StatusForbidden {
+			t.Errorf("viewer deleting, expected 403 got %d", rec.Code)
+		}
+	})
+	t.Run("trash by the owners", func(t *testing.T) {
+		if rec := ts.do("DELETE", path, nil, "Authorization", operator); rec.Code != http.StatusOK {
+			t.Fatalf("owner deleting, expected 200 got %d", rec.Code)
+		}
+		if rec := ts.do("POST", "/api/devices/trash/"+string(test200MacID)+"/restore", nil); rec.Code != http.StatusForbidden {
+			t.Errorf("viewer restoring, expected 403 got %d", rec.Code)
+		}
+		if rec := ts.do("POST", "/api/devices/trash/"+string(test200MacID)+"/restore", nil, "Authorization", operator); rec.Code != http.StatusOK {
+			t.Errorf("owner restoring, expected 200 got %d", rec.Code)
+		}
+	})
+	t.Run("registering as other than owner", func(t *testing.T) {
+		reg := registration("52-3C-42-D4-A9-F0")
+		reg["users"] = []gin.H{{"email": "someone@eensymachines.in", "role": RoleOwner}, {"email": testUser, "role": RoleOperator}}
+		if rec := ts.do("POST", "/api/devices", reg); rec.Code != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", rec.Code)
+		}
+	})
+}
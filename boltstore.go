@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const bktMeta = "meta" // schema version of the bolt file
+
+// boltMigrations : schema changes to the bolt file in order, a file at version n has had the first n applied
+// NOTE: append new migrations at the end, never change or reorder the ones that are out
+var boltMigrations = []func(tx *bolt.Tx) error{
+	// 1: buckets for the devices, outbox and revisions
+	func(tx *bolt.Tx) error {
+		for _, bkt := range []string{bktDevices, bktOutbox, bktRevisions} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bkt)); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 2: users on the devices from plain emails to memberships, the emails are owners
+	// documents are changed as is, not through Device, so this stays as it is when Device changes
+	func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bktDevices))
+		now := time.Now()
+		updated := map[string][]byte{}
+		err := bkt.ForEach(func(k, v []byte) error {
+			doc := bson.D{}
+			if err := bson.Unmarshal(v, &doc); err != nil {
+				return err
+			}
+			for i, elem := range doc {
+				users, ok := elem.Value.(bson.A)
+				if elem.Key != "users" || !ok {
+					continue
+				}
+				for j, u := range users {
+					if email, ok := u.(string); ok {
+						users[j] = bson.D{{Key: "email", Value: email}, {Key: "role", Value: "owner"}, {Key: "addedat", Value: now}}
+					}
+				}
+				doc[i].Value = users
+			}
+			byt, err := bson.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			updated[string(k)] = byt
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, v := range updated {
+			if err := bkt.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 3: bucket for the api keys of the devices
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bktApiKeys))
+		return err
+	},
+	// 4: bucket for the keys the config pushes are signed with
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bktSignKeys))
+		return err
+	},
+}
+
+// NewBoltStore : store on an embedded bolt file, for gateways that run without mongo
+// file is created if not there and migrated to the latest schema
+// Errors when the file cant be opened - held by another process for more than a few seconds
+func NewBoltStore(path string) (*KVStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt file %s: %w", path, err)
+	}
+	if err := migrateBolt(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return NewKVStore(&boltKV{db: db}), nil
+}
+
+// migrateBolt : applies the migrations the file hasnt had yet, all of them in one transaction along with the version
+func migrateBolt(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(bktMeta))
+		if err != nil {
+			return err
+		}
+		version := 0
+		if byt := meta.Get([]byte("schema")); byt != nil {
+			version = int(binary.BigEndian.Uint64(byt))
+		}
+		if version > len(boltMigrations) {
+			return fmt.Errorf("bolt file is at schema %d, newer than this build knows of (%d)", version, len(boltMigrations))
+		}
+		for ; version < len(boltMigrations); version++ {
+			if err := boltMigrations[version](tx); err != nil {
+				return fmt.Errorf("failed to migrate bolt file to schema %d: %w", version+1, err)
+			}
+			log.WithFields(log.Fields{
+				"schema": version + 1,
+			}).Info("migrated bolt file")
+		}
+		return meta.Put([]byte("schema"), binary.BigEndian.AppendUint64(nil, uint64(version)))
+	})
+}
+
+// boltKV : buckets on the bolt file, bolt allows one writer at a time
+type boltKV struct {
+	db *bolt.DB
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (kv *boltKV) View(fn func(tx kvTx) error) error {
+	return kv.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (kv *boltKV) Update(fn func(tx kvTx) error) error {
+	return kv.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (kv *boltKV) Close() error {
+	return kv.db.Close()
+}
+
+func (bt *boltTx) bucket(name string) (*bolt.Bucket, error) {
+	bkt := bt.tx.Bucket([]byte(name))
+	if bkt == nil {
+		return nil, fmt.Errorf("bucket %s not found, bolt file not migrated", name)
+	}
+	return bkt, nil
+}
+
+// Get : value is copied out since bolt's is valid only for the transaction
+func (bt *boltTx) Get(bucket, key string) ([]byte, error) {
+	bkt, err := bt.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	if val := bkt.Get([]byte(key)); val != nil {
+		return append([]byte{}, val...), nil
+	}
+	return nil, nil
+}
+
+func (bt *boltTx) Put(bucket, key string, val []byte) error {
+	bkt, err := bt.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return bkt.Put([]byte(key), val)
+}
+
+func (bt *boltTx) Delete(bucket, key string) error {
+	bkt, err := bt.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return bkt.Delete([]byte(key))
+}
+
+func (bt *boltTx) ForEach(bucket string, fn func(key string, val []byte) error) error {
+	bkt, err := bt.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return bkt.ForEach(func(k, v []byte) error {
+		return fn(string(k), v)
+	})
+}
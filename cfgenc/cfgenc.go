@@ -0,0 +1,167 @@
+// Package cfgenc : config pushes encrypted for a single device
+// The device makes an X25519 key pair at provisioning and the public key is registered on the device (encKey)
+// The registry then encrypts each push with a fresh ephemeral key - X25519 with the device's key, HKDF-SHA256, ChaCha20-Poly1305
+// Routing key (mac) and message id of the push are bound in as additional data, a push cannot be moved to another device or message
+//
+//	priv, pub, _ := cfgenc.GenerateKey() // once at provisioning, pub goes on the device registration
+//	..
+//	if cfgenc.Encrypted(delivery.Headers) {
+//		cfg, err := cfgenc.Decrypt(priv, delivery.RoutingKey, delivery.MessageId, delivery.Headers, delivery.Body)
+//	}
+//
+// Signed pushes (package cfgsig) are signed over the encrypted body, verify first and then decrypt
+package cfgenc
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Alg : the only scheme there is, goes in the headers so devices can tell
+const Alg = "x25519-chacha20poly1305"
+
+// KeySize : size of the X25519 public and private keys
+const KeySize = 32
+
+// Headers on the encrypted message
+const (
+	HdrAlg       = "x-enc-alg"
+	HdrEphemeral = "x-enc-epk"   // ephemeral public key of the registry, base64
+	HdrNonce     = "x-enc-nonce" // aead nonce, base64
+)
+
+var (
+	ErrNotEncrypted = errors.New("message is not encrypted")
+	ErrDecrypt      = errors.New("message could not be decrypted")
+)
+
+// Sealed : encrypted message, the ciphertext is the body and the rest goes in the headers
+type Sealed struct {
+	Ephemeral  []byte
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// Table : encryption headers of the message, to be merged with the other headers on it
+func (s Sealed) Table() map[string]interface{} {
+	return map[string]interface{}{
+		HdrAlg:       Alg,
+		HdrEphemeral: base64.StdEncoding.EncodeToString(s.Ephemeral),
+		HdrNonce:     base64.StdEncoding.EncodeToString(s.Nonce),
+	}
+}
+
+// GenerateKey : key pair for the device, the private key stays on the device
+func GenerateKey() (priv, pub []byte, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key.Bytes(), key.PublicKey().Bytes(), nil
+}
+
+// PublicKeyOf : public key of the private key
+func PublicKeyOf(priv []byte) ([]byte, error) {
+	key, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return key.PublicKey().Bytes(), nil
+}
+
+// aead : cipher with the key derived from the shared secret, salted with both the public keys
+func aead(shared, ephemeral, device []byte) (cipher.AEAD, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	salt := append(append([]byte{}, ephemeral...), device...)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte("cfgenc-v1")), key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+func additional(mac, msgID string) []byte {
+	return []byte("cfgenc-v1\n" + mac + "\n" + msgID)
+}
+
+// Encrypt : encrypts the message of msgID for the device of mac, devicePub being its public key
+func Encrypt(devicePub []byte, mac, msgID string, plain []byte) (Sealed, error) {
+	pub, err := ecdh.X25519().NewPublicKey(devicePub)
+	if err != nil {
+		return Sealed{}, fmt.Errorf("invalid public key of the device: %w", err)
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return Sealed{}, err
+	}
+	shared, err := eph.ECDH(pub)
+	if err != nil {
+		return Sealed{}, err
+	}
+	s := Sealed{Ephemeral: eph.PublicKey().Bytes()}
+	c, err := aead(shared, s.Ephemeral, devicePub)
+	if err != nil {
+		return Sealed{}, err
+	}
+	s.Nonce = make([]byte, c.NonceSize())
+	if _, err := rand.Read(s.Nonce); err != nil {
+		return Sealed{}, err
+	}
+	s.Ciphertext = c.Seal(nil, s.Nonce, plain, additional(mac, msgID))
+	return s, nil
+}
+
+// Encrypted : headers of the message say its encrypted
+func Encrypted(headers map[string]interface{}) bool {
+	_, ok := headers[HdrAlg]
+	return ok
+}
+
+// Decrypt : config in the message to the device, priv being the private key of the device
+// mac is the routing key the message came with, msgID its message id
+func Decrypt(priv []byte, mac, msgID string, headers map[string]interface{}, body []byte) ([]byte, error) {
+	if alg, _ := headers[HdrAlg].(string); alg != Alg {
+		return nil, fmt.Errorf("%w, %s %v", ErrNotEncrypted, HdrAlg, headers[HdrAlg])
+	}
+	raw := map[string][]byte{}
+	for _, hdr := range []string{HdrEphemeral, HdrNonce} {
+		str, _ := headers[hdr].(string)
+		byt, err := base64.StdEncoding.DecodeString(str)
+		if err != nil || len(byt) == 0 {
+			return nil, fmt.Errorf("%w, invalid %s", ErrNotEncrypted, hdr)
+		}
+		raw[hdr] = byt
+	}
+	key, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key of the device: %w", err)
+	}
+	eph, err := ecdh.X25519().NewPublicKey(raw[HdrEphemeral])
+	if err != nil {
+		return nil, fmt.Errorf("%w, invalid ephemeral key", ErrDecrypt)
+	}
+	shared, err := key.ECDH(eph)
+	if err != nil {
+		return nil, fmt.Errorf("%w, %s", ErrDecrypt, err)
+	}
+	c, err := aead(shared, raw[HdrEphemeral], key.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(raw[HdrNonce]) != c.NonceSize() {
+		return nil, fmt.Errorf("%w, invalid nonce", ErrDecrypt)
+	}
+	plain, err := c.Open(nil, raw[HdrNonce], body, additional(mac, msgID))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
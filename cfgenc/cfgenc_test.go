@@ -0,0 +1,68 @@
+package cfgenc
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+const (
+	testMac   = "52-3C-42-D4-A9-F4"
+	testMsgID = "6617e5c2a1b2c3d4e5f60718"
+)
+
+var testBody = []byte(`{"config":1,"tickat":"05:00","pulsegap":1800,"interval":60}`)
+
+func TestEncryptDecrypt(t *testing.T) {
+	priv, pub, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if derived, _ := PublicKeyOf(priv); !bytes.Equal(derived, pub) {
+		t.Fatal("public key of the private key does not match")
+	}
+	seal := func() (map[string]interface{}, []byte) {
+		s, err := Encrypt(pub, testMac, testMsgID, testBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers := s.Table()
+		headers["x-request-id"] = "abc"
+		return headers, s.Ciphertext
+	}
+	headers, body := seal()
+	if !Encrypted(headers) || bytes.Contains(body, []byte("tickat")) {
+		t.Fatalf("message not encrypted %s", body)
+	}
+	plain, err := Decrypt(priv, testMac, testMsgID, headers, body)
+	if err != nil || !bytes.Equal(plain, testBody) {
+		t.Fatalf("expected the config back, got %s %v", plain, err)
+	}
+	if _, again := seal(); bytes.Equal(again, body) {
+		t.Error("same ciphertext for two pushes")
+	}
+
+	other, _, _ := GenerateKey()
+	tampered := append([]byte{}, body...)
+	tampered[0] ^= 0xff
+	for what, c := range map[string]struct {
+		priv       []byte
+		mac, msgID string
+		body       []byte
+	}{
+		"other device key": {other, testMac, testMsgID, body},
+		"other device":     {priv, "26-97-ED-E5-FB-ED", testMsgID, body},
+		"other msg":        {priv, testMac, "6617e5c2a1b2c3d4e5f60719", body},
+		"tampered body":    {priv, testMac, testMsgID, tampered},
+	} {
+		if _, err := Decrypt(c.priv, c.mac, c.msgID, headers, c.body); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("%s, expected not decrypted got %v", what, err)
+		}
+	}
+	if _, err := Decrypt(priv, testMac, testMsgID, map[string]interface{}{"x-request-id": "abc"}, testBody); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("plain message, expected not encrypted got %v", err)
+	}
+	if _, err := Encrypt([]byte("short"), testMac, testMsgID, testBody); err == nil {
+		t.Error("encrypted with an invalid public key")
+	}
+}
@@ -0,0 +1,226 @@
+// Package cfgsig : signatures on the config messages the registry publishes to the devices
+// The registry signs every config push with the signing key of the device, key id, timestamp and nonce go in the amqp headers
+// Firmware on the devices verifies the message with a Verifier before applying the config
+//
+//	v := cfgsig.NewVerifier(2*time.Minute, cfgsig.Key{ID: keyID, Alg: cfgsig.AlgEd25519, Key: pubKey})
+//	if err := v.Verify(delivery.RoutingKey, delivery.MessageId, delivery.Headers, delivery.Body); err != nil {
+//		delivery.Reject(false)
+//	}
+package cfgsig
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Algorithms the messages are signed with
+const (
+	AlgEd25519    = "ed25519"     // registry signs with the private key, devices verify with the public key
+	AlgHMACSHA256 = "hmac-sha256" // secret shared between the registry and the device
+)
+
+// Headers on the message that carry the signature
+const (
+	HdrAlg       = "x-sig-alg"
+	HdrKeyID     = "x-sig-keyid"
+	HdrTimestamp = "x-sig-ts"    // unix seconds, int64
+	HdrNonce     = "x-sig-nonce" // random hex, unique per publish
+	HdrSignature = "x-sig"       // base64
+)
+
+var (
+	ErrUnsigned     = errors.New("message is not signed")
+	ErrUnknownKey   = errors.New("message is signed with a key not known")
+	ErrBadSignature = errors.New("signature on the message does not match")
+	ErrStale        = errors.New("message is signed too far from now")
+	ErrReplayed     = errors.New("message was seen before")
+)
+
+// Signature : signature of a message as carried in its headers
+type Signature struct {
+	Alg       string
+	KeyID     string
+	Timestamp int64
+	Nonce     string
+	Sig       []byte
+}
+
+// Table : signature as the amqp headers, to be merged with the other headers on the message
+func (s Signature) Table() map[string]interface{} {
+	return map[string]interface{}{
+		HdrAlg:       s.Alg,
+		HdrKeyID:     s.KeyID,
+		HdrTimestamp: s.Timestamp,
+		HdrNonce:     s.Nonce,
+		HdrSignature: base64.StdEncoding.EncodeToString(s.Sig),
+	}
+}
+
+// SignatureOf : signature from the headers of the message, ErrUnsigned when the headers arent there
+func SignatureOf(headers map[string]interface{}) (Signature, error) {
+	s := Signature{}
+	for _, hdr := range []struct {
+		name string
+		val  *string
+	}{{HdrAlg, &s.Alg}, {HdrKeyID, &s.KeyID}, {HdrNonce, &s.Nonce}} {
+		str, ok := headers[hdr.name].(string)
+		if !ok || str == "" {
+			return s, fmt.Errorf("%w, %s missing", ErrUnsigned, hdr.name)
+		}
+		*hdr.val = str
+	}
+	switch ts := headers[HdrTimestamp].(type) {
+	case int64:
+		s.Timestamp = ts
+	case int32:
+		s.Timestamp = int64(ts)
+	case int:
+		s.Timestamp = int64(ts)
+	case string:
+		parsed, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return s, fmt.Errorf("%w, invalid %s", ErrUnsigned, HdrTimestamp)
+		}
+		s.Timestamp = parsed
+	default:
+		return s, fmt.Errorf("%w, %s missing", ErrUnsigned, HdrTimestamp)
+	}
+	raw, _ := headers[HdrSignature].(string)
+	sig, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil || len(sig) == 0 {
+		return s, fmt.Errorf("%w, invalid %s", ErrUnsigned, HdrSignature)
+	}
+	s.Sig = sig
+	return s, nil
+}
+
+// Payload : bytes that are signed - the signature headers, the routing key (mac) and message id of the message, and its body
+// a message signed for one device cannot be replayed to another
+func Payload(alg, keyID string, ts int64, nonce, mac, msgID string, body []byte) []byte {
+	head := fmt.Sprintf("cfgsig-v1\n%s\n%s\n%d\n%s\n%s\n%s\n", alg, keyID, ts, nonce, mac, msgID)
+	return append([]byte(head), body...)
+}
+
+// Sign : signs the message for the device of mac, key is the ed25519 seed or the hmac secret
+func Sign(alg, keyID string, key []byte, mac, msgID string, body []byte, now time.Time) (Signature, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return Signature{}, err
+	}
+	s := Signature{Alg: alg, KeyID: keyID, Timestamp: now.Unix(), Nonce: hex.EncodeToString(nonce)}
+	payload := Payload(alg, keyID, s.Timestamp, s.Nonce, mac, msgID, body)
+	switch alg {
+	case AlgEd25519:
+		if len(key) != ed25519.SeedSize {
+			return Signature{}, fmt.Errorf("invalid ed25519 seed of %d bytes", len(key))
+		}
+		s.Sig = ed25519.Sign(ed25519.NewKeyFromSeed(key), payload)
+	case AlgHMACSHA256:
+		if len(key) == 0 {
+			return Signature{}, errors.New("empty hmac secret")
+		}
+		s.Sig = macOf(key, payload)
+	default:
+		return Signature{}, fmt.Errorf("unknown signing algorithm %s", alg)
+	}
+	return s, nil
+}
+
+func macOf(secret, payload []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// Key : key the device verifies the messages with, the ed25519 public key or the hmac secret
+type Key struct {
+	ID  string
+	Alg string
+	Key []byte
+}
+
+// Verifier : verifies the signed messages on the device
+// nonces are remembered for twice the skew allowed, a message seen again within that is refused
+type Verifier struct {
+	mu      sync.Mutex
+	keys    map[string]Key
+	maxSkew time.Duration
+	seen    map[string]time.Time
+	now     func() time.Time
+}
+
+// NewVerifier : verifier with the keys of the device, messages signed more than maxSkew away from now are refused
+func NewVerifier(maxSkew time.Duration, keys ...Key) *Verifier {
+	v := &Verifier{keys: map[string]Key{}, maxSkew: maxSkew, seen: map[string]time.Time{}, now: time.Now}
+	for _, k := range keys {
+		v.keys[k.ID] = k
+	}
+	return v
+}
+
+// AddKey : key is known from here on, as when the registry rotates the signing key
+func (v *Verifier) AddKey(k Key) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys[k.ID] = k
+}
+
+// RemoveKey : messages signed with the key are refused from here on
+func (v *Verifier) RemoveKey(id string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.keys, id)
+}
+
+// Verify : message on the queue of the device is from the registry and not seen before
+// mac is the routing key the message came with, msgID its message id
+func (v *Verifier) Verify(mac, msgID string, headers map[string]interface{}, body []byte) error {
+	s, err := SignatureOf(headers)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key, ok := v.keys[s.KeyID]
+	if !ok || key.Alg != s.Alg {
+		return fmt.Errorf("%w, %s %s", ErrUnknownKey, s.Alg, s.KeyID)
+	}
+	payload := Payload(s.Alg, s.KeyID, s.Timestamp, s.Nonce, mac, msgID, body)
+	switch s.Alg {
+	case AlgEd25519:
+		if len(key.Key) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(key.Key), payload, s.Sig) {
+			return ErrBadSignature
+		}
+	case AlgHMACSHA256:
+		if !hmac.Equal(macOf(key.Key, payload), s.Sig) {
+			return ErrBadSignature
+		}
+	default:
+		return fmt.Errorf("%w, %s %s", ErrUnknownKey, s.Alg, s.KeyID)
+	}
+	now := v.now()
+	at := time.Unix(s.Timestamp, 0)
+	if at.Before(now.Add(-v.maxSkew)) || at.After(now.Add(v.maxSkew)) {
+		return fmt.Errorf("%w, signed at %s", ErrStale, at)
+	}
+	for nonce, seenAt := range v.seen {
+		if seenAt.Before(now.Add(-2 * v.maxSkew)) {
+			delete(v.seen, nonce)
+		}
+	}
+	nonce := s.KeyID + "/" + s.Nonce
+	if _, ok := v.seen[nonce]; ok {
+		return ErrReplayed
+	}
+	v.seen[nonce] = now
+	return nil
+}
@@ -0,0 +1,79 @@
+package cfgsig
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+)
+
+const (
+	testMac   = "52-3C-42-D4-A9-F4"
+	testMsgID = "6617e5c2a1b2c3d4e5f60718"
+)
+
+var testBody = []byte(`{"config":1,"tickat":"05:00","pulsegap":1800,"interval":60}`)
+
+func TestSignVerify(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	for name, c := range map[string]struct {
+		alg      string
+		signWith []byte
+		key      Key
+	}{
+		"ed25519": {AlgEd25519, priv.Seed(), Key{ID: "k1", Alg: AlgEd25519, Key: pub}},
+		"hmac":    {AlgHMACSHA256, secret, Key{ID: "k1", Alg: AlgHMACSHA256, Key: secret}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			sign := func() map[string]interface{} {
+				s, err := Sign(c.alg, "k1", c.signWith, testMac, testMsgID, testBody, now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s.Table()
+			}
+			v := NewVerifier(time.Minute, c.key)
+			headers := sign()
+			if err := v.Verify(testMac, testMsgID, headers, testBody); err != nil {
+				t.Fatalf("expected verified, got %s", err)
+			}
+			if err := v.Verify(testMac, testMsgID, headers, testBody); !errors.Is(err, ErrReplayed) {
+				t.Errorf("same message again, expected replayed got %v", err)
+			}
+			for what, err := range map[string]error{
+				"other body":   v.Verify(testMac, testMsgID, sign(), []byte(`{"config":0}`)),
+				"other device": v.Verify("26-97-ED-E5-FB-ED", testMsgID, sign(), testBody),
+				"other msg":    v.Verify(testMac, "6617e5c2a1b2c3d4e5f60719", sign(), testBody),
+			} {
+				if !errors.Is(err, ErrBadSignature) {
+					t.Errorf("%s, expected bad signature got %v", what, err)
+				}
+			}
+			if err := NewVerifier(time.Minute).Verify(testMac, testMsgID, sign(), testBody); !errors.Is(err, ErrUnknownKey) {
+				t.Errorf("no keys, expected unknown key got %v", err)
+			}
+			if err := v.Verify(testMac, testMsgID, map[string]interface{}{"x-request-id": "abc"}, testBody); !errors.Is(err, ErrUnsigned) {
+				t.Errorf("no headers, expected unsigned got %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyStale(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	v := NewVerifier(time.Minute, Key{ID: "k1", Alg: AlgEd25519, Key: pub})
+	for _, at := range []time.Time{time.Now().Add(-2 * time.Minute), time.Now().Add(2 * time.Minute)} {
+		s, _ := Sign(AlgEd25519, "k1", priv.Seed(), testMac, testMsgID, testBody, at)
+		if err := v.Verify(testMac, testMsgID, s.Table(), testBody); !errors.Is(err, ErrStale) {
+			t.Errorf("signed at %s, expected stale got %v", at, err)
+		}
+	}
+	// hmac key with the ed25519 key id, algorithm has to be that of the key
+	s, _ := Sign(AlgHMACSHA256, "k1", pub, testMac, testMsgID, testBody, time.Now())
+	if err := v.Verify(testMac, testMsgID, s.Table(), testBody); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("public key used as hmac secret, expected unknown key got %v", err)
+	}
+}
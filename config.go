@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	/* Secrets inside the container are mounted at the location,
+	check the deployment file for the name of the volume mounts and actual secret key literal for the path
+	NOTE:  secret name in kubernetes  has no bearing here, volumename/literal-key*/
+	MONGO_URI_SECRET  = "/run/secrets/vol-mongouri/uri"
+	AMQP_URI_SECRET   = "/run/secrets/vol-amqpuri/uri"
+	JWT_KEY_SECRET    = "/run/secrets/vol-jwt/secret" // HS256 shared secret
+	JWT_PUBKEY_SECRET = "/run/secrets/vol-jwt/pubkey" // RS256 public key, PEM
+)
+
+const (
+	ModeK8s = "k8s" // connection uris are read from the secrets mounted on the pod
+	ModeDev = "dev" // connection uris are made from the environment, as in docker-compose and the Makefile
+)
+
+// Config : everything the server needs to start, from a yaml file, the environment and flags in that order of precedence
+// Options nested under the yaml keys are the lowercase field names - app: relay: pollevery: 5s
+type Config struct {
+	Mode      string        `yaml:"mode"`      // k8s / dev, decides where the connection uris are read from
+	Listen    string        `yaml:"listen"`    // address the http server listens on
+	Drain     time.Duration `yaml:"drain"`     // on shutdown, how long requests in flight are waited on
+	GinMode   string        `yaml:"ginmode"`   // debug / release / test
+	Store     string        `yaml:"store"`     // mongo / bolt / memory
+	BoltPath  string        `yaml:"boltpath"`  // bolt file when on bolt
+	MongoURI  string        `yaml:"mongouri"`  // read as per the mode when not set
+	MongoDB   string        `yaml:"mongodb"`   // name of the database when on mongo
+	AmqpURI   string        `yaml:"amqpuri"`   // read as per the mode when not set
+	Mongo     MongoPoolOpts `yaml:"mongo"`     // pool sizing & timeouts
+	Publisher PublisherOpts `yaml:"publisher"` // config push exchange & confirms
+	App       AppOpts       `yaml:"app"`       // background workers of the app
+	Trace     TraceOpts     `yaml:"trace"`     // exporter for the spans
+	Auth      AuthOpts      `yaml:"auth"`      // keys for the bearer tokens, read as per the mode when not set
+}
+
+// DefaultConfig : config the server starts with when nothing is set
+// zero values in the nested options are left to their own defaults
+func DefaultConfig() Config {
+	return Config{
+		Mode:     ModeK8s,
+		Listen:   ":8080",
+		Drain:    25 * time.Second,
+		GinMode:  "debug",
+		Store:    "mongo",
+		BoltPath: "devicereg.db",
+	}
+}
+
+// LoadConfig : defaults, overridden by the yaml file in -config, then the environment and then the flags
+// connection uris not set by any of them are read as per the mode, errors when the config is incomplete
+// args are the command line arguments without the program name
+func LoadConfig(args []string) (Config, error) {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("webapi-devicereg", flag.ContinueOnError)
+	cfgFile := fs.String("config", os.Getenv("CONFIG_FILE"), "yaml file with the configuration")
+	mode := fs.String("mode", "", "k8s or dev, where the connection uris are read from")
+	listen := fs.String("listen", "", "address the http server listens on")
+	store := fs.String("store", "", "mongo, bolt or memory")
+	boltPath := fs.String("bolt-path", "", "bolt file when on bolt")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if *cfgFile != "" {
+		if err := cfg.readFile(*cfgFile); err != nil {
+			return cfg, err
+		}
+	}
+	cfg.readEnv()
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "mode":
+			cfg.Mode = *mode
+		case "listen":
+			cfg.Listen = *listen
+		case "store":
+			cfg.Store = *store
+		case "bolt-path":
+			cfg.BoltPath = *boltPath
+		}
+	})
+	cfg.Mode = strings.ToLower(cfg.Mode)
+	cfg.GinMode = strings.ToLower(cfg.GinMode)
+	if cfg.Mode != ModeK8s && cfg.Mode != ModeDev {
+		return cfg, fmt.Errorf("invalid mode %s, expected %s or %s", cfg.Mode, ModeK8s, ModeDev)
+	}
+	if err := cfg.readSecrets(); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.validate()
+}
+
+// readFile : yaml file over the config, keys not in the file are left as they are
+func (cfg *Config) readFile(fp string) error {
+	byt, err := os.ReadFile(fp)
+	if err != nil {
+		return fmt.Errorf("failed to read config file %s: %w", fp, err)
+	}
+	if err := yaml.Unmarshal(byt, cfg); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", fp, err)
+	}
+	return nil
+}
+
+// readEnv : environment over the config, only the variables that are set
+func (cfg *Config) readEnv() {
+	cfg.Mode = envString("APP_MODE", cfg.Mode)
+	cfg.Listen = envString("LISTEN_ADDR", cfg.Listen)
+	cfg.Drain = envDuration("SHUTDOWN_DRAIN", cfg.Drain)
+	cfg.GinMode = envString("GINMODE", cfg.GinMode)
+	cfg.Store = envString("STORE_BACKEND", cfg.Store)
+	cfg.BoltPath = envString("BOLT_PATH", cfg.BoltPath)
+	cfg.MongoURI = envString("MONGO_URI", cfg.MongoURI)
+	cfg.MongoDB = envString("MONGO_DB_NAME", cfg.MongoDB)
+	cfg.AmqpURI = envString("AMQP_URI", cfg.AmqpURI)
+
+	cfg.Mongo.MaxPoolSize = envUint("MONGO_MAXPOOL", cfg.Mongo.MaxPoolSize)
+	cfg.Mongo.MinPoolSize = envUint("MONGO_MINPOOL", cfg.Mongo.MinPoolSize)
+	cfg.Mongo.ConnectTimeout = envDuration("MONGO_CONNECT_TIMEOUT", cfg.Mongo.ConnectTimeout)
+	cfg.Mongo.OpTimeout = envDuration("MONGO_OP_TIMEOUT", cfg.Mongo.OpTimeout)
+
+	cfg.Publisher.Exchange = envString("AMQP_XNAME", cfg.Publisher.Exchange)
+	cfg.Publisher.PoolSize = int(envUint("AMQP_CHANNELS", uint64(cfg.Publisher.PoolSize)))
+	cfg.Publisher.ConfirmTimeout = envDuration("AMQP_CONFIRM_TIMEOUT", cfg.Publisher.ConfirmTimeout)
+
+	cfg.Trace.Exporter = envString("TRACE_EXPORTER", cfg.Trace.Exporter)
+	cfg.Trace.File = envString("TRACE_FILE", cfg.Trace.File)
+	if sample, err := strconv.ParseFloat(os.Getenv("TRACE_SAMPLE"), 64); err == nil {
+		cfg.Trace.Sample = sample
+	}
+
+	cfg.Auth.Secret = envString("JWT_SECRET", cfg.Auth.Secret)
+	cfg.Auth.PubKey = envString("JWT_PUBKEY", cfg.Auth.PubKey)
+	cfg.Auth.Issuer = envString("JWT_ISSUER", cfg.Auth.Issuer)
+	cfg.Auth.Audience = envString("JWT_AUDIENCE", cfg.Auth.Audience)
+	cfg.Auth.Leeway = envDuration("JWT_LEEWAY", cfg.Auth.Leeway)
+
+	app := &cfg.App
+	app.Relay.PollEvery = envDuration("OUTBOX_POLL", app.Relay.PollEvery)
+	app.Relay.MaxBackoff = envDuration("OUTBOX_MAX_BACKOFF", app.Relay.MaxBackoff)
+	app.Relay.MaxAttempts = int(envUint("OUTBOX_MAX_ATTEMPTS", uint64(app.Relay.MaxAttempts)))
+	app.Relay.MaxAge = envDuration("OUTBOX_MAX_AGE", app.Relay.MaxAge)
+	app.Acks.Exchange = envString("AMQP_ACK_XNAME", app.Acks.Exchange)
+	app.Acks.Queue = envString("AMQP_ACK_QUEUE", app.Acks.Queue)
+	app.Acks.Timeout = envDuration("ACK_TIMEOUT", app.Acks.Timeout)
+	app.Presence.Exchange = envString("AMQP_HB_XNAME", app.Presence.Exchange)
+	app.Presence.Queue = envString("AMQP_HB_QUEUE", app.Presence.Queue)
+	app.Presence.OnlineWithin = envDuration("ONLINE_WITHIN", app.Presence.OnlineWithin)
+	app.Presence.OfflineAfter = envDuration("OFFLINE_AFTER", app.Presence.OfflineAfter)
+	app.Shadow.Exchange = envString("AMQP_RPT_XNAME", app.Shadow.Exchange)
+	app.Shadow.Queue = envString("AMQP_RPT_QUEUE", app.Shadow.Queue)
+	app.Shadow.DriftAfter = envDuration("DRIFT_AFTER", app.Shadow.DriftAfter)
+	app.TrashFor = envDuration("TRASH_RETENTION", app.TrashFor)
+	app.Purge.Every = envDuration("TRASH_PURGE_EVERY", app.Purge.Every)
+}
+
+// readSecrets : connection uris and token keys that arent set yet
+// k8s reads them off the secrets mounted on the pod, dev makes them from the server & login in the environment
+func (cfg *Config) readSecrets() error {
+	if cfg.MongoURI == "" && cfg.Store == "mongo" {
+		if cfg.Mode == ModeDev {
+			cfg.MongoURI = devURI("mongodb", os.Getenv("MONGO_SRVR"), os.Getenv("MONGO_USER"), os.Getenv("MONGO_PASS"), "")
+		} else {
+			secrets, err := readK8SecretMount(MONGO_URI_SECRET)
+			if err != nil || len(secrets) == 0 {
+				return fmt.Errorf("failed to read mongo uri from secret mount: %v", err)
+			}
+			cfg.MongoURI = secrets[0]
+		}
+		log.WithFields(log.Fields{
+			"mode": cfg.Mode,
+		}).Debug("mongo connect uri read")
+	}
+	if cfg.AmqpURI == "" {
+		if cfg.Mode == ModeDev {
+			user, pass, _ := strings.Cut(os.Getenv("AMQP_LOGIN"), ":")
+			cfg.AmqpURI = devURI("amqp", os.Getenv("AMQP_SERVER"), user, pass, "5672")
+		} else {
+			secrets, err := readK8SecretMount(AMQP_URI_SECRET)
+			if err != nil || len(secrets) == 0 {
+				return fmt.Errorf("failed to read amqp uri from secret mount: %v", err)
+			}
+			cfg.AmqpURI = secrets[0]
+		}
+		log.WithFields(log.Fields{
+			"mode": cfg.Mode,
+		}).Debug("amqp connect uri read")
+	}
+	// keys for the tokens, either or both could be mounted
+	// in dev they come only from the environment or the file
+	if cfg.Auth.Secret == "" && cfg.Auth.PubKey == "" && cfg.Mode == ModeK8s {
+		for fp, key := range map[string]*string{JWT_KEY_SECRET: &cfg.Auth.Secret, JWT_PUBKEY_SECRET: &cfg.Auth.PubKey} {
+			secrets, err := readK8SecretMount(fp)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("failed to read token key from secret mount: %v", err)
+			}
+			*key = strings.Join(secrets, " ") // PEM has spaces in it
+		}
+		log.WithFields(log.Fields{
+			"hs256": cfg.Auth.Secret != "",
+			"rs256": cfg.Auth.PubKey != "",
+		}).Debug("token keys read")
+	}
+	return nil
+}
+
+// validate : errors on the config the server cannot start with
+func (cfg *Config) validate() error {
+	switch cfg.Store {
+	case "mongo":
+		if cfg.MongoURI == "" {
+			return fmt.Errorf("empty mongo uri, cannot proceed")
+		}
+		if cfg.MongoDB == "" {
+			return fmt.Errorf("invalid/empty name for mongo db, cannot proceed")
+		}
+	case "bolt":
+		if cfg.BoltPath == "" {
+			return fmt.Errorf("empty bolt path, cannot proceed")
+		}
+	case "memory":
+	default:
+		return fmt.Errorf("invalid store backend %s, cannot proceed", cfg.Store)
+	}
+	if cfg.AmqpURI == "" {
+		return fmt.Errorf("empty amqp uri, cannot proceed")
+	}
+	if cfg.Auth.Secret == "" && cfg.Auth.PubKey == "" {
+		return fmt.Errorf("no key to verify the tokens with, cannot proceed")
+	}
+	return nil
+}
+
+// devURI : connection uri from the server and login in the environment, empty when the server isnt set
+// port is added when the server has none
+func devURI(scheme, server, user, pass, port string) string {
+	if server == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil && port != "" {
+		server = net.JoinHostPort(server, port)
+	}
+	u := url.URL{Scheme: scheme, Host: server, Path: "/"}
+	if user != "" {
+		u.User = url.UserPassword(user, pass)
+	}
+	return u.String()
+}
+
+// readK8SecretMount : secrets mounted on the pod read inside the container
+// fp		: filepath of the secret file
+func readK8SecretMount(fp string) ([]string, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	byt, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasSuffix(byt, []byte("\n")) {
+		byt, _ = bytes.CutSuffix(byt, []byte("\n")) //often file read in will have this as a suffix
+	}
+	/* There could be multiple secrets in the same file separated by white space */
+	return strings.Split(string(byt), " "), nil
+}
+
+// envString : reads a string from the environment, def when not set
+func envString(key string, def string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return def
+}
+
+// envUint : reads an unsigned integer from the environment, def when not set or not a number
+func envUint(key string, def uint64) uint64 {
+	val, err := strconv.ParseUint(os.Getenv(key), 10, 64)
+	if err != nil {
+		return def
+	}
+	return val
+}
+
+// envDuration : reads a duration (10s, 2m ..) from the environment, def when not set or invalid
+func envDuration(key string, def time.Duration) time.Duration {
+	val, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return val
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// Subscription : a queue the registry consumes from
+// Setup declares the topology it needs on the channel and returns the name of the queue to consume
+// Handle is called for each delivery, error rejects the message without requeueing it
+type Subscription struct {
+	Name   string
+	Setup  func(ch *amqp.Channel) (string, error)
+	Handle func(d amqp.Delivery) error
+}
+
+// ConsumerOpts : tuning for the amqp consumer, zero values are replaced by defaults
+type ConsumerOpts struct {
+	Prefetch   int           // unacknowledged deliveries per subscription
+	MinBackoff time.Duration // first wait before redialing a lost connection
+	MaxBackoff time.Duration // waits double on each failed redial upto this
+}
+
+func (opts *ConsumerOpts) defaults() {
+	if opts.Prefetch <= 0 {
+		opts.Prefetch = 10
+	}
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff = time.Second
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+}
+
+// AmqpConsumer : connection to the broker for all the messages coming up from the devices
+// Kept separate from the publisher connection so flow control on one doesnt stall the other
+// Subscriptions are setup again each time the connection is redialed
+type AmqpConsumer struct {
+	uri  string
+	opts ConsumerOpts
+	subs []Subscription
+
+	mu     sync.RWMutex
+	health DepHealth
+
+	handlers  sync.WaitGroup // deliveries being handled
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewAmqpConsumer : starts consuming the subscriptions, connection is made in the background
+func NewAmqpConsumer(uri string, opts ConsumerOpts, subs ...Subscription) *AmqpConsumer {
+	opts.defaults()
+	ac := &AmqpConsumer{
+		uri:  uri,
+		opts: opts,
+		subs: subs,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(ac.done)
+		keepConnected(ac.uri, ac.opts.MinBackoff, ac.opts.MaxBackoff, ac.stop, ac.setup, ac.down, nil, nil)
+	}()
+	return ac
+}
+
+// setup : opens a channel per subscription and starts consuming on it
+func (ac *AmqpConsumer) setup(conn *amqp.Connection) error {
+	start := time.Now()
+	for _, sub := range ac.subs {
+		ch, err := conn.Channel()
+		if err != nil {
+			return err
+		}
+		if err := ch.Qos(ac.opts.Prefetch, 0, false); err != nil {
+			return err
+		}
+		queue, err := sub.Setup(ch)
+		if err != nil {
+			return err
+		}
+		deliveries, err := ch.Consume(queue, "", false, false, false, false, nil)
+		if err != nil {
+			return err
+		}
+		ac.handlers.Add(1)
+		go ac.consume(sub, deliveries)
+		log.WithFields(log.Fields{
+			"subscription": sub.Name,
+			"queue":        queue,
+		}).Info("consuming from amqp queue")
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.health = DepHealth{Healthy: true, LastCheck: time.Now(), Latency: time.Since(start)}
+	return nil
+}
+
+// consume : handles deliveries till the channel is closed along with the connection
+func (ac *AmqpConsumer) consume(sub Subscription, deliveries <-chan amqp.Delivery) {
+	defer ac.handlers.Done()
+	for d := range deliveries {
+		if err := sub.Handle(d); err != nil {
+			log.WithFields(log.Fields{
+				"subscription": sub.Name,
+				"err":          err,
+				"msgid":        d.MessageId,
+			}).Error("failed to handle message, rejected")
+			d.Nack(false, false)
+			continue
+		}
+		d.Ack(false)
+	}
+}
+
+func (ac *AmqpConsumer) down(err error) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.health = DepHealth{Healthy: false, LastErr: err, LastCheck: time.Now()}
+}
+
+// Health : whether the consumer is connected and the last connection error if any
+func (ac *AmqpConsumer) Health() DepHealth {
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+	return ac.health
+}
+
+// Close : closes the connection and waits for the deliveries in hand to be handled
+func (ac *AmqpConsumer) Close() {
+	ac.closeOnce.Do(func() { close(ac.stop) })
+	<-ac.done
+	ac.handlers.Wait()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/eensymachines-in/patio/aquacfg"
+	"github.com/eensymachines-in/webapi-devicereg/cfgenc"
+	"github.com/eensymachines-in/webapi-devicereg/cfgsig"
+	"github.com/gin-gonic/gin"
+)
+
+func TestEncryptedPushes(t *testing.T) {
+	ts := newTestServer(t)
+	priv, pub, err := cfgenc.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := registration(test200MacID)
+	reg["encKey"] = pub
+	rec := ts.do("POST", "/api/devices", reg)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body)
+	}
+	if dev := decodeDevice(t, rec); !bytes.Equal(dev.EncKey, pub) {
+		t.Fatalf("encryption key not on the registered device %v", dev.EncKey)
+	}
+	path := "/api/devices/" + string(test200MacID)
+	newCfg := gin.H{"tickat": "05:00", "config": 1, "interval": 60, "pulsegap": 1800}
+
+	t.Run("encrypted for the device", func(t *testing.T) {
+		if rec := ts.do("PATCH", path+"?path=config&action=replace", newCfg); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body)
+		}
+		keys := []SigningKey{}
+		json.Unmarshal(ts.do("GET", path+"/signingkeys", nil).Body.Bytes(), &keys)
+		if len(keys) == 0 {
+			t.Fatal("no signing key for the device")
+		}
+		// signature is over the ciphertext, verified before decrypting
+		msg, err := ts.verify(t, cfgsig.Key{ID: keys[0].ID, Alg: keys[0].Alg, Key: keys[0].PubKey})
+		if err != nil {
+			t.Fatalf("encrypted push not verified, %s", err)
+		}
+		if !cfgenc.Encrypted(msg.Headers) || msg.ContentType != "application/octet-stream" || bytes.Contains(msg.Body, []byte("tickat")) {
+			t.Fatalf("push not encrypted %s %v", msg.Body, msg.Headers)
+		}
+		plain, err := cfgenc.Decrypt(priv, string(test200MacID), msg.MessageId, msg.Headers, msg.Body)
+		if err != nil {
+			t.Fatalf("push not decrypted with the device key, %s", err)
+		}
+		sched := aquacfg.Schedule{}
+		if err := json.Unmarshal(plain, &sched); err != nil || sched.TickAt != "05:00" {
+			t.Errorf("unexpected config in the push %s", plain)
+		}
+		if _, err := cfgenc.Decrypt(priv, string(test404MacID), msg.MessageId, msg.Headers, msg.Body); err == nil {
+			t.Error("push decrypted as that of another device")
+		}
+	})
+	t.Run("cleared by the owner", func(t *testing.T) {
+		if rec := ts.do("PATCH", path+"?path=enckey&action=replace", gin.H{"encKey": nil}, "Authorization", bearer("stranger@eensymachines.in")); rec.Code != http.StatusForbidden {
+			t.Errorf("stranger clearing the key, expected 403 got %d", rec.Code)
+		}
+		rec := ts.do("PATCH", path+"?path=enckey&action=replace", gin.H{"encKey": nil})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body)
+		}
+		if dev := decodeDevice(t, rec); len(dev.EncKey) != 0 {
+			t.Fatalf("encryption key still on the device %v", dev.EncKey)
+		}
+		ts.do("PATCH", path+"?path=config&action=replace", gin.H{"tickat": "06:00", "config": 1, "interval": 60, "pulsegap": 1800})
+		if msg := ts.pub.msgs[len(ts.pub.msgs)-1]; cfgenc.Encrypted(msg.Headers) || !bytes.Contains(msg.Body, []byte("06:00")) {
+			t.Errorf("push encrypted after the key was cleared %s", msg.Body)
+		}
+	})
+	t.Run("invalid keys", func(t *testing.T) {
+		if rec := ts.do("PATCH", path+"?path=enckey&action=replace", gin.H{"encKey": []byte("short")}); rec.Code != http.StatusBadRequest {
+			t.Errorf("short key, expected 400 got %d", rec.Code)
+		}
+		if rec := ts.do("PATCH", path+"?path=enckey&action=replace", gin.H{"encKey": "not base64!"}); rec.Code != http.StatusBadRequest {
+			t.Errorf("key not base64, expected 400 got %d", rec.Code)
+		}
+		reg := registration(test404MacID)
+		reg["encKey"] = []byte("short")
+		if rec := ts.do("POST", "/api/devices", reg); rec.Code != http.StatusBadRequest {
+			t.Errorf("registered with a short key, expected 400 got %d", rec.Code)
+		}
+	})
+}
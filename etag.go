@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+/* ETag of the device is "<version>-<hash>"
+version counts the changes made by the operators (config, users) while the hash is of the device as dispatched
+If-None-Match is against the whole tag - pushes, presence changing the device details is not a 304
+If-Match is against the version alone - acks and heartbeats from the device arent a conflict for the operator */
+
+// ErrPrecondition : device has changed since the version the request was made against
+var ErrPrecondition = func(e error) httperr.HttpErr {
+	return (&ePrecondition{}).SetInternal(e)
+}
+
+type ePrecondition struct {
+	Internal error
+}
+
+func (ep *ePrecondition) SetInternal(ie error) httperr.HttpErr {
+	if ie == nil {
+		return nil
+	}
+	ep.Internal = ie
+	return ep
+}
+
+func (ep *ePrecondition) Log(le *log.Entry) httperr.HttpErr {
+	le.WithFields(log.Fields{
+		"internal_err": ep.Internal,
+	}).Warn("precondition failed")
+	return ep
+}
+
+func (ep *ePrecondition) HttpStatusCode() int {
+	return http.StatusPreconditionFailed
+}
+
+func (ep *ePrecondition) ClientErrData() string {
+	return "Device was changed by someone else since you last fetched it, reload and try again."
+}
+
+func (ep *ePrecondition) Error() string {
+	return ep.Internal.Error()
+}
+
+// etagOf : entity tag of the device as dispatched, device has to be decorated before
+func etagOf(dev *Device) string {
+	h := fnv.New64a()
+	byt, _ := json.Marshal(dev)
+	h.Write(byt)
+	return fmt.Sprintf(`"%d-%x"`, dev.Version, h.Sum64())
+}
+
+// versionOfTag : version from the entity tag, false if the tag isnt one of ours
+func versionOfTag(tag string) (int64, bool) {
+	tag = strings.Trim(strings.TrimPrefix(strings.TrimSpace(tag), "W/"), `"`)
+	ver, _, found := strings.Cut(tag, "-")
+	if !found {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(ver, 10, 64)
+	return v, err == nil
+}
+
+// notModified : true when the If-None-Match header has the current tag of the device
+func notModified(c *gin.Context, etag string) bool {
+	inm := c.GetHeader("If-None-Match")
+	if inm == "" {
+		return false
+	}
+	for _, tag := range strings.Split(inm, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatch : version of the device the request was made against as in the If-Match header
+// nil when the header isnt sent or is *, the change is then made regardless of the version
+// When none of the tags are of the current version the request is aborted with 412, and false is returned
+// Version is to be handed down to the store so the change is made only if the device is still at that version
+func ifMatch(c *gin.Context, dev *Device) (*int64, bool) {
+	im := c.GetHeader("If-Match")
+	if im == "" || strings.TrimSpace(im) == "*" {
+		return nil, true
+	}
+	for _, tag := range strings.Split(im, ",") {
+		if v, ok := versionOfTag(tag); ok && v == dev.Version {
+			return &v, true
+		}
+	}
+	httperr.HttpErrOrOkDispatch(c, ErrPrecondition(fmt.Errorf("device %s is at version %d, If-Match %s", dev.MacID, dev.Version, im)), reqLog(c).WithFields(log.Fields{
+		"stack_trace": "ifMatch",
+	}))
+	return nil, false
+}
@@ -2,80 +2,125 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/eensymachines-in/errx/httperr"
 	"github.com/eensymachines-in/patio/aquacfg"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-/* mongoClDBInCtx : utility function that can get mongo connection objects from the context if injected previously */
-func mongoClDBInCtx(c *gin.Context) (*mongo.Client, *mongo.Database) {
-	val, _ := c.Get("mongo-client")
-	cl, _ := val.(*mongo.Client)
-	val, _ = c.Get("mongo-database")
-	db, _ := val.(*mongo.Database)
-	return cl, db
+// actorOf : user making the request, recorded against the changes
+// subject of the bearer token, X-Operator header from the front end is no longer trusted
+// changes made with an api key are recorded against the key
+func actorOf(c *gin.Context) string {
+	if key := apiKeyOf(c); key != nil {
+		return "apikey:" + key.ID
+	}
+	if actor := userOf(c); actor != "" {
+		return actor
+	}
+	return "anonymous"
+}
+
+// pushConfig : sets the config on the device and pushes it downstream, a revision is recorded for the change
+// Config change and the message that pushes it downstream are written together in the outbox
+// Devices will bind queues using their own mac id for listening to messages
+// since this is configs_direct amqp exchange only config changes will be posted here
+// returns the status code to respond with, false if the request was aborted with an error
+func (app *App) pushConfig(c *gin.Context, dev *Device, sched aquacfg.Schedule, chg CfgChange, ctx context.Context) (int, bool) {
+	chg.ReqID = requestID(c)
+	chg.Trace = traceCarrier(ctx)
+	msg, err := app.Outbox.PatchConfgOutbox(dev.MacID, sched, chg, app.Relay.Lease(), ctx)
+	if err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+			"stack_trace": "pushConfig",
+			"mac":         dev.MacID,
+			"new_config":  sched.Config,
+			"tickat":      sched.TickAt,
+			"pulsegap":    sched.PulseGap,
+			"interval":    sched.Interval,
+		}))
+		return 0, false
+	}
+	/* Attempting to deliver right away, incase that fails the relay keeps trying in the background
+	Database and the device cannot be out of sync for long since the message is never lost */
+	/* Devices that arent listening (no queue bound for the mac) get the config when they are back
+	push on the device is then undelivered and the caller is told so with 202
+	delivery is waited on only so long, a broker that is down doesnt hold up the request - config is queued all the same */
+	dctx, cancel := context.WithTimeout(c.Request.Context(), app.Relay.PublishTimeout())
+	defer cancel()
+	if err := app.Relay.Deliver(dctx, msg); err != nil {
+		reqLog(c).WithFields(log.Fields{
+			"stack":        "pushConfig",
+			"mac":          dev.MacID,
+			"msgid":        msg.ID.Hex(),
+			"err":          err,
+			"notlistening": errors.Is(err, ErrUnroutable),
+		}).Warn("config saved, delivery to device pending")
+		return http.StatusAccepted, true
+	}
+	return http.StatusOK, true
 }
 
 // DeviceOfID : from the deivce of ID - objectid in the database or the mac id this can get the device details
 // sets the device details in the context for the downstream handlers
-func DeviceOfID(c *gin.Context) {
-	cl, db := mongoClDBInCtx(c)
-	ctx, cancel := context.WithCancel(context.Background())
+// user of the token has to be one of the users of the device, else its 403
+// any of the users can see the device, handlers downstream check the role for the changes
+func (app *App) DeviceOfID(c *gin.Context) {
+	ctx, cancel := app.opCtx(c.Request.Context())
 	defer cancel()
-	if cl == nil || db == nil {
-		httperr.HttpErrOrOkDispatch(c, httperr.ErrGatewayConnect(fmt.Errorf("failed to connect to mongo db")), log.WithFields(log.Fields{
-			"stack_trace": "HndlLstDvcs",
-			"client_null": cl == nil,
-			"db_null":     db == nil,
+	result := Device{}
+	if err := app.Devices.GetOfId(DevMacID(c.Param("deviceid")), &result, ctx); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+			"stack_trace": "DeviceOfID",
 		}))
-		if cl != nil {
-			cl.Disconnect(ctx)
-		}
 		return
 	}
-	result := Device{}
-	if err := DevicesCollc(db).GetOfId(DevMacID(c.Param("deviceid")), &result, ctx); err != nil {
-		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
-			"stack_trace": "HndlLstDvcs",
-			"client_null": cl == nil,
-			"db_null":     db == nil,
-		}))
-		cl.Disconnect(ctx)
+	if !permitted(c, &result, RoleViewer, "DeviceOfID") {
 		return
 	}
+	app.decorate(&result, time.Now())
 	c.Set("device", &result)
 	c.Next()
 }
-func HndlOneDvc(c *gin.Context) {
-	cl, db := mongoClDBInCtx(c)
-	if cl == nil || db == nil {
-		httperr.HttpErrOrOkDispatch(c, httperr.ErrGatewayConnect(fmt.Errorf("failed to connect to mongo db")), log.WithFields(log.Fields{
-			"stack_trace": "HndlLstDvcs",
-			"client_null": cl == nil,
-			"db_null":     db == nil,
-		}))
-		return
-	}
-	defer cl.Disconnect(context.TODO()) // database connection closed
-	ctx, cancel := context.WithCancel(context.Background())
+func (app *App) HndlOneDvc(c *gin.Context) {
+	ctx, cancel := app.opCtx(c.Request.Context())
 	defer cancel()
 	val, _ := c.Get("device")
 	deviceDetails, _ := val.(*Device)
 	if c.Request.Method == "GET" {
+		// front end polls with If-None-Match, unchanged device is not sent again
+		etag := etagOf(deviceDetails)
+		c.Header("ETag", etag)
+		if notModified(c, etag) {
+			c.AbortWithStatus(http.StatusNotModified)
+			return
+		}
 		c.AbortWithStatusJSON(http.StatusOK, deviceDetails)
 		return
-	} else if c.Request.Method == "DELETE" {
-		if err := DevicesCollc(db).DeleteDevice(c.Param("deviceid"), ctx); err != nil {
-			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+	}
+	// owners delete the device and change its users / encryption key, operators change the config
+	need := RoleOperator
+	if c.Request.Method == "DELETE" || c.Query("path") == "users" || c.Query("path") == "enckey" {
+		need = RoleOwner
+	}
+	if !permitted(c, deviceDetails, need, "HndlOneDvc") {
+		return
+	}
+	// changes are made only if the device is still at the version in If-Match
+	ifVersion, ok := ifMatch(c, deviceDetails)
+	if !ok {
+		return
+	}
+	if c.Request.Method == "DELETE" {
+		if err := app.Devices.DeleteDevice(c.Param("deviceid"), ifVersion, app.trashFor, ctx); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
 				"stack_trace": "HndlOneDvc/DELETE",
 			}))
 			return
@@ -85,94 +130,40 @@ func HndlOneDvc(c *gin.Context) {
 	} else if c.Request.Method == "PATCH" {
 		path := c.Query("path")
 		action := c.Query("action")
+		status := http.StatusOK // accepted when the device is yet to receive the change
 		if path == "config" {
 			if action == "replace" {
 				newCfg := aquacfg.Schedule{}
 				if err := c.ShouldBind(&newCfg); err != nil {
-					httperr.HttpErrOrOkDispatch(c, httperr.ErrBinding(err), log.WithFields(log.Fields{
-						"stack_trace": "HndlLstDvcs/POST",
-					}))
-				}
-				if err := DevicesCollc(db).PatchConfg(deviceDetails.MacID, newCfg, ctx); err != nil {
-					httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+					httperr.HttpErrOrOkDispatch(c, httperr.ErrBinding(err), reqLog(c).WithFields(log.Fields{
 						"stack_trace": "HndlOneDvc/PATCH",
-						"mac":         deviceDetails.MacID,
-						"new_config":  newCfg.Config,
-						"tickat":      newCfg.TickAt,
-						"pulsegap":    newCfg.PulseGap,
-						"interval":    newCfg.Interval,
 					}))
 					return
 				}
-				/* Rabbit publish the new config with routing key as mac id of the device
-				Devices will bind queues using their own mac id for listening to messages
-				since this is configs_direct amqp exchange only config changes will be posted here
-				*/
-				val, _ := c.Get("amqp-ch")
-				amqpCh := val.(*amqp.Channel)
-				amqpCh.Confirm(false) // since nowait is false, error can be handled here itself
-				val, _ = c.Get("amqp-conn")
-				amqpConn := val.(*amqp.Connection)
-				defer amqpConn.Close()
-				defer amqpCh.Close()
-				/* ------------ Setting up Publisher confirmations
-				when the consumer (device on the ground acknowledges the receip[t of the msssage, this shall confirm here) */
-				confirmations := amqpCh.NotifyPublish(make(chan amqp.Confirmation, 1))
-				// defer close(confirmations)
-
-				/* ?Ready to publish the message to exchange */
-				byt, _ := json.Marshal(newCfg)
-				err := amqpCh.Publish(os.Getenv("AMQP_XNAME"), string(deviceDetails.MacID), false, false, amqp.Publishing{
-					ContentType: "text/plain",
-					Body:        byt,
-				})
-				/* Incase the publishing fails, the database changes will be out of sync from the device on the ground
-				such cases its required to undo the changes on the database on our way out to the original configuration  */
-				if err != nil {
-					httperr.HttpErrOrOkDispatch(c, httperr.ErrGatewayConnect(fmt.Errorf("failed to send message to amqp server %s", err)), log.WithFields(log.Fields{}))
-					// since amqp publish  and db update should be atomic operation
-					/* Unfortunately in the case if this fails, chances of which are minimal we still do get the device and the datbase out of sysnc
-					hence you see no error is handled here */
-					DevicesCollc(db).PatchConfg(deviceDetails.MacID, *deviceDetails.Cfg, ctx) // reverting the old settings
+				if status, ok = app.pushConfig(c, deviceDetails, newCfg, CfgChange{By: actorOf(c), IfVersion: ifVersion}, ctx); !ok {
 					return
-				} else {
-					// Success when publishing , wait for the confirmation acknowledgement
-					select {
-					case confrm := <-confirmations:
-						if !confrm.Ack {
-							httperr.HttpErrOrOkDispatch(c, httperr.ErrGatewayConnect(fmt.Errorf("rejected by the rabbit mq server")), log.WithFields(log.Fields{
-								"stack": "HndlOneDvc/PATCH",
-							}))
-							return
-						}
-						/* If received acknowledgement then does nothing escapes all the loopers to sending the device details with status ok */
-					case <-time.After(8 * time.Second):
-						/* Delay in getting the acknowledgement, deadline */
-						httperr.HttpErrOrOkDispatch(c, httperr.ErrGatewayConnect(fmt.Errorf("rabbitmq server timedout, no acknoedgement response")), log.WithFields(log.Fields{
-							"stack": "HndlOneDvc/PATCH",
-						}))
-						return
-					}
 				}
 			} else {
 				c.AbortWithStatus(http.StatusMethodNotAllowed)
 				return
 			}
 		} else if path == "users" {
-			userEmails := []string{}
-			if err := c.ShouldBind(&userEmails); err != nil {
-				httperr.HttpErrOrOkDispatch(c, httperr.ErrBinding(err), log.WithFields(log.Fields{
+			// plain emails are owners, {email, role} for the other roles
+			members := []Membership{}
+			if err := c.ShouldBind(&members); err != nil {
+				httperr.HttpErrOrOkDispatch(c, httperr.ErrBinding(err), reqLog(c).WithFields(log.Fields{
 					"stack_trace": "HndlOneDvc/PATCH",
 				}))
 				return
 			}
 			if action == "append" || action == "replace" {
-				// append additional owners for the device
-				if err := DevicesCollc(db).AppendUsers(deviceDetails.MacID, userEmails, map[string]bool{"append": false, "replace": true}[action], ctx); err != nil {
-					httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				// append additional users for the device, replacing the list cannot leave it without an owner
+				stampMembers(members, deviceDetails, actorOf(c), time.Now())
+				if err := app.Devices.AppendUsers(deviceDetails.MacID, members, map[string]bool{"append": false, "replace": true}[action], ifVersion, ctx); err != nil {
+					httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
 						"stack_trace": "HndlOneDvc/PATCH",
 						"mac":         deviceDetails.MacID,
-						"append":      userEmails,
+						"users":       members,
 					}))
 					return
 				}
@@ -181,34 +172,48 @@ func HndlOneDvc(c *gin.Context) {
 				c.AbortWithStatus(http.StatusMethodNotAllowed)
 				return
 			}
+		} else if path == "enckey" {
+			// {"encKey": base64 X25519 public key}, null / empty to push the configs plain again
+			if action != "replace" {
+				c.AbortWithStatus(http.StatusMethodNotAllowed)
+				return
+			}
+			payload := struct {
+				EncKey []byte `json:"encKey"`
+			}{}
+			if err := c.ShouldBind(&payload); err != nil {
+				httperr.HttpErrOrOkDispatch(c, httperr.ErrBinding(err), reqLog(c).WithFields(log.Fields{
+					"stack_trace": "HndlOneDvc/PATCH",
+				}))
+				return
+			}
+			if err := app.Devices.SetEncKey(deviceDetails.MacID, payload.EncKey, ifVersion, ctx); err != nil {
+				httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+					"stack_trace": "HndlOneDvc/PATCH",
+					"mac":         deviceDetails.MacID,
+				}))
+				return
+			}
 		}
 		// whenever done patching, getting the updated device details and dispatching via json  over http
-		err := DevicesCollc(db).GetOfId(deviceDetails.MacID, deviceDetails, ctx)
+		err := app.Devices.GetOfId(deviceDetails.MacID, deviceDetails, ctx)
 		if err != nil {
-			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
 				"stack_trace": "HndlOneDvc/PATCH/getting_updated",
 			}))
 			return
 		}
+		app.decorate(deviceDetails, time.Now())
 		// time to dispatch the updated device details
-		c.AbortWithStatusJSON(http.StatusOK, deviceDetails)
+		c.Header("ETag", etagOf(deviceDetails))
+		c.AbortWithStatusJSON(status, deviceDetails)
 		return
 	}
 	c.AbortWithStatus(http.StatusMethodNotAllowed)
 }
 
-func HndlLstDvcs(c *gin.Context) {
-	cl, db := mongoClDBInCtx(c)
-	if cl == nil || db == nil {
-		httperr.HttpErrOrOkDispatch(c, httperr.ErrGatewayConnect(fmt.Errorf("failed to connect to mongo db")), log.WithFields(log.Fields{
-			"stack_trace": "HndlLstDvcs",
-			"client_null": cl == nil,
-			"db_null":     db == nil,
-		}))
-		return
-	}
-	defer cl.Disconnect(context.TODO()) // database connection closed
-	ctx, cancel := context.WithCancel(context.Background())
+func (app *App) HndlLstDvcs(c *gin.Context) {
+	ctx, cancel := app.opCtx(c.Request.Context())
 	defer cancel()
 	if c.Request.Method == "POST" {
 		/*
@@ -217,40 +222,307 @@ func HndlLstDvcs(c *gin.Context) {
 			- duplicate entrues not allowed, tracked by macID
 			- invalid MAC IDs would be rejected
 			- devices with no users are rejected
+			- user of the token has to be one of the owners, cannot register devices for others
+			- plain emails in users are owners
 			- devices with invalid schedule configurations are rejected
 			- ObjectID is auto generated and updated in the outgoing device
 		*/
 		newDevc := Device{}
 		if err := c.ShouldBind(&newDevc); err != nil {
-			httperr.HttpErrOrOkDispatch(c, httperr.ErrBinding(err), log.WithFields(log.Fields{
+			httperr.HttpErrOrOkDispatch(c, httperr.ErrBinding(err), reqLog(c).WithFields(log.Fields{
 				"stack_trace": "HndlLstDvcs/POST",
 			}))
 			return
 		}
-		if err := DevicesCollc(db).AddNewDevice(&newDevc, ctx); err != nil {
-			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+		if len(newDevc.Users) > 0 && newDevc.RoleOf(userOf(c)) != RoleOwner {
+			forbidden(c, fmt.Errorf("%s registering device %s has to be one of its owners", userOf(c), newDevc.MacID), "HndlLstDvcs/POST")
+			return
+		}
+		stampMembers(newDevc.Users, nil, actorOf(c), time.Now())
+		if err := app.Devices.AddNewDevice(&newDevc, ctx); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
 				"stack_trace": "HndlLstDvcs/POST",
 			}))
 			return
 		}
+		app.decorate(&newDevc, time.Now())
 		c.AbortWithStatusJSON(http.StatusOK, &newDevc)
 		return
 	} else if c.Request.Method == "GET" {
-		// ?filter=users&user=email
-		// val, is the email of the users for which we filter the devices
+		// ?filter=users&status=online
+		// devices are of the user of the token, ?user= if sent is not gone by
+		// status is optional, narrows down the list to devices online / stale / offline
 		filter := c.Query("filter")
-		val := c.Query("user")
+		val := userOf(c)
+		status := c.Query("status")
+		if status != "" && status != DeviceOnline && status != DeviceStale && status != DeviceOffline {
+			httperr.HttpErrOrOkDispatch(c, httperr.ErrInvalidParam(fmt.Errorf("invalid device status filter %s", status)), reqLog(c).WithFields(log.Fields{
+				"stack_trace": "HndlLstDvcs/GET",
+			}))
+			return
+		}
 		if filter == "users" {
 			result := []Device{}
-			if err := DevicesCollc(db).DevicesOfUser(val, ctx, &result); err != nil {
-				httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			if err := app.Devices.DevicesOfUser(val, ctx, &result); err != nil {
+				httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
 					"stack_trace": "HndlLstDvcs/GET",
 				}))
 				return
 			}
-			c.AbortWithStatusJSON(http.StatusOK, result)
+			now := time.Now()
+			filtered := []Device{}
+			for _, dev := range result {
+				app.decorate(&dev, now)
+				if status == "" || dev.Status == status {
+					filtered = append(filtered, dev)
+				}
+			}
+			c.AbortWithStatusJSON(http.StatusOK, filtered)
+			return
+		}
+	}
+	c.AbortWithStatus(http.StatusMethodNotAllowed)
+}
+
+// HndlHeartbeat : heartbeat from the device over http, fallback for when the device cannot reach the broker
+// mac in the url is the device the heartbeat is for, ip defaults to that of the caller
+func (app *App) HndlHeartbeat(c *gin.Context) {
+	ctx, cancel := app.opCtx(c.Request.Context())
+	defer cancel()
+	val, _ := c.Get("device")
+	deviceDetails, _ := val.(*Device)
+	if !permitted(c, deviceDetails, RoleOperator, "HndlHeartbeat") {
+		return
+	}
+	hb := Heartbeat{}
+	if err := c.ShouldBind(&hb); err != nil {
+		httperr.HttpErrOrOkDispatch(c, httperr.ErrBinding(err), reqLog(c).WithFields(log.Fields{
+			"stack_trace": "HndlHeartbeat",
+		}))
+		return
+	}
+	hb.MacID = DevMacID(c.Param("deviceid"))
+	if hb.IP == "" {
+		hb.IP = c.ClientIP()
+	}
+	if err := app.Presence.Beat(hb, ctx); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+			"stack_trace": "HndlHeartbeat",
+			"mac":         hb.MacID,
+		}))
+		return
+	}
+	c.AbortWithStatus(http.StatusOK)
+}
+
+// HndlShadow : desired, reported config of the device and the delta between them
+// GET gets the shadow, POST is the device reporting the config it has applied
+func (app *App) HndlShadow(c *gin.Context) {
+	ctx, cancel := app.opCtx(c.Request.Context())
+	defer cancel()
+	val, _ := c.Get("device")
+	deviceDetails, _ := val.(*Device)
+	if c.Request.Method == "POST" {
+		if !permitted(c, deviceDetails, RoleOperator, "HndlShadow/POST") {
+			return
+		}
+		rpt := aquacfg.Schedule{}
+		if err := c.ShouldBind(&rpt); err != nil {
+			httperr.HttpErrOrOkDispatch(c, httperr.ErrBinding(err), reqLog(c).WithFields(log.Fields{
+				"stack_trace": "HndlShadow/POST",
+			}))
+			return
+		}
+		if err := app.Shadows.Report(DevMacID(c.Param("deviceid")), rpt, ctx); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+				"stack_trace": "HndlShadow/POST",
+				"mac":         c.Param("deviceid"),
+			}))
+			return
+		}
+		c.AbortWithStatus(http.StatusOK)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, deviceDetails.Shadow)
+}
+
+// HndlRevisions : history of the config changes on the device
+// GET /revisions lists all the revisions, latest first
+// GET /revisions/diff?from=&to= is the difference between the new config of the two revisions
+func (app *App) HndlRevisions(c *gin.Context) {
+	ctx, cancel := app.opCtx(c.Request.Context())
+	defer cancel()
+	val, _ := c.Get("device")
+	deviceDetails, _ := val.(*Device)
+	if strings.HasSuffix(c.FullPath(), "/diff") {
+		from, errFrom := strconv.Atoi(c.Query("from"))
+		to, errTo := strconv.Atoi(c.Query("to"))
+		if errFrom != nil || errTo != nil {
+			httperr.HttpErrOrOkDispatch(c, httperr.ErrInvalidParam(fmt.Errorf("invalid revisions to diff %s, %s", c.Query("from"), c.Query("to"))), reqLog(c).WithFields(log.Fields{
+				"stack_trace": "HndlRevisions/diff",
+			}))
+			return
+		}
+		revFrom, revTo := CfgRevision{}, CfgRevision{}
+		for _, r := range []struct {
+			num int
+			rev *CfgRevision
+		}{{from, &revFrom}, {to, &revTo}} {
+			if err := app.Revisions.RevisionOf(deviceDetails.MacID, r.num, r.rev, ctx); err != nil {
+				httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+					"stack_trace": "HndlRevisions/diff",
+					"mac":         deviceDetails.MacID,
+				}))
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"from": from,
+			"to":   to,
+			"diff": CfgDiff(&revFrom.New, &revTo.New),
+		})
+		return
+	}
+	result := []CfgRevision{}
+	if err := app.Revisions.Revisions(deviceDetails.MacID, &result, ctx); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+			"stack_trace": "HndlRevisions",
+			"mac":         deviceDetails.MacID,
+		}))
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, result)
+}
+
+// HndlRollback : sets the device config back to that of the given revision
+// rollback is a config change by itself, pushed to the device and recorded as a fresh revision
+func (app *App) HndlRollback(c *gin.Context) {
+	ctx, cancel := app.opCtx(c.Request.Context())
+	defer cancel()
+	val, _ := c.Get("device")
+	deviceDetails, _ := val.(*Device)
+	revNum, err := strconv.Atoi(c.Param("rev"))
+	if err != nil {
+		httperr.HttpErrOrOkDispatch(c, httperr.ErrInvalidParam(fmt.Errorf("invalid revision %s", c.Param("rev"))), reqLog(c).WithFields(log.Fields{
+			"stack_trace": "HndlRollback",
+		}))
+		return
+	}
+	if !permitted(c, deviceDetails, RoleOperator, "HndlRollback") {
+		return
+	}
+	rev := CfgRevision{}
+	if err := app.Revisions.RevisionOf(deviceDetails.MacID, revNum, &rev, ctx); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+			"stack_trace": "HndlRollback",
+			"mac":         deviceDetails.MacID,
+		}))
+		return
+	}
+	ifVersion, ok := ifMatch(c, deviceDetails)
+	if !ok {
+		return
+	}
+	status, ok := app.pushConfig(c, deviceDetails, rev.New, CfgChange{By: actorOf(c), RollbackOf: rev.Rev, IfVersion: ifVersion}, ctx)
+	if !ok {
+		return
+	}
+	if err := app.Devices.GetOfId(deviceDetails.MacID, deviceDetails, ctx); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+			"stack_trace": "HndlRollback/getting_updated",
+		}))
+		return
+	}
+	app.decorate(deviceDetails, time.Now())
+	c.Header("ETag", etagOf(deviceDetails))
+	c.AbortWithStatusJSON(status, deviceDetails)
+}
+
+// HndlTrash : devices deleted but not yet purged
+// GET lists the trashed devices of the user of the token
+// POST /:deviceid/restore brings the device back, DELETE purges it permanently
+// only the owners of the device in the trash can restore / purge it
+func (app *App) HndlTrash(c *gin.Context) {
+	ctx, cancel := app.opCtx(c.Request.Context())
+	defer cancel()
+	mac := DevMacID(c.Param("deviceid"))
+	result := []Device{}
+	if err := app.Devices.TrashedDevices(userOf(c), &result, ctx); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+			"stack_trace": "HndlTrash",
+		}))
+		return
+	}
+	if c.Request.Method == "GET" {
+		c.AbortWithStatusJSON(http.StatusOK, result)
+		return
+	}
+	dev := trashedOf(result, mac)
+	if dev == nil {
+		httperr.HttpErrOrOkDispatch(c, httperr.ErrResourceNotFound(fmt.Errorf("device %s not in the trash of %s", mac, userOf(c))), reqLog(c).WithFields(log.Fields{
+			"stack_trace": "HndlTrash",
+			"mac":         mac,
+		}))
+		return
+	}
+	if !permitted(c, dev, RoleOwner, "HndlTrash") {
+		return
+	}
+	if c.Request.Method == "POST" {
+		if err := app.Devices.RestoreDevice(mac, ctx); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+				"stack_trace": "HndlTrash/POST",
+				"mac":         mac,
+			}))
 			return
 		}
+		restored := Device{}
+		if err := app.Devices.GetOfId(mac, &restored, ctx); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+				"stack_trace": "HndlTrash/POST/getting_restored",
+			}))
+			return
+		}
+		app.decorate(&restored, time.Now())
+		c.Header("ETag", etagOf(&restored))
+		c.AbortWithStatusJSON(http.StatusOK, &restored)
+		return
+	} else if c.Request.Method == "DELETE" {
+		if err := app.Devices.PurgeDevice(mac, ctx); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+				"stack_trace": "HndlTrash/DELETE",
+				"mac":         mac,
+			}))
+			return
+		}
+		c.AbortWithStatus(http.StatusOK)
+		return
 	}
 	c.AbortWithStatus(http.StatusMethodNotAllowed)
 }
+
+// trashedOf : device of the mac among the trashed, nil when its not
+func trashedOf(trashed []Device, mac DevMacID) *Device {
+	for i := range trashed {
+		if trashed[i].MacID == mac {
+			return &trashed[i]
+		}
+	}
+	return nil
+}
+
+// stampMembers : who added the users and when, users already on the device keep the ones they have
+// dev is nil for a new registration
+func stampMembers(users []Membership, dev *Device, by string, now time.Time) {
+	for i := range users {
+		users[i].AddedBy, users[i].AddedAt = by, now
+		if dev == nil {
+			continue
+		}
+		for _, m := range dev.Users {
+			if m.Email == users[i].Email {
+				users[i].AddedBy, users[i].AddedAt = m.AddedBy, m.AddedAt
+			}
+		}
+	}
+}
@@ -0,0 +1,666 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+/* Scenarios from test/apitest.http and test/apitest.negative.http, run against the router
+on an in memory store with a fake broker in place of rabbit */
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// fakePublisher : stands in for the amqp publisher
+// publishes fail with the queued errors in order - ErrPublishNack, ErrConfirmTimeout .. , confirmed when none are queued
+type fakePublisher struct {
+	mu        sync.Mutex
+	hang      bool // publishes wait for their context to end, as on a broker that doesnt respond
+	fail      []error
+	published []DevMacID
+	msgs      []amqp.Publishing // properties of the confirmed publishes
+}
+
+func (fp *fakePublisher) Publish(ctx context.Context, mac DevMacID, payload []byte, opts ...PubOpt) error {
+	fp.mu.Lock()
+	if fp.hang {
+		fp.mu.Unlock()
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	defer fp.mu.Unlock()
+	if len(fp.fail) > 0 {
+		err := fp.fail[0]
+		fp.fail = fp.fail[1:]
+		return err
+	}
+	fp.published = append(fp.published, mac)
+	msg := amqp.Publishing{Body: payload}
+	for _, opt := range opts {
+		opt(&msg)
+	}
+	fp.msgs = append(fp.msgs, msg)
+	return nil
+}
+
+// failNext : the next publishes fail with errs
+func (fp *fakePublisher) failNext(errs ...error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.fail = append(fp.fail, errs...)
+}
+
+func (fp *fakePublisher) count() int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return len(fp.published)
+}
+
+type testServer struct {
+	app    *App
+	router *gin.Engine
+	store  *KVStore
+	pub    *fakePublisher
+}
+
+// newTestServer : router over a fresh in memory store, relay polls too slow to get in the way of the test
+func newTestServer(t *testing.T) *testServer {
+	store := NewMemStore()
+	pub := &fakePublisher{}
+	app := NewApp(nil, store.Stores(), pub, AppOpts{Relay: RelayOpts{PollEvery: time.Hour}})
+	auth, err := NewAuthenticator(AuthOpts{Secret: testJWTSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Auth = auth
+	t.Cleanup(func() {
+		app.Close()
+		store.Close()
+	})
+	return &testServer{app: app, router: NewRouter(app), store: store, pub: pub}
+}
+
+// testJWTSecret : HS256 key the test server verifies the tokens with
+const testJWTSecret = "devicereg-test-secret"
+
+// testUser : requests are made as this user unless an Authorization header is given
+const testUser = "kneerunjun@gmail.com"
+
+// bearer : Authorization header value with a token for the user, valid for an hour
+func bearer(sub string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   sub,
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	signed, err := token.SignedString([]byte(testJWTSecret))
+	if err != nil {
+		panic(err)
+	}
+	return "Bearer " + signed
+}
+
+// do : sends the request with the body as json, headers in pairs of key, value
+// request is made with a token for testUser unless the headers have Authorization
+func (ts *testServer) do(method, path string, body interface{}, headers ...string) *httptest.ResponseRecorder {
+	var rdr io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		rdr = strings.NewReader(b)
+	default:
+		byt, _ := json.Marshal(b)
+		rdr = bytes.NewReader(byt)
+	}
+	req := httptest.NewRequest(method, path, rdr)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", bearer(testUser))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	ts.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// register : registers the device, fails the test if it couldnt be
+func (ts *testServer) register(t *testing.T, mac DevMacID) {
+	t.Helper()
+	if rec := ts.do("POST", "/api/devices", registration(mac)); rec.Code != http.StatusOK {
+		t.Fatalf("failed to register device %s: %d %s", mac, rec.Code, rec.Body)
+	}
+}
+
+// outboxMsg : outbox message of the id as it is in the store
+func (ts *testServer) outboxMsg(id string) OutboxMsg {
+	msg := OutboxMsg{}
+	ts.store.kv.View(func(tx kvTx) error {
+		_, err := getDoc(tx, bktOutbox, id, &msg)
+		return err
+	})
+	return msg
+}
+
+func registration(mac DevMacID) gin.H {
+	return gin.H{
+		"name":     "Aquaponics pump control-I@Saidham",
+		"make":     "Raspberry Pi 0w 512M 16G",
+		"mac":      mac,
+		"location": "18.41827883006836, 73.76921566514285",
+		"users":    []string{"kneerunjun@gmail.com", "awatiniranjan@gmail.com"},
+		"cfg":      gin.H{"tickat": "12:00", "config": 0, "interval": 100, "pulsegap": 80},
+	}
+}
+
+func decodeDevice(t *testing.T, rec *httptest.ResponseRecorder) Device {
+	t.Helper()
+	dev := Device{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &dev); err != nil {
+		t.Fatalf("response isnt a device: %s", rec.Body)
+	}
+	return dev
+}
+
+const (
+	test200MacID = DevMacID("52-3C-42-D4-A9-F4")
+	test404MacID = DevMacID("26-97-ED-E5-FB-ED")
+)
+
+func TestRegisterDevice(t *testing.T) {
+	ts := newTestServer(t)
+	rec := ts.do("POST", "/api/devices", registration(test200MacID))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body)
+	}
+	if dev := decodeDevice(t, rec); dev.ID.IsZero() || dev.Status != DeviceOffline {
+		t.Fatalf("registered device not as expected %+v", dev)
+	}
+	if rec := ts.do("POST", "/api/devices", registration(test200MacID)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("duplicate registration, expected 400 got %d", rec.Code)
+	}
+	for name, mutate := range map[string]func(gin.H){
+		"invalid config": func(reg gin.H) { reg["cfg"] = gin.H{"tickat": "", "config": 1, "interval": 100, "pulsegap": 80} },
+		"invalid mac":    func(reg gin.H) { reg["mac"] = "" },
+		"no users":       func(reg gin.H) { reg["users"] = []string{} },
+	} {
+		t.Run(name, func(t *testing.T) {
+			reg := registration("52-3C-42-D4-A9-F0")
+			mutate(reg)
+			if rec := ts.do("POST", "/api/devices", reg); rec.Code != http.StatusBadRequest {
+				t.Fatalf("expected 400, got %d %s", rec.Code, rec.Body)
+			}
+		})
+	}
+	if rec := ts.do("POST", "/api/devices", "{not json"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad payload, expected 400 got %d", rec.Code)
+	}
+}
+
+func TestGetDevice(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, test200MacID)
+	rec := ts.do("GET", "/api/devices/"+string(test200MacID), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if dev := decodeDevice(t, rec); dev.MacID != test200MacID || dev.Shadow == nil {
+		t.Fatalf("device not as expected %+v", dev)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag on the device")
+	}
+	if rec := ts.do("GET", "/api/devices/"+string(test200MacID), nil, "If-None-Match", etag); rec.Code != http.StatusNotModified {
+		t.Fatalf("unchanged device, expected 304 got %d", rec.Code)
+	}
+	if rec := ts.do("GET", "/api/devices/"+string(test404MacID), nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("unregistered device, expected 404 got %d", rec.Code)
+	}
+}
+
+func TestDevicesOfUser(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, test200MacID)
+	for user, count := range map[string]int{"kneerunjun@gmail.com": 1, "behenkaloda@gmail.com": 0} {
+		rec := ts.do("GET", "/api/devices?filter=users", nil, "Authorization", bearer(user))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		devs := []Device{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &devs); err != nil || len(devs) != count {
+			t.Fatalf("expected %d devices of %s, got %s", count, user, rec.Body)
+		}
+	}
+	if rec := ts.do("GET", "/api/devices?filter=users&status=dead", nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid status filter, expected 400 got %d", rec.Code)
+	}
+}
+
+func TestDeleteDevice(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, test200MacID)
+	if rec := ts.do("DELETE", "/api/devices/"+string(test200MacID), nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if rec := ts.do("GET", "/api/devices/"+string(test200MacID), nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("deleted device, expected 404 got %d", rec.Code)
+	}
+	if rec := ts.do("DELETE", "/api/devices/"+string(test404MacID), nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("unregistered device, expected 404 got %d", rec.Code)
+	}
+	if rec := ts.do("POST", "/api/devices/trash/"+string(test200MacID)+"/restore", nil); rec.Code != http.StatusOK {
+		t.Fatalf("restoring, expected 200 got %d", rec.Code)
+	}
+	if rec := ts.do("GET", "/api/devices/"+string(test200MacID), nil); rec.Code != http.StatusOK {
+		t.Fatalf("restored device, expected 200 got %d", rec.Code)
+	}
+}
+
+// TestPurgeDue : devices past their time in the trash are purged with their config history and keys
+func TestPurgeDue(t *testing.T) {
+	ts := newTestServer(t)
+	ts.app.trashFor = time.Millisecond
+	ts.register(t, test200MacID)
+	ts.register(t, test404MacID)
+	path := "/api/devices/" + string(test200MacID)
+	ts.do("PATCH", path+"?path=config&action=replace", gin.H{"tickat": "05:00", "config": 1, "interval": 60, "pulsegap": 1800})
+	key := ts.issueKey(t, test200MacID)
+	signing := []SigningKey{}
+	if ts.store.SigningKeysOf(test200MacID, &signing, context.Background()); len(signing) == 0 {
+		t.Fatal("no signing key on the device to purge")
+	}
+	if rec := ts.do("DELETE", path, nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if n := ts.app.Purger.purge(); n != 1 {
+		t.Fatalf("expected 1 device purged, got %d", n)
+	}
+	ctx := context.Background()
+	revs := []CfgRevision{}
+	ts.store.Revisions(test200MacID, &revs, ctx)
+	if len(revs) != 0 {
+		t.Errorf("revisions left after purge %+v", revs)
+	}
+	if err := ts.store.KeyOf(key.ID, &ApiKey{}, ctx); err == nil {
+		t.Error("api key left after purge")
+	}
+	ts.store.SigningKeysOf(test200MacID, &signing, ctx)
+	if len(signing) != 0 {
+		t.Errorf("signing keys left after purge %+v", signing)
+	}
+	if rec := ts.do("GET", "/api/devices/"+string(test404MacID), nil); rec.Code != http.StatusOK {
+		t.Errorf("device not in the trash purged, got %d", rec.Code)
+	}
+	if n := ts.app.Purger.purge(); n != 0 {
+		t.Errorf("purged again %d", n)
+	}
+}
+
+func TestAppendUsers(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, test200MacID)
+	rec := ts.do("PATCH", "/api/devices/"+string(test200MacID)+"?path=users&action=append", []string{"kneerunjun@chutchaman.com"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body)
+	}
+	if dev := decodeDevice(t, rec); len(dev.Users) != 3 {
+		t.Fatalf("user not appended %v", dev.Users)
+	}
+	if rec := ts.do("PATCH", "/api/devices/"+string(test200MacID)+"?path=users&action=remove", []string{}); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("unknown action, expected 405 got %d", rec.Code)
+	}
+}
+
+// TestPatchConfig : each branch of the config PATCH in HndlOneDvc
+// NOTE: config used to be reverted when the publish failed, that was replaced by the outbox
+// config now stays as patched and the push is retried from the outbox, which is what the failing branches check
+func TestPatchConfig(t *testing.T) {
+	newCfg := gin.H{"tickat": "05:00", "config": 1, "interval": 60, "pulsegap": 1800}
+	path := "/api/devices/" + string(test200MacID) + "?path=config&action=replace"
+
+	t.Run("delivered", func(t *testing.T) {
+		ts := newTestServer(t)
+		ts.register(t, test200MacID)
+		rec := ts.do("PATCH", path, newCfg)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body)
+		}
+		dev := decodeDevice(t, rec)
+		if dev.Cfg.TickAt != "05:00" || dev.CfgRev != 1 || len(dev.Pushes) != 1 || dev.Pushes[0].Status != PushPending {
+			t.Fatalf("device not as expected after a delivered patch %+v", dev)
+		}
+		if ts.pub.count() != 1 {
+			t.Fatalf("expected 1 publish, got %d", ts.pub.count())
+		}
+		revs := []CfgRevision{}
+		ts.store.Revisions(test200MacID, &revs, context.Background())
+		if len(revs) != 1 || revs[0].By != "kneerunjun@gmail.com" || revs[0].Old == nil || revs[0].Old.TickAt != "12:00" {
+			t.Fatalf("revision not recorded %+v", revs)
+		}
+	})
+
+	for name, pubErr := range map[string]error{
+		"nacked":          ErrPublishNack,
+		"confirm timeout": ErrConfirmTimeout,
+		"broker down":     ErrBrokerDown,
+		"not listening":   ErrUnroutable,
+	} {
+		t.Run(name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.register(t, test200MacID)
+			ts.pub.failNext(pubErr)
+			rec := ts.do("PATCH", path, newCfg)
+			if rec.Code != http.StatusAccepted {
+				t.Fatalf("expected 202, got %d %s", rec.Code, rec.Body)
+			}
+			dev := decodeDevice(t, rec)
+			if dev.Cfg.TickAt != "05:00" {
+				t.Fatalf("config not kept when the publish failed %+v", dev.Cfg)
+			}
+			if len(dev.Pushes) != 1 || dev.Pushes[0].Status != PushUndelivered || dev.Pushes[0].Reason != pubErr.Error() {
+				t.Fatalf("push not marked undelivered %+v", dev.Pushes)
+			}
+			msg := ts.outboxMsg(dev.Pushes[0].MsgID)
+			if msg.Status != OutboxPending || msg.Attempts != 1 || !msg.NextAttemptAt.After(time.Now()) {
+				t.Fatalf("outbox message not queued for a retry %+v", msg)
+			}
+		})
+	}
+
+	t.Run("given up", func(t *testing.T) {
+		ts := newTestServer(t)
+		ts.app.Relay.opts.MaxAttempts = 2
+		ts.register(t, test200MacID)
+		ts.pub.failNext(ErrUnroutable, ErrUnroutable)
+		rec := ts.do("PATCH", path, newCfg)
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d %s", rec.Code, rec.Body)
+		}
+		msgID := decodeDevice(t, rec).Pushes[0].MsgID
+		msg := ts.outboxMsg(msgID)
+		if err := ts.app.Relay.Deliver(context.Background(), &msg); !errors.Is(err, ErrUnroutable) {
+			t.Fatalf("expected unroutable, got %v", err)
+		}
+		if msg := ts.outboxMsg(msgID); msg.Status != OutboxFailed || msg.Attempts != 2 {
+			t.Fatalf("outbox message not given up %+v", msg)
+		}
+		dev := decodeDevice(t, ts.do("GET", "/api/devices/"+string(test200MacID), nil))
+		if dev.Pushes[0].Status != PushExpired || !strings.HasPrefix(dev.Pushes[0].Reason, "gave up after 2 attempts") {
+			t.Fatalf("push not expired when given up %+v", dev.Pushes)
+		}
+		if claimed, _ := ts.store.ClaimOutbox(time.Minute, 10, context.Background()); len(claimed) != 0 {
+			t.Errorf("message given up claimed again %+v", claimed)
+		}
+	})
+
+	t.Run("device deleted", func(t *testing.T) {
+		ts := newTestServer(t)
+		ts.register(t, test200MacID)
+		ts.pub.failNext(ErrBrokerDown)
+		rec := ts.do("PATCH", path, newCfg)
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d %s", rec.Code, rec.Body)
+		}
+		msgID := decodeDevice(t, rec).Pushes[0].MsgID
+		if rec := ts.do("DELETE", "/api/devices/"+string(test200MacID), nil); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if msg := ts.outboxMsg(msgID); msg.Status != OutboxSuperseded {
+			t.Fatalf("pending message of a deleted device not superseded %+v", msg)
+		}
+		if claimed, _ := ts.store.ClaimOutbox(time.Minute, 10, context.Background()); len(claimed) != 0 {
+			t.Errorf("message of a deleted device claimed %+v", claimed)
+		}
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		ts := newTestServer(t)
+		ts.register(t, test200MacID)
+		rec := ts.do("PATCH", path, gin.H{"tickat": "", "config": 1, "interval": 60, "pulsegap": 1800})
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d", rec.Code)
+		}
+		if rec := ts.do("PATCH", path, "{not json"); rec.Code != http.StatusBadRequest {
+			t.Fatalf("bad payload, expected 400 got %d", rec.Code)
+		}
+		if ts.pub.count() != 0 {
+			t.Fatal("invalid config was published")
+		}
+	})
+
+	t.Run("broker not responding", func(t *testing.T) {
+		ts := newTestServer(t)
+		ts.app.Relay.opts.PublishTimeout = 50 * time.Millisecond
+		ts.register(t, test200MacID)
+		ts.pub.hang = true
+		start := time.Now()
+		rec := ts.do("PATCH", path, newCfg)
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d %s", rec.Code, rec.Body)
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("request held up by the broker for %s", time.Since(start))
+		}
+		if dev := decodeDevice(t, rec); dev.Cfg.TickAt != "05:00" || dev.Pushes[0].Status != PushUndelivered {
+			t.Fatalf("config not queued for the relay %+v", dev.Pushes)
+		}
+	})
+
+	t.Run("relay lease runs out", func(t *testing.T) {
+		ts := newTestServer(t)
+		ts.app.Relay.opts.Lease = 150 * time.Millisecond
+		ts.app.Relay.opts.PublishTimeout = 100 * time.Millisecond
+		ids := []string{}
+		for _, mac := range []DevMacID{test200MacID, test404MacID, "52-3C-42-D4-A9-F0"} {
+			ts.register(t, mac)
+			msg, err := ts.store.PatchConfgOutbox(mac, testSchedule(), CfgChange{By: testUser}, 0, context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, msg.ID.Hex())
+		}
+		ts.pub.hang = true
+		ts.app.Relay.relay()
+		attempted := 0
+		for _, id := range ids {
+			msg := ts.outboxMsg(id)
+			if msg.Status != OutboxPending {
+				t.Fatalf("message %s no longer pending %+v", id, msg)
+			}
+			attempted += msg.Attempts
+		}
+		// one publish used up the lease, the ones not attempted dont count as failed
+		if attempted != 1 {
+			t.Fatalf("expected 1 attempt within the lease, got %d", attempted)
+		}
+	})
+
+	t.Run("changed since", func(t *testing.T) {
+		ts := newTestServer(t)
+		ts.register(t, test200MacID)
+		etag := ts.do("GET", "/api/devices/"+string(test200MacID), nil).Header().Get("ETag")
+		if rec := ts.do("PATCH", path, newCfg, "If-Match", etag); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if rec := ts.do("PATCH", path, newCfg, "If-Match", etag); rec.Code != http.StatusPreconditionFailed {
+			t.Fatalf("stale If-Match, expected 412 got %d", rec.Code)
+		}
+		if ts.pub.count() != 1 {
+			t.Fatalf("expected 1 publish, got %d", ts.pub.count())
+		}
+	})
+
+	t.Run("not registered", func(t *testing.T) {
+		ts := newTestServer(t)
+		if rec := ts.do("PATCH", "/api/devices/"+string(test404MacID)+"?path=config&action=replace", newCfg); rec.Code != http.StatusNotFound {
+			t.Fatalf("expected 404, got %d", rec.Code)
+		}
+	})
+}
+
+// TestAcks : acknowledgements from the devices on the broker mark the pushes and their revisions
+func TestAcks(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, test200MacID)
+	other := DevMacID("52-3C-42-D4-A9-F0")
+	ts.register(t, other)
+	path := "/api/devices/" + string(test200MacID)
+	// pushed : config changed, message id of its push
+	pushed := func(t *testing.T, tickAt string) string {
+		t.Helper()
+		if rec := ts.do("PATCH", path+"?path=config&action=replace", gin.H{"tickat": tickAt, "config": 1, "interval": 60, "pulsegap": 1800}); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body)
+		}
+		return ts.pub.msgs[len(ts.pub.msgs)-1].MessageId
+	}
+	ack := func(mac DevMacID, ok bool, msgID string) []byte {
+		byt, _ := json.Marshal(CmdAck{DevcMacId: string(mac), Ack: ok, MsgID: msgID})
+		return byt
+	}
+	// statusOf : status of the push on the device and delivery on its revision
+	statusOf := func(t *testing.T, msgID string) (string, string) {
+		t.Helper()
+		status, delivery := "", ""
+		for _, p := range decodeDevice(t, ts.do("GET", path, nil)).Pushes {
+			if p.MsgID == msgID {
+				status = p.Status
+			}
+		}
+		revs := []CfgRevision{}
+		json.Unmarshal(ts.do("GET", path+"/revisions", nil).Body.Bytes(), &revs)
+		for _, rev := range revs {
+			if rev.MsgID == msgID {
+				delivery = rev.Delivery
+			}
+		}
+		return status, delivery
+	}
+
+	t.Run("acked by correlation id", func(t *testing.T) {
+		msgID := pushed(t, "05:00")
+		// correlation id is the push, message id in the payload is ignored when there is one
+		if err := ts.app.Acks.handle(amqp.Delivery{CorrelationId: msgID, Body: ack(test200MacID, true, "stale")}); err != nil {
+			t.Fatal(err)
+		}
+		if status, delivery := statusOf(t, msgID); status != PushAcked || delivery != PushAcked {
+			t.Errorf("expected acked got %s / %s", status, delivery)
+		}
+	})
+	t.Run("nacked by payload msgid", func(t *testing.T) {
+		msgID := pushed(t, "06:00")
+		if err := ts.app.Acks.handle(amqp.Delivery{Body: ack(test200MacID, false, msgID)}); err != nil {
+			t.Fatal(err)
+		}
+		if status, delivery := statusOf(t, msgID); status != PushNacked || delivery != PushNacked {
+			t.Errorf("expected nacked got %s / %s", status, delivery)
+		}
+	})
+	t.Run("rejected", func(t *testing.T) {
+		msgID := pushed(t, "07:00")
+		for what, d := range map[string]amqp.Delivery{
+			"other device":    {CorrelationId: msgID, Body: ack(other, true, "")},
+			"unknown msgid":   {CorrelationId: "6617e5c2a1b2c3d4e5f60718", Body: ack(test200MacID, true, "")},
+			"no msgid":        {Body: ack(test200MacID, true, "")},
+			"invalid mac":     {CorrelationId: msgID, Body: ack("b8:27", true, "")},
+			"invalid payload": {CorrelationId: msgID, Body: []byte("{not json")},
+		} {
+			if err := ts.app.Acks.handle(d); err == nil {
+				t.Errorf("%s, ack not rejected", what)
+			}
+		}
+		if status, delivery := statusOf(t, msgID); status != PushPending || delivery != PushPending {
+			t.Errorf("push changed by rejected acks, got %s / %s", status, delivery)
+		}
+	})
+	t.Run("expired", func(t *testing.T) {
+		msgID := pushed(t, "08:00")
+		n, err := ts.store.ExpirePushes(time.Now().Add(time.Second), context.Background())
+		if err != nil || n != 1 {
+			t.Fatalf("expected pushes on 1 device expired, got %d %v", n, err)
+		}
+		if status, delivery := statusOf(t, msgID); status != PushExpired || delivery != PushExpired {
+			t.Errorf("expected expired got %s / %s", status, delivery)
+		}
+		// ack after expiry still marks the push, the device did apply it
+		if err := ts.app.Acks.handle(amqp.Delivery{CorrelationId: msgID, Body: ack(test200MacID, true, "")}); err != nil {
+			t.Fatal(err)
+		}
+		if status, delivery := statusOf(t, msgID); status != PushAcked || delivery != PushAcked {
+			t.Errorf("late ack, expected acked got %s / %s", status, delivery)
+		}
+	})
+}
+
+// TestHeartbeatIngestion : heartbeats from the devices on the broker are recorded as their presence
+func TestHeartbeatIngestion(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, test200MacID)
+	handle := ts.app.Presence.Subscription().Handle
+	byt, _ := json.Marshal(Heartbeat{MacID: test200MacID, Firmware: "1.2.0", Uptime: 3600, IP: "192.168.1.7"})
+	if err := handle(amqp.Delivery{Body: byt}); err != nil {
+		t.Fatal(err)
+	}
+	dev := decodeDevice(t, ts.do("GET", "/api/devices/"+string(test200MacID), nil))
+	if dev.Presence == nil || dev.Presence.Firmware != "1.2.0" || dev.Presence.IP != "192.168.1.7" || dev.Status != DeviceOnline {
+		t.Fatalf("heartbeat not recorded %+v %s", dev.Presence, dev.Status)
+	}
+	unknown, _ := json.Marshal(Heartbeat{MacID: test404MacID})
+	for what, body := range map[string][]byte{"not registered": unknown, "invalid payload": []byte("{not json")} {
+		if err := handle(amqp.Delivery{Body: body}); err == nil {
+			t.Errorf("%s, heartbeat not rejected", what)
+		}
+	}
+}
+
+// TestReconcile : devices that havent caught up with the desired config have it pushed again, once
+func TestReconcile(t *testing.T) {
+	ts := newTestServer(t)
+	ts.app.Shadows.opts.DriftAfter = 50 * time.Millisecond
+	other := DevMacID("52-3C-42-D4-A9-F0")
+	ts.register(t, test200MacID)
+	ts.register(t, other)
+	handle := ts.app.Shadows.Subscription().Handle
+	for mac, drifted := range map[DevMacID]bool{test200MacID: true, other: false} {
+		reported := *decodeDevice(t, ts.do("GET", "/api/devices/"+string(mac), nil)).Cfg
+		if drifted {
+			reported.Interval++
+		}
+		byt, _ := json.Marshal(CfgReport{MacID: mac, Cfg: reported})
+		if err := handle(amqp.Delivery{Body: byt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if shadow := decodeDevice(t, ts.do("GET", "/api/devices/"+string(other), nil)).Shadow; len(shadow.Delta) != 0 {
+		t.Fatalf("device reporting the desired config not in sync %v", shadow.Delta)
+	}
+	time.Sleep(60 * time.Millisecond)
+	ts.app.Shadows.reconcile()
+	ts.app.Relay.relay()
+	if ts.pub.count() != 1 || ts.pub.published[0] != test200MacID {
+		t.Fatalf("expected one push again to the drifted device, got %v", ts.pub.published)
+	}
+	// push again resets the drift clock, the device isnt pushed to again right away
+	ts.app.Shadows.reconcile()
+	ts.app.Relay.relay()
+	if ts.pub.count() != 1 {
+		t.Fatalf("drifted device pushed to again right away, got %v", ts.pub.published)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// version : build of the api, set when building
+// go build -ldflags "-X main.version=v0.0.4"
+var version = "dev"
+
+// HealthReporter : dependency that keeps its own health state up to date in the background
+// MongoPool, AmqpPublisher and AmqpConsumer are all reporters
+type HealthReporter interface {
+	Health() DepHealth
+}
+
+// DepStatus : health of a dependency as sent out on /status
+type DepStatus struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	Readiness bool      `json:"readiness"` // api isnt ready when this dependency isnt healthy
+	LastErr   string    `json:"lasterr,omitempty"`
+	LastCheck time.Time `json:"lastcheck"`
+	Latency   string    `json:"latency"` // as of the last check
+}
+
+// ApiStatus : response of /status
+type ApiStatus struct {
+	Version string      `json:"version"`
+	Started time.Time   `json:"started"`
+	Uptime  string      `json:"uptime"`
+	Ready   bool        `json:"ready"`
+	Deps    []DepStatus `json:"deps"`
+}
+
+type watchedDep struct {
+	name      string
+	dep       HealthReporter
+	readiness bool
+}
+
+// Health : dependencies of the api that are reported on, readiness goes by the ones marked so
+// Checks are not made here, each dependency keeps its own state - this only reads them
+type Health struct {
+	started time.Time
+	mu      sync.RWMutex
+	deps    []watchedDep
+}
+
+// NewHealth : nothing watched yet, api is ready till a dependency is added
+func NewHealth() *Health {
+	return &Health{started: time.Now()}
+}
+
+// Watch : adds the dependency to the status, readiness when the api cannot serve without it
+func (h *Health) Watch(name string, dep HealthReporter, readiness bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.deps = append(h.deps, watchedDep{name: name, dep: dep, readiness: readiness})
+}
+
+// Status : state of all the dependencies as of their last checks
+func (h *Health) Status() ApiStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	status := ApiStatus{
+		Version: version,
+		Started: h.started,
+		Uptime:  time.Since(h.started).Round(time.Second).String(),
+		Ready:   true,
+		Deps:    []DepStatus{},
+	}
+	for _, wd := range h.deps {
+		dh := wd.dep.Health()
+		ds := DepStatus{
+			Name:      wd.name,
+			Healthy:   dh.Healthy,
+			Readiness: wd.readiness,
+			LastCheck: dh.LastCheck,
+			Latency:   dh.Latency.String(),
+		}
+		if dh.LastErr != nil {
+			ds.LastErr = dh.LastErr.Error()
+		}
+		if wd.readiness && !dh.Healthy {
+			status.Ready = false
+		}
+		status.Deps = append(status.Deps, ds)
+	}
+	return status
+}
+
+// HndlHealthz : liveness, process is up and serving
+// dependencies are left out on purpose, restarting the pod wont bring the broker back
+func (app *App) HndlHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "version": version})
+}
+
+// HndlReadyz : readiness, 503 when any of the dependencies the api needs to serve is down
+// as when the broker is being reconnected to, so traffic is drained away from the pod
+func (app *App) HndlReadyz(c *gin.Context) {
+	status := app.Health.Status()
+	if !status.Ready {
+		down := []string{}
+		for _, ds := range status.Deps {
+			if ds.Readiness && !ds.Healthy {
+				down = append(down, ds.Name)
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "down": down})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+// HndlStatus : each dependency with its state, last error and latency along with the build version
+func (app *App) HndlStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, app.Health.Status())
+}
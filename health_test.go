@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDep : dependency whose health is set by the test
+type fakeDep struct {
+	mu     sync.Mutex
+	health DepHealth
+}
+
+func (fd *fakeDep) Health() DepHealth {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	return fd.health
+}
+
+func (fd *fakeDep) set(healthy bool, err error) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.health = DepHealth{Healthy: healthy, LastErr: err, LastCheck: time.Now(), Latency: 3 * time.Millisecond}
+}
+
+func TestProbes(t *testing.T) {
+	ts := newTestServer(t)
+	broker, consumer := &fakeDep{}, &fakeDep{}
+	broker.set(true, nil)
+	consumer.set(true, nil)
+	ts.app.Health.Watch("amqp-publisher", broker, true)
+	ts.app.Health.Watch("amqp-consumer", consumer, false)
+
+	if rec := ts.do("GET", "/readyz", nil); rec.Code != http.StatusOK {
+		t.Errorf("expected ready with all dependencies up, got %d %s", rec.Code, rec.Body)
+	}
+	consumer.set(false, errors.New("connection refused"))
+	if rec := ts.do("GET", "/readyz", nil); rec.Code != http.StatusOK {
+		t.Errorf("expected ready with only the consumer down, got %d %s", rec.Code, rec.Body)
+	}
+	broker.set(false, errors.New("amqp connection closed"))
+	if rec := ts.do("GET", "/readyz", nil); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 while the broker is reconnecting, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := ts.do("GET", "/healthz", nil); rec.Code != http.StatusOK {
+		t.Errorf("expected live regardless of the dependencies, got %d", rec.Code)
+	}
+
+	rec := ts.do("GET", "/status", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for status, got %d", rec.Code)
+	}
+	status := ApiStatus{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("unexpected status response %s", rec.Body)
+	}
+	if status.Ready || status.Version != version || len(status.Deps) != 2 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if ds := status.Deps[0]; ds.Name != "amqp-publisher" || ds.Healthy || ds.LastErr != "amqp connection closed" || ds.Latency != "3ms" {
+		t.Errorf("unexpected publisher status %+v", ds)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"github.com/streadway/amqp"
+)
+
+// PresenceOpts : where the heartbeats come from and the thresholds to derive device status
+type PresenceOpts struct {
+	Exchange     string        // fanout exchange devices publish heartbeats on
+	Queue        string        // durable queue the registry consumes heartbeats from, shared across replicas
+	OnlineWithin time.Duration // device is online if last seen within this
+	OfflineAfter time.Duration // device is offline if not seen since this, stale in between
+}
+
+func (opts *PresenceOpts) defaults() {
+	if opts.Exchange == "" {
+		opts.Exchange = "heartbeats"
+	}
+	if opts.Queue == "" {
+		opts.Queue = "devicereg_heartbeats"
+	}
+	if opts.OnlineWithin == 0 {
+		opts.OnlineWithin = 90 * time.Second
+	}
+	if opts.OfflineAfter < opts.OnlineWithin {
+		opts.OfflineAfter = 10 * time.Minute
+	}
+}
+
+// Presences : ingests the heartbeats from the devices and derives their status
+type Presences struct {
+	store PresenceStore
+	opts  PresenceOpts
+}
+
+// NewPresences : thresholds not set in opts are defaulted
+func NewPresences(store PresenceStore, opts PresenceOpts) *Presences {
+	opts.defaults()
+	return &Presences{store: store, opts: opts}
+}
+
+// StatusOf : online / stale / offline as of now, devices that never sent a heartbeat are offline
+func (ps *Presences) StatusOf(dev *Device, now time.Time) string {
+	if dev.Presence == nil {
+		return DeviceOffline
+	}
+	since := now.Sub(dev.Presence.LastSeen)
+	if since <= ps.opts.OnlineWithin {
+		return DeviceOnline
+	} else if since <= ps.opts.OfflineAfter {
+		return DeviceStale
+	}
+	return DeviceOffline
+}
+
+// Beat : records the heartbeat as of now
+func (ps *Presences) Beat(hb Heartbeat, ctx context.Context) httperr.HttpErr {
+	return ps.store.Beat(hb, time.Now(), ctx)
+}
+
+// Subscription : consumes heartbeats from the devices on the heartbeat exchange
+func (ps *Presences) Subscription() Subscription {
+	return Subscription{
+		Name: "heartbeats",
+		Setup: func(ch *amqp.Channel) (string, error) {
+			if err := ch.ExchangeDeclare(ps.opts.Exchange, "fanout", true, false, false, false, nil); err != nil {
+				return "", err
+			}
+			q, err := ch.QueueDeclare(ps.opts.Queue, true, false, false, false, nil)
+			if err != nil {
+				return "", err
+			}
+			return q.Name, ch.QueueBind(q.Name, "", ps.opts.Exchange, false, nil)
+		},
+		Handle: func(d amqp.Delivery) error {
+			hb := Heartbeat{}
+			if err := json.Unmarshal(d.Body, &hb); err != nil {
+				return fmt.Errorf("invalid heartbeat payload %s", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := ps.Beat(hb, ctx); err != nil {
+				return fmt.Errorf("failed to record heartbeat, %v", err)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,1061 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"github.com/eensymachines-in/patio/aquacfg"
+	"github.com/eensymachines-in/webapi-devicereg/cfgenc"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Buckets on the key value backend, same as the mongo collections
+const (
+	bktDevices   = "devices"     // devices by mac
+	bktOutbox    = "outbox"      // outbox messages by id
+	bktRevisions = "revisions"   // revisions by mac/rev
+	bktApiKeys   = "apikeys"     // api keys of the devices by id
+	bktSignKeys  = "signingkeys" // signing keys of the devices by id
+)
+
+// kvTx : documents in buckets keyed by id, as seen from within a transaction
+// NOTE: buckets arent to be changed from within ForEach, collect the keys and change them after
+type kvTx interface {
+	Get(bucket, key string) ([]byte, error) // nil when the key isnt there
+	Put(bucket, key string, val []byte) error
+	Delete(bucket, key string) error
+	ForEach(bucket string, fn func(key string, val []byte) error) error // in the order of the keys
+}
+
+// kvBackend : key value storage under the KVStore
+// writes are done one transaction at a time, changes of a transaction are discarded when fn errors
+type kvBackend interface {
+	View(fn func(tx kvTx) error) error
+	Update(fn func(tx kvTx) error) error
+	Close() error
+}
+
+// txAbort : error the transaction is aborted with, carried out as is to the caller
+type txAbort struct {
+	httperr.HttpErr
+}
+
+func (ta txAbort) Error() string {
+	return fmt.Sprintf("transaction aborted, status %d", ta.HttpStatusCode())
+}
+
+// asHttpErr : errors from the transaction, other than the ones aborted with, are db query errors
+func asHttpErr(err error) httperr.HttpErr {
+	if err == nil {
+		return nil
+	}
+	ta := txAbort{}
+	if errors.As(err, &ta) {
+		return ta.HttpErr
+	}
+	return httperr.ErrDBQuery(err)
+}
+
+// getDoc : decodes the document at key onto v, false when the key isnt there
+func getDoc(tx kvTx, bucket, key string, v interface{}) (bool, error) {
+	byt, err := tx.Get(bucket, key)
+	if err != nil || byt == nil {
+		return false, err
+	}
+	return true, bson.Unmarshal(byt, v)
+}
+
+// putDoc : encodes v as the document at key
+func putDoc(tx kvTx, bucket, key string, v interface{}) error {
+	byt, err := bson.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Put(bucket, key, byt)
+}
+
+// revKey : revisions of a device are keyed in order
+func revKey(mac DevMacID, rev int) string {
+	return fmt.Sprintf("%s/%010d", mac, rev)
+}
+
+// KVStore : devices, outbox, revisions and keys over a key value backend - in memory or embedded on disk
+// Behaves the same as the mongo collections, including the expiry of the trashed devices and delivered messages
+// Implements all the stores the app runs on, see Stores
+type KVStore struct {
+	kv kvBackend
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewKVStore : store over the backend, expired documents are swept in the background
+func NewKVStore(kv kvBackend) *KVStore {
+	ks := &KVStore{
+		kv:   kv,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go ks.run()
+	return ks
+}
+
+// Stores : the store as all the stores of the app
+func (ks *KVStore) Stores() Stores {
+	return Stores{Devices: ks, Outbox: ks, Revisions: ks, Pushes: ks, Presence: ks, Shadows: ks, Fleet: ks, Keys: ks, Signing: ks}
+}
+
+// view / update : runs fn in a transaction, errors as HttpErr
+func (ks *KVStore) view(fn func(tx kvTx) error) httperr.HttpErr {
+	return asHttpErr(ks.kv.View(fn))
+}
+
+func (ks *KVStore) update(fn func(tx kvTx) error) httperr.HttpErr {
+	return asHttpErr(ks.kv.Update(fn))
+}
+
+// liveDevice : device of mac that isnt in the trash, only while at the version when not nil
+// aborts with 404 / 412 otherwise
+func liveDevice(tx kvTx, mac DevMacID, ifVersion *int64, dev *Device) error {
+	found, err := getDoc(tx, bktDevices, string(mac), dev)
+	if err != nil {
+		return err
+	}
+	if !found || dev.TrashAt != nil {
+		return txAbort{httperr.ErrResourceNotFound(fmt.Errorf("device not found %s", mac))}
+	}
+	if ifVersion != nil && dev.Version != *ifVersion {
+		return txAbort{ErrPrecondition(fmt.Errorf("device %s changed since version %d", mac, *ifVersion))}
+	}
+	return nil
+}
+
+// devicesWhere : all the devices that match, in the order they were registered
+func devicesWhere(tx kvTx, match func(dev *Device) bool) ([]Device, error) {
+	result := []Device{}
+	err := tx.ForEach(bktDevices, func(key string, val []byte) error {
+		dev := Device{}
+		if err := bson.Unmarshal(val, &dev); err != nil {
+			return err
+		}
+		if match(&dev) {
+			result = append(result, dev)
+		}
+		return nil
+	})
+	sort.SliceStable(result, func(i, j int) bool { return result[i].ID.Hex() < result[j].ID.Hex() })
+	return result, err
+}
+
+// deleteRevisions : drops the config history of the device
+func deleteRevisions(tx kvTx, mac DevMacID) error {
+	keys := []string{}
+	err := tx.ForEach(bktRevisions, func(key string, val []byte) error {
+		rev := CfgRevision{}
+		if err := bson.Unmarshal(val, &rev); err != nil {
+			return err
+		}
+		if rev.MacID == mac {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := tx.Delete(bktRevisions, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// supersedeOfDevice : pending outbox messages of the device are not relayed any more
+func supersedeOfDevice(tx kvTx, mac DevMacID) error {
+	superseded := []OutboxMsg{}
+	err := tx.ForEach(bktOutbox, func(key string, val []byte) error {
+		m := OutboxMsg{}
+		if err := bson.Unmarshal(val, &m); err != nil {
+			return err
+		}
+		if m.MacID == mac && m.Status == OutboxPending {
+			m.Status = OutboxSuperseded
+			superseded = append(superseded, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, m := range superseded {
+		if err := putDoc(tx, bktOutbox, m.ID.Hex(), &m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteOfDevice : drops the documents of the device from the bucket - api keys, signing keys
+func deleteOfDevice(tx kvTx, bucket string, mac DevMacID) error {
+	keys := []string{}
+	err := tx.ForEach(bucket, func(key string, val []byte) error {
+		doc := struct {
+			MacID DevMacID `bson:"mac"`
+		}{}
+		if err := bson.Unmarshal(val, &doc); err != nil {
+			return err
+		}
+		if doc.MacID == mac {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := tx.Delete(bucket, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keysWhere : all the api keys that match, oldest first
+func keysWhere(tx kvTx, match func(key *ApiKey) bool) ([]ApiKey, error) {
+	result := []ApiKey{}
+	err := tx.ForEach(bktApiKeys, func(id string, val []byte) error {
+		key := ApiKey{}
+		if err := bson.Unmarshal(val, &key); err != nil {
+			return err
+		}
+		if match(&key) {
+			result = append(result, key)
+		}
+		return nil
+	})
+	sort.SliceStable(result, func(i, j int) bool { return result[i].CreatedAt.Before(result[j].CreatedAt) })
+	return result, err
+}
+
+// hasUser : user is on the device in any role
+func hasUser(dev *Device, userid string) bool {
+	return dev.RoleOf(userid) != ""
+}
+
+// GetOfId : Gets a single device of Mac ID, devices in the trash are not found
+func (ks *KVStore) GetOfId(mac DevMacID, result *Device, ctx context.Context) httperr.HttpErr {
+	*result = Device{}
+	return ks.view(func(tx kvTx) error {
+		return liveDevice(tx, mac, nil, result)
+	})
+}
+
+// AddNewDevice : Adds a new device after validating it, duplicate mac - even in the trash - is rejected
+func (ks *KVStore) AddNewDevice(dev *Device, ctx context.Context) httperr.HttpErr {
+	if dev == nil || !dev.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("one or more fields on the device is invalid"))
+	}
+	return ks.update(func(tx kvTx) error {
+		existing, err := tx.Get(bktDevices, string(dev.MacID))
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return txAbort{httperr.DuplicateResourceErr(fmt.Errorf("device with Mac %s already registered", dev.MacID))}
+		}
+		dev.SetServerFields(time.Now())
+		dev.ID = primitive.NewObjectID()
+		return putDoc(tx, bktDevices, string(dev.MacID), dev)
+	})
+}
+
+// DeleteDevice : moves the device to the trash, purged after retain
+func (ks *KVStore) DeleteDevice(mac string, ifVersion *int64, retain time.Duration, ctx context.Context) httperr.HttpErr {
+	if !DevMacID(mac).IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid MAC for the device to delete %s", mac))
+	}
+	return ks.update(func(tx kvTx) error {
+		dev := Device{}
+		if err := liveDevice(tx, DevMacID(mac), ifVersion, &dev); err != nil {
+			return err
+		}
+		now := time.Now()
+		purgeAt := now.Add(retain)
+		dev.TrashAt, dev.PurgeAt = &now, &purgeAt
+		dev.Version++
+		if err := supersedeOfDevice(tx, DevMacID(mac)); err != nil {
+			return err
+		}
+		return putDoc(tx, bktDevices, mac, &dev)
+	})
+}
+
+// TrashedDevices : devices in the trash, of the user when userid is not empty, latest trashed first
+func (ks *KVStore) TrashedDevices(userid string, result *[]Device, ctx context.Context) httperr.HttpErr {
+	return ks.view(func(tx kvTx) error {
+		devs, err := devicesWhere(tx, func(dev *Device) bool {
+			return dev.TrashAt != nil && (userid == "" || hasUser(dev, userid))
+		})
+		sort.SliceStable(devs, func(i, j int) bool { return devs[i].TrashAt.After(*devs[j].TrashAt) })
+		*result = devs
+		return err
+	})
+}
+
+// RestoreDevice : brings the device back from the trash
+func (ks *KVStore) RestoreDevice(mac DevMacID, ctx context.Context) httperr.HttpErr {
+	return ks.update(func(tx kvTx) error {
+		dev := Device{}
+		found, err := getDoc(tx, bktDevices, string(mac), &dev)
+		if err != nil {
+			return err
+		}
+		if !found || dev.TrashAt == nil {
+			return txAbort{httperr.ErrResourceNotFound(fmt.Errorf("device not in trash %s", mac))}
+		}
+		dev.TrashAt, dev.PurgeAt = nil, nil
+		dev.Version++
+		return putDoc(tx, bktDevices, string(mac), &dev)
+	})
+}
+
+// PurgeDevice : permanently deletes the device from the trash along with its config history and keys
+func (ks *KVStore) PurgeDevice(mac DevMacID, ctx context.Context) httperr.HttpErr {
+	return ks.update(func(tx kvTx) error {
+		dev := Device{}
+		found, err := getDoc(tx, bktDevices, string(mac), &dev)
+		if err != nil {
+			return err
+		}
+		if !found || dev.TrashAt == nil {
+			return txAbort{httperr.ErrResourceNotFound(fmt.Errorf("device not in trash %s", mac))}
+		}
+		if err := tx.Delete(bktDevices, string(mac)); err != nil {
+			return err
+		}
+		for _, bkt := range []string{bktApiKeys, bktSignKeys} {
+			if err := deleteOfDevice(tx, bkt, mac); err != nil {
+				return err
+			}
+		}
+		if err := supersedeOfDevice(tx, mac); err != nil {
+			return err
+		}
+		return deleteRevisions(tx, mac)
+	})
+}
+
+// DueForPurge : devices in the trash whose purgeat is past the given time
+func (ks *KVStore) DueForPurge(at time.Time, result *[]DevMacID, ctx context.Context) httperr.HttpErr {
+	return ks.view(func(tx kvTx) error {
+		devs, err := devicesWhere(tx, func(dev *Device) bool {
+			return dev.TrashAt != nil && dev.PurgeAt != nil && dev.PurgeAt.Before(at)
+		})
+		*result = []DevMacID{}
+		for _, dev := range devs {
+			*result = append(*result, dev.MacID)
+		}
+		return err
+	})
+}
+
+// DevicesOfUser : devices not in the trash the user can control
+func (ks *KVStore) DevicesOfUser(userid string, ctx context.Context, result *[]Device) httperr.HttpErr {
+	if userid == "" {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid user email as owner of the device %s", userid))
+	}
+	return ks.view(func(tx kvTx) error {
+		devs, err := devicesWhere(tx, func(dev *Device) bool {
+			return dev.TrashAt == nil && hasUser(dev, userid)
+		})
+		*result = devs
+		return err
+	})
+}
+
+// PatchConfg : Patches the schedule for the device, no error when the device isnt found
+func (ks *KVStore) PatchConfg(mac DevMacID, sched aquacfg.Schedule, ctx context.Context) httperr.HttpErr {
+	if !mac.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid mac id %s for the device being patched", mac))
+	}
+	if !sched.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid schedule for the device. Check schedule fields for rule violation"))
+	}
+	herr := ks.update(func(tx kvTx) error {
+		dev := Device{}
+		if err := liveDevice(tx, mac, nil, &dev); err != nil {
+			return err
+		}
+		dev.Cfg = &sched
+		dev.Version++
+		return putDoc(tx, bktDevices, string(mac), &dev)
+	})
+	if herr != nil && herr.HttpStatusCode() == 404 {
+		return nil
+	}
+	return herr
+}
+
+// AppendUsers : appends users not already on the device, or replaces the list
+// the list replaced with has to have an owner, appending cannot change the roles of those already on
+func (ks *KVStore) AppendUsers(mac DevMacID, users []Membership, replace bool, ifVersion *int64, ctx context.Context) httperr.HttpErr {
+	if !mac.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid mac id %s for the device being patched", mac))
+	}
+	if !ValidMembers(users, replace) {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid users for the device %s, roles are owner / operator / viewer and atleast one is an owner", mac))
+	}
+	return ks.update(func(tx kvTx) error {
+		dev := Device{}
+		if err := liveDevice(tx, mac, ifVersion, &dev); err != nil {
+			return err
+		}
+		if replace {
+			dev.Users = users
+		} else {
+			for _, u := range users {
+				if !hasUser(&dev, u.Email) {
+					dev.Users = append(dev.Users, u)
+				}
+			}
+		}
+		dev.Version++
+		return putDoc(tx, bktDevices, string(mac), &dev)
+	})
+}
+
+// SetEncKey : sets or clears the encryption key of the device
+func (ks *KVStore) SetEncKey(mac DevMacID, key []byte, ifVersion *int64, ctx context.Context) httperr.HttpErr {
+	if !mac.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid mac id %s for the device being patched", mac))
+	}
+	if !ValidEncKey(key) {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid encryption key for the device %s, has to be an X25519 public key of %d bytes", mac, cfgenc.KeySize))
+	}
+	return ks.update(func(tx kvTx) error {
+		dev := Device{}
+		if err := liveDevice(tx, mac, ifVersion, &dev); err != nil {
+			return err
+		}
+		dev.EncKey = key
+		dev.Version++
+		return putDoc(tx, bktDevices, string(mac), &dev)
+	})
+}
+
+// SetPushStatus : updates the status of a config push on the device and its revision
+func (ks *KVStore) SetPushStatus(mac DevMacID, msgID string, upd PushUpdate, ctx context.Context) httperr.HttpErr {
+	return ks.update(func(tx kvTx) error {
+		dev := Device{}
+		if _, err := getDoc(tx, bktDevices, string(mac), &dev); err != nil {
+			return err
+		}
+		matched := false
+		for i := range dev.Pushes {
+			if dev.Pushes[i].MsgID == msgID && (len(upd.From) == 0 || contains(upd.From, dev.Pushes[i].Status)) {
+				dev.Pushes[i].Status, dev.Pushes[i].Reason, dev.Pushes[i].UpdatedAt = upd.Status, upd.Reason, time.Now()
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return txAbort{httperr.ErrResourceNotFound(fmt.Errorf("push %s not found on device %s", msgID, mac))}
+		}
+		if err := putDoc(tx, bktDevices, string(mac), &dev); err != nil {
+			return err
+		}
+		// revision that made the push follows the delivery status, changed once out of the iteration
+		revs := map[string]CfgRevision{}
+		err := tx.ForEach(bktRevisions, func(key string, val []byte) error {
+			rev := CfgRevision{}
+			if err := bson.Unmarshal(val, &rev); err != nil {
+				return err
+			}
+			if rev.MacID == mac && rev.MsgID == msgID {
+				rev.Delivery = upd.Status
+				revs[key] = rev
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for key, rev := range revs {
+			if err := putDoc(tx, bktRevisions, key, &rev); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpirePushes : pending pushes not acknowledged since before the given time are marked expired, and so are the revisions that made them
+// returns the count of devices that had pushes expired
+func (ks *KVStore) ExpirePushes(before time.Time, ctx context.Context) (int64, error) {
+	var count int64
+	err := ks.kv.Update(func(tx kvTx) error {
+		count = 0
+		devs, err := devicesWhere(tx, func(dev *Device) bool { return true })
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		msgIDs := map[string]bool{}
+		for _, dev := range devs {
+			expired := false
+			for i, p := range dev.Pushes {
+				if p.Status == PushPending && p.UpdatedAt.Before(before) {
+					dev.Pushes[i].Status, dev.Pushes[i].UpdatedAt = PushExpired, now
+					msgIDs[p.MsgID] = true
+					expired = true
+				}
+			}
+			if expired {
+				count++
+				if err := putDoc(tx, bktDevices, string(dev.MacID), &dev); err != nil {
+					return err
+				}
+			}
+		}
+		if len(msgIDs) == 0 {
+			return nil
+		}
+		revs := map[string]CfgRevision{}
+		err = tx.ForEach(bktRevisions, func(key string, val []byte) error {
+			rev := CfgRevision{}
+			if err := bson.Unmarshal(val, &rev); err != nil {
+				return err
+			}
+			if msgIDs[rev.MsgID] {
+				rev.Delivery = PushExpired
+				revs[key] = rev
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for key, rev := range revs {
+			if err := putDoc(tx, bktRevisions, key, &rev); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Beat : records the heartbeat as the presence of the device
+func (ks *KVStore) Beat(hb Heartbeat, at time.Time, ctx context.Context) httperr.HttpErr {
+	if !hb.MacID.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid mac id %s for the heartbeat", hb.MacID))
+	}
+	return ks.update(func(tx kvTx) error {
+		dev := Device{}
+		if err := liveDevice(tx, hb.MacID, nil, &dev); err != nil {
+			return err
+		}
+		dev.Presence = &Presence{LastSeen: at, Firmware: hb.Firmware, Uptime: hb.Uptime, IP: hb.IP}
+		return putDoc(tx, bktDevices, string(hb.MacID), &dev)
+	})
+}
+
+// Report : records the config the device has applied
+func (ks *KVStore) Report(mac DevMacID, sched aquacfg.Schedule, at time.Time, ctx context.Context) httperr.HttpErr {
+	if !mac.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid mac id %s for the reported config", mac))
+	}
+	return ks.update(func(tx kvTx) error {
+		dev := Device{}
+		if err := liveDevice(tx, mac, nil, &dev); err != nil {
+			return err
+		}
+		dev.Reported, dev.RptAt = &sched, &at
+		return putDoc(tx, bktDevices, string(mac), &dev)
+	})
+}
+
+// DriftedDevices : devices not in the trash whose reported config isnt the desired one pushed before the given time
+func (ks *KVStore) DriftedDevices(before time.Time, ctx context.Context) ([]Device, error) {
+	var result []Device
+	err := ks.kv.View(func(tx kvTx) error {
+		var err error
+		result, err = devicesWhere(tx, func(dev *Device) bool {
+			return dev.TrashAt == nil && dev.Reported != nil && dev.CfgAt.Before(before) && !reflect.DeepEqual(dev.Cfg, dev.Reported)
+		})
+		return err
+	})
+	return result, err
+}
+
+// CountFleet : registered and online devices, and their pushes by status
+func (ks *KVStore) CountFleet(onlineSince time.Time, ctx context.Context) (FleetCounts, error) {
+	counts := FleetCounts{Pushes: map[string]int64{}}
+	err := ks.kv.View(func(tx kvTx) error {
+		devs, err := devicesWhere(tx, func(dev *Device) bool { return dev.TrashAt == nil })
+		for _, dev := range devs {
+			counts.Registered++
+			if dev.Presence != nil && !dev.Presence.LastSeen.Before(onlineSince) {
+				counts.Online++
+			}
+			for _, push := range dev.Pushes {
+				counts.Pushes[push.Status]++
+			}
+		}
+		return err
+	})
+	return counts, err
+}
+
+// PatchConfgOutbox : patches the config, records the revision and queues the message to push it
+func (ks *KVStore) PatchConfgOutbox(mac DevMacID, sched aquacfg.Schedule, chg CfgChange, lease time.Duration, ctx context.Context) (*OutboxMsg, httperr.HttpErr) {
+	if !sched.IsValid() {
+		return nil, httperr.ErrInvalidParam(fmt.Errorf("invalid schedule for the device. Check schedule fields for rule violation"))
+	}
+	return ks.enqueue(mac, &sched, chg, lease)
+}
+
+// RepushConfg : queues the desired config of the device again, no revision is recorded
+func (ks *KVStore) RepushConfg(mac DevMacID, lease time.Duration, ctx context.Context) (*OutboxMsg, httperr.HttpErr) {
+	return ks.enqueue(mac, nil, CfgChange{}, lease)
+}
+
+// enqueue : sets the config on the device (nil to push the current one) and queues the outbox message, in one transaction
+func (ks *KVStore) enqueue(mac DevMacID, sched *aquacfg.Schedule, chg CfgChange, lease time.Duration) (*OutboxMsg, httperr.HttpErr) {
+	if !mac.IsValid() {
+		return nil, httperr.ErrInvalidParam(fmt.Errorf("invalid mac id %s for the device being patched", mac))
+	}
+	now := time.Now()
+	msg := &OutboxMsg{
+		ID:            primitive.NewObjectID(),
+		MacID:         mac,
+		Status:        OutboxPending,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+		LockedUntil:   now.Add(lease),
+		ReqID:         chg.ReqID,
+		Trace:         chg.Trace,
+	}
+	herr := ks.update(func(tx kvTx) error {
+		dev := Device{}
+		if err := liveDevice(tx, mac, chg.IfVersion, &dev); err != nil {
+			return err
+		}
+		if dev.Cfg == nil && sched == nil {
+			return fmt.Errorf("device %s has no config to push", mac)
+		}
+		old := dev.Cfg
+		dev.CfgAt = now
+		dev.Pushes = append(dev.Pushes, ConfigPush{MsgID: msg.ID.Hex(), Status: PushPending, IssuedAt: now, UpdatedAt: now})
+		if len(dev.Pushes) > MaxPushes {
+			dev.Pushes = dev.Pushes[len(dev.Pushes)-MaxPushes:]
+		}
+		if sched != nil {
+			msg.Cfg = *sched
+			dev.Cfg = sched
+			dev.CfgRev++
+			dev.Version++
+			rev := &CfgRevision{
+				ID:         primitive.NewObjectID(),
+				MacID:      mac,
+				Rev:        dev.CfgRev,
+				By:         chg.By,
+				At:         now,
+				Old:        old,
+				New:        *sched,
+				MsgID:      msg.ID.Hex(),
+				Delivery:   PushPending,
+				RollbackOf: chg.RollbackOf,
+			}
+			if err := putDoc(tx, bktRevisions, revKey(mac, rev.Rev), rev); err != nil {
+				return err
+			}
+		} else {
+			msg.Cfg = *old
+		}
+		msg.EncKey = dev.EncKey
+		if err := putDoc(tx, bktDevices, string(mac), &dev); err != nil {
+			return err
+		}
+		if err := supersedeOfDevice(tx, mac); err != nil {
+			return err
+		}
+		return putDoc(tx, bktOutbox, msg.ID.Hex(), msg)
+	})
+	if herr != nil {
+		return nil, herr
+	}
+	return msg, nil
+}
+
+// ClaimOutbox : claims upto limit pending messages that are due and not leased, oldest first
+func (ks *KVStore) ClaimOutbox(lease time.Duration, limit int, ctx context.Context) ([]OutboxMsg, error) {
+	result := []OutboxMsg{}
+	err := ks.kv.Update(func(tx kvTx) error {
+		now := time.Now()
+		due := []OutboxMsg{}
+		err := tx.ForEach(bktOutbox, func(key string, val []byte) error {
+			m := OutboxMsg{}
+			if err := bson.Unmarshal(val, &m); err != nil {
+				return err
+			}
+			if m.Status == OutboxPending && !m.NextAttemptAt.After(now) && !m.LockedUntil.After(now) {
+				due = append(due, m)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.SliceStable(due, func(i, j int) bool { return due[i].CreatedAt.Before(due[j].CreatedAt) })
+		result = []OutboxMsg{}
+		for _, m := range due {
+			if len(result) >= limit {
+				break
+			}
+			m.LockedUntil = now.Add(lease)
+			if err := putDoc(tx, bktOutbox, m.ID.Hex(), &m); err != nil {
+				return err
+			}
+			result = append(result, m)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// updateMsg : changes the outbox message of id, if its there
+func (ks *KVStore) updateMsg(id primitive.ObjectID, fn func(m *OutboxMsg)) error {
+	return ks.kv.Update(func(tx kvTx) error {
+		m := OutboxMsg{}
+		found, err := getDoc(tx, bktOutbox, id.Hex(), &m)
+		if err != nil || !found {
+			return err
+		}
+		fn(&m)
+		return putDoc(tx, bktOutbox, id.Hex(), &m)
+	})
+}
+
+// MarkDelivered : message was published and confirmed, a message superseded meanwhile is left as is
+func (ks *KVStore) MarkDelivered(id primitive.ObjectID, ctx context.Context) error {
+	return ks.updateMsg(id, func(m *OutboxMsg) {
+		if m.Status != OutboxPending {
+			return
+		}
+		now := time.Now()
+		m.Status, m.DeliveredAt, m.LockedUntil = OutboxDelivered, &now, time.Time{}
+	})
+}
+
+// MarkFailed : records the failed attempt and releases the lease, relay tries again at retryAt
+func (ks *KVStore) MarkFailed(id primitive.ObjectID, cause error, retryAt time.Time, ctx context.Context) error {
+	return ks.updateMsg(id, func(m *OutboxMsg) {
+		m.Attempts++
+		m.LastErr, m.NextAttemptAt, m.LockedUntil = cause.Error(), retryAt, time.Time{}
+	})
+}
+
+// GiveUp : message is failed for good, a message superseded meanwhile is left as is
+func (ks *KVStore) GiveUp(id primitive.ObjectID, cause error, ctx context.Context) error {
+	return ks.updateMsg(id, func(m *OutboxMsg) {
+		if m.Status != OutboxPending {
+			return
+		}
+		m.Attempts++
+		m.Status, m.LastErr, m.LockedUntil = OutboxFailed, cause.Error(), time.Time{}
+	})
+}
+
+// Revisions : all the revisions of the device config, latest first
+func (ks *KVStore) Revisions(mac DevMacID, result *[]CfgRevision, ctx context.Context) httperr.HttpErr {
+	if !mac.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid mac id %s for revisions", mac))
+	}
+	*result = []CfgRevision{}
+	return ks.view(func(tx kvTx) error {
+		err := tx.ForEach(bktRevisions, func(key string, val []byte) error {
+			rev := CfgRevision{}
+			if err := bson.Unmarshal(val, &rev); err != nil {
+				return err
+			}
+			if rev.MacID == mac {
+				*result = append(*result, rev)
+			}
+			return nil
+		})
+		sort.SliceStable(*result, func(i, j int) bool { return (*result)[i].Rev > (*result)[j].Rev })
+		return err
+	})
+}
+
+// RevisionOf : single revision of the device config, errors when not found
+func (ks *KVStore) RevisionOf(mac DevMacID, rev int, result *CfgRevision, ctx context.Context) httperr.HttpErr {
+	*result = CfgRevision{}
+	return ks.view(func(tx kvTx) error {
+		found, err := getDoc(tx, bktRevisions, revKey(mac, rev), result)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return txAbort{httperr.ErrResourceNotFound(fmt.Errorf("revision %d not found for device %s", rev, mac))}
+		}
+		return nil
+	})
+}
+
+// AddKey : adds the api key, duplicate id is rejected
+func (ks *KVStore) AddKey(key *ApiKey, ctx context.Context) httperr.HttpErr {
+	if key == nil || !key.MacID.IsValid() || key.ID == "" || key.Hash == "" {
+		return httperr.ErrInvalidParam(fmt.Errorf("one or more fields on the api key is invalid"))
+	}
+	return ks.update(func(tx kvTx) error {
+		existing, err := tx.Get(bktApiKeys, key.ID)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return txAbort{httperr.DuplicateResourceErr(fmt.Errorf("api key %s already exists", key.ID))}
+		}
+		return putDoc(tx, bktApiKeys, key.ID, key)
+	})
+}
+
+// KeysOf : keys of the device, revoked ones included, oldest first
+func (ks *KVStore) KeysOf(mac DevMacID, result *[]ApiKey, ctx context.Context) httperr.HttpErr {
+	if !mac.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid mac id %s for api keys", mac))
+	}
+	return ks.view(func(tx kvTx) error {
+		keys, err := keysWhere(tx, func(key *ApiKey) bool { return key.MacID == mac })
+		*result = keys
+		return err
+	})
+}
+
+// KeyOf : single key by its id, errors when not found
+func (ks *KVStore) KeyOf(id string, result *ApiKey, ctx context.Context) httperr.HttpErr {
+	*result = ApiKey{}
+	return ks.view(func(tx kvTx) error {
+		found, err := getDoc(tx, bktApiKeys, id, result)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return txAbort{httperr.ErrResourceNotFound(fmt.Errorf("api key %s not found", id))}
+		}
+		return nil
+	})
+}
+
+// activeKey : changes the key of id, only while its of the device and not revoked
+func (ks *KVStore) activeKey(mac DevMacID, id string, fn func(key *ApiKey)) httperr.HttpErr {
+	return ks.update(func(tx kvTx) error {
+		key := ApiKey{}
+		found, err := getDoc(tx, bktApiKeys, id, &key)
+		if err != nil {
+			return err
+		}
+		if !found || key.MacID != mac || key.RevokedAt != nil {
+			return txAbort{httperr.ErrResourceNotFound(fmt.Errorf("active api key %s not found for device %s", id, mac))}
+		}
+		fn(&key)
+		return putDoc(tx, bktApiKeys, id, &key)
+	})
+}
+
+func (ks *KVStore) RotateKey(mac DevMacID, id, hash string, at time.Time, ctx context.Context) httperr.HttpErr {
+	return ks.activeKey(mac, id, func(key *ApiKey) {
+		key.Hash, key.RotatedAt = hash, &at
+	})
+}
+
+func (ks *KVStore) RevokeKey(mac DevMacID, id string, at time.Time, ctx context.Context) httperr.HttpErr {
+	return ks.activeKey(mac, id, func(key *ApiKey) {
+		key.RevokedAt = &at
+	})
+}
+
+func (ks *KVStore) TouchKey(id string, at time.Time, ctx context.Context) error {
+	return ks.kv.Update(func(tx kvTx) error {
+		key := ApiKey{}
+		found, err := getDoc(tx, bktApiKeys, id, &key)
+		if err != nil || !found {
+			return err
+		}
+		key.LastUsedAt = &at
+		return putDoc(tx, bktApiKeys, id, &key)
+	})
+}
+
+// signingKeysWhere : all the signing keys that match, latest first
+func signingKeysWhere(tx kvTx, match func(key *SigningKey) bool) ([]SigningKey, error) {
+	result := []SigningKey{}
+	err := tx.ForEach(bktSignKeys, func(id string, val []byte) error {
+		key := SigningKey{}
+		if err := bson.Unmarshal(val, &key); err != nil {
+			return err
+		}
+		if match(&key) {
+			result = append(result, key)
+		}
+		return nil
+	})
+	sort.SliceStable(result, func(i, j int) bool { return result[i].CreatedAt.After(result[j].CreatedAt) })
+	return result, err
+}
+
+// AddSigningKey : key becomes the active one of the device, the one active till now is retired
+// only for a device that is registered and not in the trash
+func (ks *KVStore) AddSigningKey(key *SigningKey, ctx context.Context) httperr.HttpErr {
+	if key == nil || !key.MacID.IsValid() || key.ID == "" || len(key.Secret) == 0 {
+		return httperr.ErrInvalidParam(fmt.Errorf("one or more fields on the signing key is invalid"))
+	}
+	return ks.update(func(tx kvTx) error {
+		if err := liveDevice(tx, key.MacID, nil, &Device{}); err != nil {
+			return err
+		}
+		existing, err := tx.Get(bktSignKeys, key.ID)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return txAbort{httperr.DuplicateResourceErr(fmt.Errorf("signing key %s already exists", key.ID))}
+		}
+		// writes are one transaction at a time, the device is left with only the new key active
+		keys, err := signingKeysWhere(tx, func(k *SigningKey) bool { return k.MacID == key.MacID })
+		if err != nil {
+			return err
+		}
+		var latest *SigningKey
+		if len(keys) > 0 {
+			latest = &keys[0]
+		}
+		key.CreatedAt = createdAfter(key.CreatedAt, latest)
+		for _, k := range keys {
+			if k.RetiredAt != nil {
+				continue
+			}
+			k.RetiredAt = &key.CreatedAt
+			if err := putDoc(tx, bktSignKeys, k.ID, &k); err != nil {
+				return err
+			}
+		}
+		return putDoc(tx, bktSignKeys, key.ID, key)
+	})
+}
+
+// SigningKeysOf : keys of the device, retired ones included, latest first
+func (ks *KVStore) SigningKeysOf(mac DevMacID, result *[]SigningKey, ctx context.Context) httperr.HttpErr {
+	if !mac.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid mac id %s for signing keys", mac))
+	}
+	return ks.view(func(tx kvTx) error {
+		keys, err := signingKeysWhere(tx, func(key *SigningKey) bool { return key.MacID == mac })
+		*result = keys
+		return err
+	})
+}
+
+// ActiveSigningKey : errors with 404 when the device has no active key
+func (ks *KVStore) ActiveSigningKey(mac DevMacID, result *SigningKey, ctx context.Context) httperr.HttpErr {
+	*result = SigningKey{}
+	return ks.view(func(tx kvTx) error {
+		keys, err := signingKeysWhere(tx, func(key *SigningKey) bool { return key.MacID == mac && key.RetiredAt == nil })
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return txAbort{httperr.ErrResourceNotFound(fmt.Errorf("no active signing key for device %s", mac))}
+		}
+		*result = keys[0]
+		return nil
+	})
+}
+
+func (ks *KVStore) RetireSigningKey(mac DevMacID, id string, at time.Time, ctx context.Context) httperr.HttpErr {
+	return ks.update(func(tx kvTx) error {
+		key := SigningKey{}
+		found, err := getDoc(tx, bktSignKeys, id, &key)
+		if err != nil {
+			return err
+		}
+		if !found || key.MacID != mac || key.RetiredAt != nil {
+			return txAbort{httperr.ErrResourceNotFound(fmt.Errorf("active signing key %s not found for device %s", id, mac))}
+		}
+		key.RetiredAt = &at
+		return putDoc(tx, bktSignKeys, id, &key)
+	})
+}
+
+// sweep : what mongo would expire with its ttl indexes - messages delivered a week ago
+// trashed devices are purged by the Purger, with their revisions and keys
+func (ks *KVStore) sweep(now time.Time) error {
+	return ks.kv.Update(func(tx kvTx) error {
+		stale := []string{}
+		err := tx.ForEach(bktOutbox, func(key string, val []byte) error {
+			m := OutboxMsg{}
+			if err := bson.Unmarshal(val, &m); err != nil {
+				return err
+			}
+			if m.DeliveredAt != nil && m.DeliveredAt.Before(now.Add(-7*24*time.Hour)) {
+				stale = append(stale, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range stale {
+			if err := tx.Delete(bktOutbox, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (ks *KVStore) run() {
+	defer close(ks.done)
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ks.stop:
+			return
+		case now := <-tick.C:
+			if err := ks.sweep(now); err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("failed to sweep expired documents")
+			}
+		}
+	}
+}
+
+// Close : stops sweeping and closes the backend
+func (ks *KVStore) Close() error {
+	ks.closeOnce.Do(func() { close(ks.stop) })
+	<-ks.done
+	return ks.kv.Close()
+}
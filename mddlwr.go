@@ -1,21 +1,22 @@
 package main
 
 import (
-	"context"
-	"fmt"
+	"crypto/rand"
+	"encoding/hex"
 	"net/http"
-	"os"
+	"regexp"
 	"time"
 
-	"github.com/eensymachines-in/errx/httperr"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
+// RequestIDHeader : header the request id is read from and sent back on
+const RequestIDHeader = "X-Request-ID"
+
+// reqIDPattern : ids accepted from the callers, anything else is replaced so the logs arent polluted
+var reqIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
 // CORS : this allows all cross origin requests
 func CORS(c *gin.Context) {
 	// First, we add the headers with need to enable CORS
@@ -36,91 +37,54 @@ func CORS(c *gin.Context) {
 	}
 }
 
-func RabbitConnectWithChn(connString, xname string) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		conn, err := amqp.Dial(connString)
-		if err != nil {
-			httperr.HttpErrOrOkDispatch(c, httperr.ErrGatewayConnect(err), log.WithFields(log.Fields{
-				"stack":       "RabbitConnectWithChn",
-				"conn_string": connString,
-			}))
-			return
-		}
-		// defer conn.Close()
-		ch, err := conn.Channel()
-		if err != nil {
-			httperr.HttpErrOrOkDispatch(c, httperr.ErrGatewayConnect(err), log.WithFields(log.Fields{
-				"stack":  "RabbitConnectWithChn",
-				"login":  os.Getenv("AMQP_LOGIN"),
-				"server": os.Getenv("AMQP_SERVER"),
-			}))
-			conn.Close() // incase no channel, we close the channel before we exit the stack
-			return
-		}
-		// NOTE: we shall be using a direct exchange with mac id specific routing key
-		err = ch.ExchangeDeclare(
-			xname,    // name
-			"direct", // exhange type
-			true,     // durable
-			false,    //auto deleted
-			false,    //internal
-			false,    // nowait
-			nil,      //amqp.table
-		)
-		if err != nil {
-			httperr.HttpErrOrOkDispatch(c, httperr.ErrGatewayConnect(err), log.WithFields(log.Fields{
-				"stack":  "RabbitConnectWithChn",
-				"login":  os.Getenv("AMQP_LOGIN"),
-				"server": os.Getenv("AMQP_SERVER"),
-			}))
-			// incase declaring the exchange fails we close the channel and connection on our way out
-			ch.Close()
-			conn.Close()
-			return
-		}
-		c.Set("amqp-ch", ch)
-		c.Set("amqp-conn", conn)
-		c.Next()
-	}
+// ExposeHeaders : response headers the front end can read cross origin, on top of utilities.CORS
+// ETag is read for If-Match / If-None-Match, X-Request-ID to quote when reporting a problem
+func ExposeHeaders(c *gin.Context) {
+	c.Header("Access-Control-Expose-Headers", "ETag, "+RequestIDHeader)
+	c.Next()
 }
 
-func MongoConnectURI(uri, dbname string) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-		client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
-		if err != nil || client == nil {
-			httperr.HttpErrOrOkDispatch(c, httperr.ErrGatewayConnect(err), log.WithFields(log.Fields{
-				"stack": "MongoConnect",
-				"uri":   uri,
-			}))
-			return
-		}
-		c.Set("mongo-client", client)
-		c.Set("mongo-database", client.Database(dbname))
+// RequestID : id of the request as sent by the caller in X-Request-ID, generated when not
+// sent back on the response, carried on the log entries of the request and on the config pushes it makes
+func RequestID(c *gin.Context) {
+	id := c.GetHeader(RequestIDHeader)
+	if !reqIDPattern.MatchString(id) {
+		byt := make([]byte, 16)
+		rand.Read(byt)
+		id = hex.EncodeToString(byt)
 	}
+	c.Set("reqid", id)
+	c.Header(RequestIDHeader, id)
+	c.Next()
+}
+
+// requestID : id of the request as set by RequestID, empty when the middleware isnt in the chain
+func requestID(c *gin.Context) string {
+	return c.GetString("reqid")
 }
-/* NOTE: Archived was when we werent using i */
-func MongoConnect(server, user, passwd, dbname string) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-		client, err := mongo.Connect(ctx, options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%s@%s:27017", user, passwd, server)))
-		if err != nil {
-			httperr.HttpErrOrOkDispatch(c, httperr.ErrGatewayConnect(err), log.WithFields(log.Fields{
-				"stack":  "MongoConnect",
-				"login":  user,
-				"server": server,
-			}))
-			return
-		}
-		if client.Ping(ctx, readpref.Primary()) != nil {
-			httperr.HttpErrOrOkDispatch(c, httperr.ErrGatewayConnect(err), log.WithFields(log.Fields{
-				"stack":  "MongoConnect",
-				"login":  user,
-				"server": server,
-			}))
-			return
-		}
-		c.Set("mongo-client", client)
-		c.Set("mongo-database", client.Database(dbname))
+
+// reqLog : log entry with the id of the request, handlers log with this instead of the bare logger
+func reqLog(c *gin.Context) *log.Entry {
+	return log.WithField("reqid", requestID(c))
+}
+
+// AccessLog : one entry per request with its id, in place of gin's own logger
+func AccessLog(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	entry := reqLog(c).WithFields(log.Fields{
+		"method":  c.Request.Method,
+		"path":    c.Request.URL.Path,
+		"status":  c.Writer.Status(),
+		"latency": time.Since(start),
+		"client":  c.ClientIP(),
+	})
+	if len(c.Errors) > 0 {
+		entry = entry.WithField("errs", c.Errors.String())
+	}
+	if c.Writer.Status() >= http.StatusInternalServerError {
+		entry.Warn("request")
+	} else {
+		entry.Info("request")
 	}
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var errReadOnlyTx = errors.New("write in a read only transaction")
+
+// NewMemStore : store held in memory, nothing survives a restart
+// for tests and running the api offline without a database
+func NewMemStore() *KVStore {
+	return NewKVStore(&memKV{buckets: map[string]map[string][]byte{}})
+}
+
+// memKV : buckets as maps, writers hold the lock for the whole transaction
+type memKV struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+// memTx : writes of the transaction are kept aside till its done, nil value is a deleted key
+type memTx struct {
+	kv     *memKV
+	writes map[string]map[string][]byte
+}
+
+func (kv *memKV) View(fn func(tx kvTx) error) error {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	return fn(&memTx{kv: kv})
+}
+
+func (kv *memKV) Update(fn func(tx kvTx) error) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	tx := &memTx{kv: kv, writes: map[string]map[string][]byte{}}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for bucket, writes := range tx.writes {
+		if kv.buckets[bucket] == nil {
+			kv.buckets[bucket] = map[string][]byte{}
+		}
+		for key, val := range writes {
+			if val == nil {
+				delete(kv.buckets[bucket], key)
+			} else {
+				kv.buckets[bucket][key] = val
+			}
+		}
+	}
+	return nil
+}
+
+func (kv *memKV) Close() error {
+	return nil
+}
+
+func (tx *memTx) Get(bucket, key string) ([]byte, error) {
+	if val, ok := tx.writes[bucket][key]; ok {
+		return val, nil
+	}
+	return tx.kv.buckets[bucket][key], nil
+}
+
+func (tx *memTx) put(bucket, key string, val []byte) error {
+	if tx.writes == nil {
+		return errReadOnlyTx
+	}
+	if tx.writes[bucket] == nil {
+		tx.writes[bucket] = map[string][]byte{}
+	}
+	tx.writes[bucket][key] = val
+	return nil
+}
+
+func (tx *memTx) Put(bucket, key string, val []byte) error {
+	return tx.put(bucket, key, append([]byte{}, val...))
+}
+
+func (tx *memTx) Delete(bucket, key string) error {
+	return tx.put(bucket, key, nil)
+}
+
+func (tx *memTx) ForEach(bucket string, fn func(key string, val []byte) error) error {
+	keys := []string{}
+	for key := range tx.kv.buckets[bucket] {
+		if _, ok := tx.writes[bucket][key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	for key, val := range tx.writes[bucket] {
+		if val != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		val, _ := tx.Get(bucket, key)
+		if err := fn(key, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"github.com/eensymachines-in/patio/aquacfg"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Metrics shared across the process, registered on the registry of each app
+// devices and pushes are counted off the store at the time of scraping
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "devicereg_http_requests_total",
+		Help: "Requests handled, by route and status",
+	}, []string{"method", "route", "status"})
+	httpLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "devicereg_http_request_duration_seconds",
+		Help:    "Time taken to handle the requests, by route",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+	storeLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "devicereg_store_op_duration_seconds",
+		Help:    "Time taken by the store operations, by store, method and outcome",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"store", "method", "outcome"})
+	amqpPublishes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "devicereg_amqp_publishes_total",
+		Help: "Config pushes published, by the broker's confirmation - ack, nack, timeout, unroutable, broker_down, error",
+	}, []string{"outcome"})
+	amqpConfirmWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "devicereg_amqp_publish_duration_seconds",
+		Help:    "Time from publishing a config push till the broker confirms it or the wait is given up",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2, 4, 8, 16},
+	})
+)
+
+// publishOutcome : label for the outcome of a publish
+func publishOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "ack"
+	case errors.Is(err, ErrPublishNack):
+		return "nack"
+	case errors.Is(err, ErrConfirmTimeout):
+		return "timeout"
+	case errors.Is(err, ErrUnroutable):
+		return "unroutable"
+	case errors.Is(err, ErrBrokerDown):
+		return "broker_down"
+	default:
+		return "error"
+	}
+}
+
+// NewMetrics : registry with the process wide metrics and the fleet counts off the store
+// onlineWithin is how recent a heartbeat has to be for a device to count as online
+func NewMetrics(fleet FleetCounter, onlineWithin time.Duration) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpLatency, storeLatency, amqpPublishes, amqpConfirmWait,
+	)
+	if fleet != nil {
+		reg.MustRegister(&fleetCollector{fleet: fleet, onlineWithin: onlineWithin})
+	}
+	return reg
+}
+
+var (
+	descRegistered = prometheus.NewDesc("devicereg_devices_registered", "Devices registered, not in the trash", nil, nil)
+	descOnline     = prometheus.NewDesc("devicereg_devices_online", "Registered devices with a heartbeat within the online threshold", nil, nil)
+	descPushes     = prometheus.NewDesc("devicereg_pushes", "Latest config pushes on the devices by status, pending and undelivered are the ones not acknowledged yet", []string{"status"}, nil)
+)
+
+// fleetCollector : counts the devices off the store on each scrape
+type fleetCollector struct {
+	fleet        FleetCounter
+	onlineWithin time.Duration
+}
+
+func (fc *fleetCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descRegistered
+	ch <- descOnline
+	ch <- descPushes
+}
+
+func (fc *fleetCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	counts, err := fc.fleet.CountFleet(time.Now().Add(-fc.onlineWithin), ctx)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("failed to count devices for the metrics")
+		ch <- prometheus.NewInvalidMetric(descRegistered, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(descRegistered, prometheus.GaugeValue, float64(counts.Registered))
+	ch <- prometheus.MustNewConstMetric(descOnline, prometheus.GaugeValue, float64(counts.Online))
+	for _, status := range []string{PushUndelivered, PushPending, PushAcked, PushNacked, PushExpired} {
+		ch <- prometheus.MustNewConstMetric(descPushes, prometheus.GaugeValue, float64(counts.Pushes[status]), status)
+	}
+}
+
+// Metered : counts and times the requests by route, unmatched routes are counted together
+func Metered(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+	httpLatency.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+}
+
+// HndlMetrics : metrics of the app in the prometheus exposition format
+func (app *App) HndlMetrics(c *gin.Context) {
+	promhttp.HandlerFor(app.Metrics, promhttp.HandlerOpts{}).ServeHTTP(c.Writer, c.Request)
+}
+
+// observedDevices : times and traces each operation on the device store
+type observedDevices struct {
+	QueryDevices
+}
+
+// observe : starts the span and the clock for an operation on the store
+// end is called with the error of the operation and its http status, 0 when it isnt an HttpErr
+func observe(ctx context.Context, store, method string) (context.Context, func(err error, status int)) {
+	start := time.Now()
+	ctx, span := tracer().Start(ctx, store+"."+method, trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, func(err error, status int) {
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+			if status != 0 {
+				span.SetStatus(codes.Error, http.StatusText(status))
+				span.SetAttributes(attribute.Int("error.status_code", status))
+			} else {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+		}
+		span.End()
+		storeLatency.WithLabelValues(store, method, outcome).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeStore : observe for the operations that error with an HttpErr, done records the error and hands it back
+func observeStore(ctx context.Context, store, method string) (context.Context, func(httperr.HttpErr) httperr.HttpErr) {
+	ctx, end := observe(ctx, store, method)
+	return ctx, func(err httperr.HttpErr) httperr.HttpErr {
+		if err != nil {
+			end(fmt.Errorf("%s failed with %d", method, err.HttpStatusCode()), err.HttpStatusCode())
+		} else {
+			end(nil, 0)
+		}
+		return err
+	}
+}
+
+// observeErr : observe for the operations that error with a plain error
+func observeErr(ctx context.Context, store, method string) (context.Context, func(error) error) {
+	ctx, end := observe(ctx, store, method)
+	return ctx, func(err error) error {
+		end(err, 0)
+		return err
+	}
+}
+
+func (md observedDevices) GetOfId(mac DevMacID, result *Device, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "QueryDevices", "GetOfId")
+	return done(md.QueryDevices.GetOfId(mac, result, ctx))
+}
+
+func (md observedDevices) AddNewDevice(dev *Device, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "QueryDevices", "AddNewDevice")
+	return done(md.QueryDevices.AddNewDevice(dev, ctx))
+}
+
+func (md observedDevices) DeleteDevice(mac string, ifVersion *int64, retain time.Duration, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "QueryDevices", "DeleteDevice")
+	return done(md.QueryDevices.DeleteDevice(mac, ifVersion, retain, ctx))
+}
+
+func (md observedDevices) TrashedDevices(userid string, result *[]Device, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "QueryDevices", "TrashedDevices")
+	return done(md.QueryDevices.TrashedDevices(userid, result, ctx))
+}
+
+func (md observedDevices) RestoreDevice(mac DevMacID, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "QueryDevices", "RestoreDevice")
+	return done(md.QueryDevices.RestoreDevice(mac, ctx))
+}
+
+func (md observedDevices) PurgeDevice(mac DevMacID, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "QueryDevices", "PurgeDevice")
+	return done(md.QueryDevices.PurgeDevice(mac, ctx))
+}
+
+func (md observedDevices) DueForPurge(at time.Time, result *[]DevMacID, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "QueryDevices", "DueForPurge")
+	return done(md.QueryDevices.DueForPurge(at, result, ctx))
+}
+
+func (md observedDevices) DevicesOfUser(userid string, ctx context.Context, result *[]Device) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "QueryDevices", "DevicesOfUser")
+	return done(md.QueryDevices.DevicesOfUser(userid, ctx, result))
+}
+
+func (md observedDevices) PatchConfg(mac DevMacID, sched aquacfg.Schedule, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "QueryDevices", "PatchConfg")
+	return done(md.QueryDevices.PatchConfg(mac, sched, ctx))
+}
+
+func (md observedDevices) AppendUsers(mac DevMacID, users []Membership, replace bool, ifVersion *int64, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "QueryDevices", "AppendUsers")
+	return done(md.QueryDevices.AppendUsers(mac, users, replace, ifVersion, ctx))
+}
+
+func (md observedDevices) SetEncKey(mac DevMacID, key []byte, ifVersion *int64, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "QueryDevices", "SetEncKey")
+	return done(md.QueryDevices.SetEncKey(mac, key, ifVersion, ctx))
+}
+
+// observedOutbox : times and traces each operation on the outbox
+type observedOutbox struct {
+	ConfigOutbox
+}
+
+func (mo observedOutbox) PatchConfgOutbox(mac DevMacID, sched aquacfg.Schedule, chg CfgChange, lease time.Duration, ctx context.Context) (*OutboxMsg, httperr.HttpErr) {
+	ctx, done := observeStore(ctx, "ConfigOutbox", "PatchConfgOutbox")
+	msg, err := mo.ConfigOutbox.PatchConfgOutbox(mac, sched, chg, lease, ctx)
+	return msg, done(err)
+}
+
+func (mo observedOutbox) RepushConfg(mac DevMacID, lease time.Duration, ctx context.Context) (*OutboxMsg, httperr.HttpErr) {
+	ctx, done := observeStore(ctx, "ConfigOutbox", "RepushConfg")
+	msg, err := mo.ConfigOutbox.RepushConfg(mac, lease, ctx)
+	return msg, done(err)
+}
+
+func (mo observedOutbox) ClaimOutbox(lease time.Duration, limit int, ctx context.Context) ([]OutboxMsg, error) {
+	ctx, done := observeErr(ctx, "ConfigOutbox", "ClaimOutbox")
+	msgs, err := mo.ConfigOutbox.ClaimOutbox(lease, limit, ctx)
+	return msgs, done(err)
+}
+
+func (mo observedOutbox) MarkDelivered(id primitive.ObjectID, ctx context.Context) error {
+	ctx, done := observeErr(ctx, "ConfigOutbox", "MarkDelivered")
+	return done(mo.ConfigOutbox.MarkDelivered(id, ctx))
+}
+
+func (mo observedOutbox) MarkFailed(id primitive.ObjectID, cause error, retryAt time.Time, ctx context.Context) error {
+	ctx, done := observeErr(ctx, "ConfigOutbox", "MarkFailed")
+	return done(mo.ConfigOutbox.MarkFailed(id, cause, retryAt, ctx))
+}
+
+func (mo observedOutbox) GiveUp(id primitive.ObjectID, cause error, ctx context.Context) error {
+	ctx, done := observeErr(ctx, "ConfigOutbox", "GiveUp")
+	return done(mo.ConfigOutbox.GiveUp(id, cause, ctx))
+}
+
+// observedPushes : times and traces each update of the push status
+type observedPushes struct {
+	PushTracker
+}
+
+func (mp observedPushes) SetPushStatus(mac DevMacID, msgID string, upd PushUpdate, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "PushTracker", "SetPushStatus")
+	return done(mp.PushTracker.SetPushStatus(mac, msgID, upd, ctx))
+}
+
+func (mp observedPushes) ExpirePushes(before time.Time, ctx context.Context) (int64, error) {
+	ctx, done := observeErr(ctx, "PushTracker", "ExpirePushes")
+	n, err := mp.PushTracker.ExpirePushes(before, ctx)
+	return n, done(err)
+}
+
+// observedRevisions : times and traces each read of the config history
+type observedRevisions struct {
+	RevisionStore
+}
+
+func (mr observedRevisions) Revisions(mac DevMacID, result *[]CfgRevision, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "RevisionStore", "Revisions")
+	return done(mr.RevisionStore.Revisions(mac, result, ctx))
+}
+
+func (mr observedRevisions) RevisionOf(mac DevMacID, rev int, result *CfgRevision, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "RevisionStore", "RevisionOf")
+	return done(mr.RevisionStore.RevisionOf(mac, rev, result, ctx))
+}
+
+// observedKeys : times and traces each operation on the api keys, lookups are on every call made with a key
+type observedKeys struct {
+	ApiKeyStore
+}
+
+func (mk observedKeys) AddKey(key *ApiKey, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "ApiKeyStore", "AddKey")
+	return done(mk.ApiKeyStore.AddKey(key, ctx))
+}
+
+func (mk observedKeys) KeysOf(mac DevMacID, result *[]ApiKey, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "ApiKeyStore", "KeysOf")
+	return done(mk.ApiKeyStore.KeysOf(mac, result, ctx))
+}
+
+func (mk observedKeys) KeyOf(id string, result *ApiKey, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "ApiKeyStore", "KeyOf")
+	return done(mk.ApiKeyStore.KeyOf(id, result, ctx))
+}
+
+func (mk observedKeys) RotateKey(mac DevMacID, id, hash string, at time.Time, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "ApiKeyStore", "RotateKey")
+	return done(mk.ApiKeyStore.RotateKey(mac, id, hash, at, ctx))
+}
+
+func (mk observedKeys) RevokeKey(mac DevMacID, id string, at time.Time, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "ApiKeyStore", "RevokeKey")
+	return done(mk.ApiKeyStore.RevokeKey(mac, id, at, ctx))
+}
+
+func (mk observedKeys) TouchKey(id string, at time.Time, ctx context.Context) error {
+	ctx, done := observeErr(ctx, "ApiKeyStore", "TouchKey")
+	return done(mk.ApiKeyStore.TouchKey(id, at, ctx))
+}
+
+// observedSigning : times and traces each operation on the signing keys, the active key is read on every push
+type observedSigning struct {
+	SigningKeyStore
+}
+
+func (ms observedSigning) AddSigningKey(key *SigningKey, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "SigningKeyStore", "AddSigningKey")
+	return done(ms.SigningKeyStore.AddSigningKey(key, ctx))
+}
+
+func (ms observedSigning) SigningKeysOf(mac DevMacID, result *[]SigningKey, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "SigningKeyStore", "SigningKeysOf")
+	return done(ms.SigningKeyStore.SigningKeysOf(mac, result, ctx))
+}
+
+func (ms observedSigning) ActiveSigningKey(mac DevMacID, result *SigningKey, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "SigningKeyStore", "ActiveSigningKey")
+	return done(ms.SigningKeyStore.ActiveSigningKey(mac, result, ctx))
+}
+
+func (ms observedSigning) RetireSigningKey(mac DevMacID, id string, at time.Time, ctx context.Context) httperr.HttpErr {
+	ctx, done := observeStore(ctx, "SigningKeyStore", "RetireSigningKey")
+	return done(ms.SigningKeyStore.RetireSigningKey(mac, id, at, ctx))
+}
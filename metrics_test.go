@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMetrics(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, test200MacID)
+	ts.pub.failNext(ErrPublishNack)
+	newCfg := gin.H{"tickat": "05:00", "config": 1, "interval": 60, "pulsegap": 1800}
+	if rec := ts.do("PATCH", "/api/devices/"+string(test200MacID)+"?path=config&action=replace", newCfg); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202 for the nacked push, got %d %s", rec.Code, rec.Body)
+	}
+
+	rec := ts.do("GET", "/metrics", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for metrics, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"devicereg_devices_registered 1",
+		"devicereg_devices_online 0",
+		`devicereg_pushes{status="undelivered"} 1`,
+		`devicereg_amqp_publishes_total{outcome="nack"}`,
+		`devicereg_http_requests_total{method="POST",route="/api/devices",status="200"}`,
+		`devicereg_http_request_duration_seconds_count{method="PATCH",route="/api/devices/:deviceid"}`,
+		`devicereg_store_op_duration_seconds_count{method="AddNewDevice",outcome="ok",store="QueryDevices"}`,
+		`devicereg_store_op_duration_seconds_count{method="PatchConfgOutbox",outcome="ok",store="ConfigOutbox"}`,
+		`devicereg_store_op_duration_seconds_count{method="MarkFailed",outcome="ok",store="ConfigOutbox"}`,
+		`devicereg_store_op_duration_seconds_count{method="ActiveSigningKey",outcome="error",store="SigningKeyStore"}`,
+		`devicereg_store_op_duration_seconds_count{method="SetPushStatus",outcome="ok",store="PushTracker"}`,
+		"devicereg_amqp_publish_duration_seconds_count",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
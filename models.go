@@ -1,9 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"regexp"
+	"time"
 
 	"github.com/eensymachines-in/patio/aquacfg"
+	"github.com/eensymachines-in/webapi-devicereg/cfgenc"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -20,19 +25,317 @@ type Device struct {
 	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
 	Name     string             `bson:"name" json:"name"` // its easier to use this when displaying on the front end
 	MacID    DevMacID           `bson:"mac" json:"mac"`
-	Location string             `bson:"location" json:"location"` // Google lat long coordinates as string
-	Make     string             `bson:"make" json:"make"`         // string description of the platform hardware used
-	Users    []string           `bson:"users" json:"users"`       // email list of user who can legit own  the device and thus control
-	Cfg      *aquacfg.Schedule  `bson:"cfg" json:"cfg"`
+	Location string             `bson:"location" json:"location"`                         // Google lat long coordinates as string
+	Make     string             `bson:"make" json:"make"`                                 // string description of the platform hardware used
+	Users    []Membership       `bson:"users" json:"users"`                               // users who can see / control the device, each with a role
+	Cfg      *aquacfg.Schedule  `bson:"cfg" json:"cfg"`                                   // desired config, as last set from the api
+	CfgAt    time.Time          `bson:"cfgat,omitempty" json:"cfgat,omitempty"`           // when the desired config was last pushed
+	CfgRev   int                `bson:"cfgrev" json:"cfgrev"`                             // revision of the desired config, 0 as registered
+	Version  int64              `bson:"version" json:"version"`                           // bumped on each change made by the operators - config, users
+	Reported *aquacfg.Schedule  `bson:"reported,omitempty" json:"reported,omitempty"`     // config the device says it has applied
+	RptAt    *time.Time         `bson:"reportedat,omitempty" json:"reportedat,omitempty"` // when the device last reported
+	Pushes   []ConfigPush       `bson:"pushes,omitempty" json:"pushes,omitempty"`         // latest config pushes, newest last
+	Presence *Presence          `bson:"presence,omitempty" json:"presence,omitempty"`     // as of the last heartbeat
+	EncKey   []byte             `bson:"enckey,omitempty" json:"encKey,omitempty"`         // X25519 public key of the device, base64 - configs pushed to it are encrypted when set
+	TrashAt  *time.Time         `bson:"trashedat,omitempty" json:"trashedat,omitempty"`   // when the device was deleted, nil while its registered
+	PurgeAt  *time.Time         `bson:"purgeat,omitempty" json:"purgeat,omitempty"`       // when the deleted device is gone for good
+	Status   string             `bson:"-" json:"status,omitempty"`                        // online / stale / offline derived from presence
+	Shadow   *Shadow            `bson:"-" json:"shadow,omitempty"`                        // desired vs reported config
 }
 
 // IsValid : validity of any device
-/* macid is valid, atleast one user to control, configuration is not nil */
+/* macid is valid, users are valid with atleast one owner, configuration is not nil, encryption key if any is a valid one */
 func (dev *Device) IsValid() bool {
-	return dev.MacID.IsValid() && len(dev.Users) > 0 && dev.Cfg != nil && dev.Cfg.IsValid()
+	return dev.MacID.IsValid() && ValidMembers(dev.Users, true) && dev.Cfg != nil && dev.Cfg.IsValid() && ValidEncKey(dev.EncKey)
 }
 
+// ValidEncKey : key is either not set or an X25519 public key
+func ValidEncKey(key []byte) bool {
+	return len(key) == 0 || len(key) == cfgenc.KeySize
+}
+
+// RoleOf : role of the user on the device, empty when not one of its users
+func (dev *Device) RoleOf(email string) string {
+	for _, m := range dev.Users {
+		if m.Email == email {
+			return m.Role
+		}
+	}
+	return ""
+}
+
+// Roles of the users on a device, each can do all that the ones below it can
+const (
+	RoleOwner    = "owner"    // changes the users, deletes / restores / purges the device
+	RoleOperator = "operator" // changes the config, rolls it back
+	RoleViewer   = "viewer"   // sees the device, its shadow and config history
+)
+
+// RoleDevice : the device itself calling with its api key, only sends heartbeats and its reported config
+// not ranked with the roles of the users, it cannot be given to a user
+const RoleDevice = "device"
+
+// roleRank : higher the rank more the role can do, 0 for roles not known
+var roleRank = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleOwner: 3}
+
+// RoleAtLeast : role can do what need can
+func RoleAtLeast(role, need string) bool {
+	return roleRank[role] > 0 && roleRank[role] >= roleRank[need]
+}
+
+// Membership : user of a device and the role the user has on it
+// Users on devices registered before roles were plain emails, those are read as owners
+type Membership struct {
+	Email   string    `bson:"email" json:"email"`
+	Role    string    `bson:"role" json:"role"`
+	AddedBy string    `bson:"addedby,omitempty" json:"addedBy,omitempty"` // user who added this one, set by the server
+	AddedAt time.Time `bson:"addedat,omitempty" json:"addedAt,omitempty"` // set by the server
+}
+
+// UnmarshalJSON : plain email is an owner, as the front end sent before roles
+func (m *Membership) UnmarshalJSON(byt []byte) error {
+	email := ""
+	if err := json.Unmarshal(byt, &email); err == nil {
+		*m = Membership{Email: email, Role: RoleOwner}
+		return nil
+	}
+	type plain Membership
+	return json.Unmarshal(byt, (*plain)(m))
+}
+
+// UnmarshalBSONValue : plain email is an owner, for documents not migrated yet
+func (m *Membership) UnmarshalBSONValue(t bsontype.Type, byt []byte) error {
+	val := bson.RawValue{Type: t, Value: byt}
+	if email, ok := val.StringValueOK(); ok {
+		*m = Membership{Email: email, Role: RoleOwner}
+		return nil
+	}
+	type plain Membership
+	return val.Unmarshal((*plain)(m))
+}
+
+// ValidMembers : every user has an email and a known role, no email more than once
+// needOwner when the list is all the users of the device, which can never be without an owner
+func ValidMembers(users []Membership, needOwner bool) bool {
+	seen := map[string]bool{}
+	owners := 0
+	for _, m := range users {
+		if m.Email == "" || roleRank[m.Role] == 0 || seen[m.Email] {
+			return false
+		}
+		seen[m.Email] = true
+		if m.Role == RoleOwner {
+			owners++
+		}
+	}
+	return len(users) > 0 && (!needOwner || owners > 0)
+}
+
+// SetServerFields : clears the fields only the server / device can set, incase a new registration sends them along
+func (dev *Device) SetServerFields(now time.Time) {
+	dev.CfgAt = now
+	dev.CfgRev = 0
+	dev.Version = 1
+	dev.Reported = nil
+	dev.RptAt = nil
+	dev.Pushes = nil
+	dev.Presence = nil
+	dev.TrashAt = nil
+	dev.PurgeAt = nil
+}
+
+// ApiKey : key a device or a script calls the api with in place of a user's token, good only for the device it is of
+// the secret part of the key is shown once when issued / rotated, only its hash is kept
+type ApiKey struct {
+	ID         string     `bson:"_id" json:"id"` // first part of the key, to look it up by
+	MacID      DevMacID   `bson:"mac" json:"mac"`
+	Name       string     `bson:"name" json:"name"` // what the key is for - firmware, a script ..
+	Hash       string     `bson:"hash" json:"-"`    // sha256 of the secret part
+	CreatedBy  string     `bson:"createdby" json:"createdBy"`
+	CreatedAt  time.Time  `bson:"createdat" json:"createdAt"`
+	RotatedAt  *time.Time `bson:"rotatedat,omitempty" json:"rotatedAt,omitempty"`
+	LastUsedAt *time.Time `bson:"lastusedat,omitempty" json:"lastUsedAt,omitempty"` // updated atmost once a minute
+	RevokedAt  *time.Time `bson:"revokedat,omitempty" json:"revokedAt,omitempty"`   // revoked keys are listed but not accepted
+}
+
+// SigningKey : key the config pushes to the device are signed with, see package cfgsig
+// a device has one active key at a time, retired keys are kept so the list shows what the device may still hold
+type SigningKey struct {
+	ID        string     `bson:"_id" json:"id"` // goes out in the headers of the signed message
+	MacID     DevMacID   `bson:"mac" json:"mac"`
+	Alg       string     `bson:"alg" json:"alg"`                           // cfgsig.AlgEd25519 / cfgsig.AlgHMACSHA256
+	Secret    []byte     `bson:"secret" json:"-"`                          // ed25519 seed or the hmac secret, never sent out but for the hmac secret when created
+	PubKey    []byte     `bson:"pubkey,omitempty" json:"pubKey,omitempty"` // ed25519 public key the device verifies with, base64 in json
+	CreatedBy string     `bson:"createdby" json:"createdBy"`
+	CreatedAt time.Time  `bson:"createdat" json:"createdAt"`
+	RetiredAt *time.Time `bson:"retiredat" json:"retiredAt,omitempty"` // replaced by another key or retired by the owner, null while active
+}
+
+// CmdAck : acknowledgement from the device once it has received a config push
+// devices send back the message id of the push as the correlation id of the ack, or in the payload
 type CmdAck struct {
 	DevcMacId string `json:"mac"` // device mac id
 	Ack       bool   `json:"ack"`
+	MsgID     string `json:"msgid,omitempty"`
+}
+
+// Status of a config push as acknowledged by the device
+const (
+	PushUndelivered = "undelivered" // device not listening / broker down, outbox keeps retrying
+	PushPending     = "pending"     // sent, device is yet to acknowledge
+	PushAcked       = "acked"       // device applied the config
+	PushNacked      = "nacked"      // device rejected the config
+	PushExpired     = "expired"     // device did not acknowledge in time
+)
+
+// MaxPushes : number of latest pushes kept on the device record
+const MaxPushes = 10
+
+// ConfigPush : a config push to the device and its acknowledgement status
+// MsgID is the id of the outbox message and the amqp message id of the push
+type ConfigPush struct {
+	MsgID     string    `bson:"msgid" json:"msgid"`
+	Status    string    `bson:"status" json:"status"`
+	Reason    string    `bson:"reason,omitempty" json:"reason,omitempty"` // why the push isnt delivered yet
+	IssuedAt  time.Time `bson:"issuedat" json:"issuedat"`
+	UpdatedAt time.Time `bson:"updatedat" json:"updatedat"`
+}
+
+// Outbox message status
+const (
+	OutboxPending    = "pending"    // yet to be published, relay would pick this up
+	OutboxDelivered  = "delivered"  // published and confirmed by the broker
+	OutboxSuperseded = "superseded" // a newer config for the same device was queued before this could be delivered, or the device was deleted
+	OutboxFailed     = "failed"     // relay gave up after too many attempts or too long, the push on the device is expired
+)
+
+// OutboxMsg : config change that has to be pushed to the device
+// written in the same transaction as the change to the device configuration, relay publishes it downstream
+type OutboxMsg struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	MacID         DevMacID           `bson:"mac" json:"mac"`
+	Cfg           aquacfg.Schedule   `bson:"cfg" json:"cfg"`
+	Status        string             `bson:"status" json:"status"`
+	Attempts      int                `bson:"attempts" json:"attempts"`
+	LastErr       string             `bson:"lasterr,omitempty" json:"lasterr,omitempty"`
+	CreatedAt     time.Time          `bson:"createdat" json:"createdat"`
+	NextAttemptAt time.Time          `bson:"nextattemptat" json:"nextattemptat"`
+	LockedUntil   time.Time          `bson:"lockeduntil" json:"-"` // lease held by the relay that is publishing this
+	DeliveredAt   *time.Time         `bson:"deliveredat,omitempty" json:"deliveredat,omitempty"`
+	ReqID         string             `bson:"reqid,omitempty" json:"reqid,omitempty"` // request that made the change, correlation id of the push
+	Trace         map[string]string  `bson:"trace,omitempty" json:"-"`               // trace context of the request, traceparent / tracestate
+	EncKey        []byte             `bson:"enckey,omitempty" json:"-"`              // key of the device as the message was queued, the config is encrypted with it
+}
+
+// PushUpdate : change in the status of a config push
+type PushUpdate struct {
+	Status string
+	Reason string   // why the push is in this status, empty when not applicable
+	From   []string // update only if the current status is one of these, any status when empty
+}
+
+// Device status derived from the last heartbeat
+const (
+	DeviceOnline  = "online"  // heartbeat within the online threshold
+	DeviceStale   = "stale"   // missed a few heartbeats, not yet considered offline
+	DeviceOffline = "offline" // no heartbeat since the offline threshold, or never
+)
+
+// Heartbeat : sent periodically by the device over amqp, or http as a fallback
+type Heartbeat struct {
+	MacID    DevMacID `json:"mac"`
+	Firmware string   `json:"firmware"`
+	Uptime   int64    `json:"uptime"` // seconds since the device booted
+	IP       string   `json:"ip"`
+}
+
+// Presence : details of the device as of its last heartbeat
+type Presence struct {
+	LastSeen time.Time `bson:"lastseen" json:"lastseen"`
+	Firmware string    `bson:"firmware" json:"firmware"`
+	Uptime   int64     `bson:"uptime" json:"uptime"`
+	IP       string    `bson:"ip" json:"ip"`
+}
+
+// Shadow : desired config against the one reported by the device
+// Delta has the desired value of each schedule field the device is yet to apply, empty when in sync
+type Shadow struct {
+	Desired  *aquacfg.Schedule      `json:"desired"`
+	Reported *aquacfg.Schedule      `json:"reported"`
+	Delta    map[string]interface{} `json:"delta"`
+}
+
+// ShadowOf : shadow of the device computed from its desired and reported config
+// devices that have never reported have the entire desired config as delta
+func ShadowOf(dev *Device) *Shadow {
+	shadow := &Shadow{Desired: dev.Cfg, Reported: dev.Reported, Delta: map[string]interface{}{}}
+	if dev.Cfg == nil {
+		return shadow
+	}
+	for key, diff := range CfgDiff(dev.Reported, dev.Cfg) {
+		shadow.Delta[key] = diff.To
+	}
+	return shadow
+}
+
+// CfgReport : config the device has applied, published by the device after every change
+type CfgReport struct {
+	MacID DevMacID         `json:"mac"`
+	Cfg   aquacfg.Schedule `json:"cfg"`
+}
+
+// CfgChange : who changed the config and why
+type CfgChange struct {
+	By         string            // user that changed the config
+	RollbackOf int               // revision rolled back to, 0 when its a fresh config
+	IfVersion  *int64            // version of the device the change was made against, nil to change it regardless
+	ReqID      string            // request that made the change, carried on to the push
+	Trace      map[string]string // trace context of the request, retries of the push continue the trace
+}
+
+// CfgRevision : a change in the desired config of the device
+// revisions are numbered per device from 1, config as registered is the old config of revision 1
+type CfgRevision struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	MacID      DevMacID           `bson:"mac" json:"mac"`
+	Rev        int                `bson:"rev" json:"rev"`
+	By         string             `bson:"by" json:"by"`
+	At         time.Time          `bson:"at" json:"at"`
+	Old        *aquacfg.Schedule  `bson:"old" json:"old"`
+	New        aquacfg.Schedule   `bson:"new" json:"new"`
+	MsgID      string             `bson:"msgid" json:"msgid"`                               // outbox message that pushed this revision
+	Delivery   string             `bson:"delivery" json:"delivery"`                         // status of the push, same as ConfigPush.Status
+	RollbackOf int                `bson:"rollbackof,omitempty" json:"rollbackof,omitempty"` // revision this rolled back to
+}
+
+// FieldDiff : value of a schedule field before and after
+type FieldDiff struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// CfgDiff : schedule fields that differ between the two configs, all the fields when either is nil
+func CfgDiff(from, to *aquacfg.Schedule) map[string]FieldDiff {
+	diff := map[string]FieldDiff{}
+	if from == nil && to == nil {
+		return diff
+	}
+	fields := func(sched *aquacfg.Schedule) map[string]interface{} {
+		if sched == nil {
+			return map[string]interface{}{}
+		}
+		return map[string]interface{}{
+			"config":   sched.Config,
+			"tickat":   sched.TickAt,
+			"pulsegap": sched.PulseGap,
+			"interval": sched.Interval,
+		}
+	}
+	f, t := fields(from), fields(to)
+	for _, key := range []string{"config", "tickat", "pulsegap", "interval"} {
+		if from == nil || to == nil || f[key] != t[key] {
+			diff[key] = FieldDiff{From: f[key], To: t[key]}
+		}
+	}
+	return diff
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// DepHealth : state of a dependency (database, broker) as seen from the last check on it
+type DepHealth struct {
+	Healthy   bool
+	LastErr   error
+	LastCheck time.Time
+	Latency   time.Duration
+}
+
+// MongoPoolOpts : sizing and timeouts for the process wide mongo client
+// zero values are replaced by defaults when the pool is created
+type MongoPoolOpts struct {
+	MaxPoolSize    uint64        // max connections the driver keeps open to the server
+	MinPoolSize    uint64        // connections kept warm even when idle
+	ConnectTimeout time.Duration // dialing & server selection deadline
+	OpTimeout      time.Duration // deadline for each query fired from the handlers
+	PingEvery      time.Duration // interval at which health of the pool is checked
+}
+
+func (opts *MongoPoolOpts) defaults() {
+	if opts.MaxPoolSize == 0 {
+		opts.MaxPoolSize = 50
+	}
+	if opts.ConnectTimeout == 0 {
+		opts.ConnectTimeout = 10 * time.Second
+	}
+	if opts.OpTimeout == 0 {
+		opts.OpTimeout = 10 * time.Second
+	}
+	if opts.PingEvery == 0 {
+		opts.PingEvery = 15 * time.Second
+	}
+}
+
+// MongoPool : one mongo client shared across all the requests for the life of the process
+// The driver maintains the connection pool underneath, this only adds sizing, timeouts and a health state
+// Use Database() to get the handle and OpCtx() for deadlines on queries
+type MongoPool struct {
+	client *mongo.Client
+	dbName string
+	opts   MongoPoolOpts
+
+	mu     sync.RWMutex
+	health DepHealth
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMongoPool : connects the client, pings the primary once and starts the background health check
+// Error when the uri is invalid or the server cannot be reached within ConnectTimeout
+func NewMongoPool(uri, dbname string, opts MongoPoolOpts) (*MongoPool, error) {
+	if dbname == "" {
+		return nil, fmt.Errorf("invalid/empty name for mongo db")
+	}
+	opts.defaults()
+	clOpts := options.Client().ApplyURI(uri).
+		SetMaxPoolSize(opts.MaxPoolSize).
+		SetMinPoolSize(opts.MinPoolSize).
+		SetConnectTimeout(opts.ConnectTimeout).
+		SetServerSelectionTimeout(opts.ConnectTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), opts.ConnectTimeout)
+	defer cancel()
+	client, err := mongo.Connect(ctx, clOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed database connection, %s", err)
+	}
+	mp := &MongoPool{
+		client: client,
+		dbName: dbname,
+		opts:   opts,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if err := mp.ping(); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("failed to ping database, %s", err)
+	}
+	go mp.watch()
+	return mp, nil
+}
+
+// ping : pings the primary and records the outcome as the health state of the pool
+func (mp *MongoPool) ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), mp.opts.ConnectTimeout)
+	defer cancel()
+	start := time.Now()
+	err := mp.client.Ping(ctx, readpref.Primary())
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.health = DepHealth{
+		Healthy:   err == nil,
+		LastErr:   err,
+		LastCheck: time.Now(),
+		Latency:   time.Since(start),
+	}
+	return err
+}
+
+// watch : periodic health check, only logs on change of state
+func (mp *MongoPool) watch() {
+	defer close(mp.done)
+	tick := time.NewTicker(mp.opts.PingEvery)
+	defer tick.Stop()
+	for {
+		select {
+		case <-mp.stop:
+			return
+		case <-tick.C:
+			wasHealthy := mp.Healthy()
+			err := mp.ping()
+			if err != nil && wasHealthy {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("mongo pool is unhealthy, database unreachable")
+			} else if err == nil && !wasHealthy {
+				log.Info("mongo pool is healthy again")
+			}
+		}
+	}
+}
+
+// Database : handle to the application database on the shared client
+func (mp *MongoPool) Database() *mongo.Database {
+	return mp.client.Database(mp.dbName)
+}
+
+// Client : the shared client, do not disconnect this from the handlers
+func (mp *MongoPool) Client() *mongo.Client {
+	return mp.client
+}
+
+// OpCtx : context for a single query with the configured operation timeout
+// parent is typically the request context so that queries are cancelled when the client goes away
+func (mp *MongoPool) OpCtx(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, mp.opts.OpTimeout)
+}
+
+// Healthy : outcome of the last ping
+func (mp *MongoPool) Healthy() bool {
+	return mp.Health().Healthy
+}
+
+// Health : detailed state of the last ping - healthy, last error, when and how long it took
+func (mp *MongoPool) Health() DepHealth {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	return mp.health
+}
+
+// Close : stops the health check and disconnects the client, pool is unusable after this
+func (mp *MongoPool) Close(ctx context.Context) error {
+	mp.closeOnce.Do(func() { close(mp.stop) })
+	<-mp.done
+	return mp.client.Disconnect(ctx)
+}
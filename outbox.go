@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"github.com/eensymachines-in/patio/aquacfg"
+	"github.com/eensymachines-in/webapi-devicereg/cfgenc"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	OutboxCollc = func(db *mongo.Database) ConfigOutbox {
+		return &qryOutbox{devices: db.Collection("devices"), outbox: db.Collection("outbox"), revisions: db.Collection("revisions")}
+	}
+)
+
+// ConfigOutbox : config changes on the device along with the messages that push them downstream
+// Device configuration and its outbox message are written together, either both or none
+type ConfigOutbox interface {
+	// PatchConfgOutbox : patches the config, records the revision and queues the message to push it, lease on the message is held by the caller
+	PatchConfgOutbox(mac DevMacID, sched aquacfg.Schedule, chg CfgChange, lease time.Duration, ctx context.Context) (*OutboxMsg, httperr.HttpErr)
+	// RepushConfg : queues the message to push the current config again
+	RepushConfg(mac DevMacID, lease time.Duration, ctx context.Context) (*OutboxMsg, httperr.HttpErr)
+	// ClaimOutbox : pending messages due for an attempt, each claimed with a lease so no other relay picks them
+	ClaimOutbox(lease time.Duration, limit int, ctx context.Context) ([]OutboxMsg, error)
+	MarkDelivered(id primitive.ObjectID, ctx context.Context) error
+	MarkFailed(id primitive.ObjectID, cause error, retryAt time.Time, ctx context.Context) error
+	// GiveUp : records the last failed attempt and marks the message failed, the relay doesnt pick it again
+	GiveUp(id primitive.ObjectID, cause error, ctx context.Context) error
+}
+
+// OutboxIndexes : creates the indexes on the outbox and revisions collection, called once on startup
+func OutboxIndexes(db *mongo.Database, ctx context.Context) error {
+	return (&qryOutbox{outbox: db.Collection("outbox"), revisions: db.Collection("revisions")}).EnsureIndexes(ctx)
+}
+
+type qryOutbox struct {
+	devices   *mongo.Collection
+	outbox    *mongo.Collection
+	revisions *mongo.Collection
+}
+
+// EnsureIndexes : indexes the relay queries on, delivered messages are cleaned up after a week
+// revisions are unique per device
+func (qo *qryOutbox) EnsureIndexes(ctx context.Context) error {
+	_, err := qo.outbox.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextattemptat", Value: 1}}},
+		{Keys: bson.D{{Key: "deliveredat", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(7 * 24 * 3600)},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = qo.revisions.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "mac", Value: 1}, {Key: "rev", Value: -1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "msgid", Value: 1}}},
+	})
+	return err
+}
+
+// PatchConfgOutbox : Patches the schedule for the device, queues the outbox message and records the revision in a single transaction
+// Older pending messages for the same device are superseded, device would only need the latest config
+// Error when mac id / schedule is invalid, device not found or changed since chg.IfVersion, or the transaction fails
+// NOTE: transactions need mongo running as a replica set, single node replica set is good enough
+func (qo *qryOutbox) PatchConfgOutbox(mac DevMacID, sched aquacfg.Schedule, chg CfgChange, lease time.Duration, ctx context.Context) (*OutboxMsg, httperr.HttpErr) {
+	if !sched.IsValid() {
+		return nil, httperr.ErrInvalidParam(fmt.Errorf("invalid schedule for the device. Check schedule fields for rule violation"))
+	}
+	return qo.enqueue(mac, &sched, chg, lease, ctx)
+}
+
+// RepushConfg : queues the desired config of the device again, no revision is recorded since the config doesnt change
+func (qo *qryOutbox) RepushConfg(mac DevMacID, lease time.Duration, ctx context.Context) (*OutboxMsg, httperr.HttpErr) {
+	return qo.enqueue(mac, nil, CfgChange{}, lease, ctx)
+}
+
+// enqueue : in a transaction, sets the config on the device (nil to push the current one) and queues the outbox message
+// when the config is set a revision is recorded as well
+func (qo *qryOutbox) enqueue(mac DevMacID, sched *aquacfg.Schedule, chg CfgChange, lease time.Duration, ctx context.Context) (*OutboxMsg, httperr.HttpErr) {
+	if !mac.IsValid() {
+		return nil, httperr.ErrInvalidParam(fmt.Errorf("invalid mac id %s for the device being patched", mac))
+	}
+	now := time.Now()
+	msg := &OutboxMsg{
+		ID:            primitive.NewObjectID(),
+		MacID:         mac,
+		Status:        OutboxPending,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+		LockedUntil:   now.Add(lease),
+		ReqID:         chg.ReqID,
+		Trace:         chg.Trace,
+	}
+	sess, err := qo.devices.Database().Client().StartSession()
+	if err != nil {
+		return nil, httperr.ErrGatewayConnect(err)
+	}
+	defer sess.EndSession(ctx)
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		push := ConfigPush{MsgID: msg.ID.Hex(), Status: PushPending, IssuedAt: now, UpdatedAt: now}
+		set := bson.M{"cfgat": now}
+		update := bson.M{
+			"$set":  set,
+			"$push": bson.M{"pushes": bson.M{"$each": []ConfigPush{push}, "$slice": -MaxPushes}},
+		}
+		if sched != nil {
+			set["cfg"] = sched
+			update["$inc"] = bson.M{"cfgrev": 1, "version": 1}
+		}
+		old := Device{}
+		sr := qo.devices.FindOneAndUpdate(sc, byVersion(mac, chg.IfVersion), update, options.FindOneAndUpdate().SetReturnDocument(options.Before))
+		if err := sr.Decode(&old); err != nil {
+			return nil, err // ErrNoDocuments when the device isnt registered
+		}
+		if old.Cfg == nil && sched == nil {
+			return nil, fmt.Errorf("device %s has no config to push", mac)
+		}
+		if sched != nil {
+			msg.Cfg = *sched
+			rev := &CfgRevision{
+				MacID:      mac,
+				Rev:        old.CfgRev + 1,
+				By:         chg.By,
+				At:         now,
+				Old:        old.Cfg,
+				New:        *sched,
+				MsgID:      msg.ID.Hex(),
+				Delivery:   PushPending,
+				RollbackOf: chg.RollbackOf,
+			}
+			if _, err := qo.revisions.InsertOne(sc, rev); err != nil {
+				return nil, err
+			}
+		} else {
+			msg.Cfg = *old.Cfg
+		}
+		msg.EncKey = old.EncKey
+		if err := supersedeOutbox(sc, qo.outbox.Database(), mac); err != nil {
+			return nil, err
+		}
+		return qo.outbox.InsertOne(sc, msg)
+	})
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, notMatched(qo.devices, mac, chg.IfVersion, ctx)
+		}
+		return nil, httperr.ErrDBQuery(err)
+	}
+	return msg, nil
+}
+
+// ClaimOutbox : claims upto limit pending messages that are due and not leased by any other relay
+func (qo *qryOutbox) ClaimOutbox(lease time.Duration, limit int, ctx context.Context) ([]OutboxMsg, error) {
+	result := []OutboxMsg{}
+	for len(result) < limit {
+		now := time.Now()
+		sr := qo.outbox.FindOneAndUpdate(ctx, bson.M{
+			"status":        OutboxPending,
+			"nextattemptat": bson.M{"$lte": now},
+			"lockeduntil":   bson.M{"$lte": now},
+		}, bson.M{
+			"$set": bson.M{"lockeduntil": now.Add(lease)},
+		}, options.FindOneAndUpdate().SetReturnDocument(options.After).SetSort(bson.M{"createdat": 1}))
+		if sr.Err() != nil {
+			if errors.Is(sr.Err(), mongo.ErrNoDocuments) {
+				break
+			}
+			return result, sr.Err()
+		}
+		msg := OutboxMsg{}
+		if err := sr.Decode(&msg); err != nil {
+			return result, err
+		}
+		result = append(result, msg)
+	}
+	return result, nil
+}
+
+// MarkDelivered : message was published and confirmed, relay wont pick it again
+// a message superseded while it was being published is left as is
+func (qo *qryOutbox) MarkDelivered(id primitive.ObjectID, ctx context.Context) error {
+	_, err := qo.outbox.UpdateOne(ctx, bson.M{"_id": id, "status": OutboxPending}, bson.M{
+		"$set": bson.M{"status": OutboxDelivered, "deliveredat": time.Now(), "lockeduntil": time.Time{}},
+	})
+	return err
+}
+
+// MarkFailed : records the failed attempt and releases the lease, relay tries again at retryAt
+func (qo *qryOutbox) MarkFailed(id primitive.ObjectID, cause error, retryAt time.Time, ctx context.Context) error {
+	_, err := qo.outbox.UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$inc": bson.M{"attempts": 1},
+		"$set": bson.M{"lasterr": cause.Error(), "nextattemptat": retryAt, "lockeduntil": time.Time{}},
+	})
+	return err
+}
+
+// GiveUp : message is failed for good, a message superseded meanwhile is left as is
+func (qo *qryOutbox) GiveUp(id primitive.ObjectID, cause error, ctx context.Context) error {
+	_, err := qo.outbox.UpdateOne(ctx, bson.M{"_id": id, "status": OutboxPending}, bson.M{
+		"$inc": bson.M{"attempts": 1},
+		"$set": bson.M{"status": OutboxFailed, "lasterr": cause.Error(), "lockeduntil": time.Time{}},
+	})
+	return err
+}
+
+// RelayOpts : tuning for the outbox relay, zero values are replaced by defaults
+type RelayOpts struct {
+	PollEvery   time.Duration // interval at which the outbox is checked for pending messages
+	Lease       time.Duration // time a relay holds a message before another can claim it
+	Batch       int           // messages claimed in one go
+	MinBackoff  time.Duration // wait before the first retry of a failed message
+	MaxBackoff  time.Duration // retries wait doubling each time upto this
+	MaxAttempts int           // message is given up after failing these many times
+	MaxAge      time.Duration // message failing this long after it was queued is given up
+	// PublishTimeout : longest a single delivery may take, the broker's confirmation included
+	PublishTimeout time.Duration
+}
+
+func (opts *RelayOpts) defaults() {
+	if opts.PollEvery == 0 {
+		opts.PollEvery = 5 * time.Second
+	}
+	if opts.Lease == 0 {
+		opts.Lease = 30 * time.Second
+	}
+	if opts.Batch <= 0 {
+		opts.Batch = 20
+	}
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff = 2 * time.Second
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = 5 * time.Minute
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 50
+	}
+	if opts.MaxAge == 0 {
+		opts.MaxAge = 24 * time.Hour
+	}
+	if opts.PublishTimeout == 0 {
+		opts.PublishTimeout = 10 * time.Second
+	}
+}
+
+// OutboxRelay : publishes outbox messages to the devices, retrying with backoff until the broker confirms
+// Delivery is at-least-once, a device may receive the same config more than once
+// Messages still failing after MaxAttempts or MaxAge are given up, as for a device that has no queue bound
+type OutboxRelay struct {
+	store  ConfigOutbox
+	pushes PushTracker
+	signer *Signer
+	pub    CfgPublisher
+	opts   RelayOpts
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewOutboxRelay : starts relaying pending outbox messages in the background
+// status of the push on the device is kept in step with the delivery, every push is signed by the signer
+func NewOutboxRelay(store ConfigOutbox, pushes PushTracker, signer *Signer, pub CfgPublisher, opts RelayOpts) *OutboxRelay {
+	opts.defaults()
+	r := &OutboxRelay{
+		store:  store,
+		pushes: pushes,
+		signer: signer,
+		pub:    pub,
+		opts:   opts,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// Lease : duration for which a message is held by whoever is publishing it
+func (r *OutboxRelay) Lease() time.Duration {
+	return r.opts.Lease
+}
+
+// PublishTimeout : longest a single delivery may take, bound the context handed to Deliver by it
+func (r *OutboxRelay) PublishTimeout() time.Duration {
+	return r.opts.PublishTimeout
+}
+
+// backoff : wait before the next attempt, given the number of attempts already failed
+func (r *OutboxRelay) backoff(attempts int) time.Duration {
+	wait := r.opts.MinBackoff
+	for i := 0; i < attempts && wait < r.opts.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > r.opts.MaxBackoff {
+		wait = r.opts.MaxBackoff
+	}
+	return wait
+}
+
+// givingUp : message that just failed is not to be tried again
+func (r *OutboxRelay) givingUp(msg *OutboxMsg) bool {
+	return msg.Attempts+1 >= r.opts.MaxAttempts || time.Since(msg.CreatedAt) > r.opts.MaxAge
+}
+
+// Deliver : publishes a single outbox message and marks it delivered or failed
+// Failed pushes are parked as undelivered on the device till a retry gets through, then pending the device's ack
+// or expired once the relay gives up on them
+// Caller should hold the lease on the message, error is that of the publish
+func (r *OutboxRelay) Deliver(ctx context.Context, msg *OutboxMsg) error {
+	byt, _ := json.Marshal(msg.Cfg)
+	/* message id is that of the outbox message, devices send it back as the correlation id of their ack
+	the request that made the change goes as the correlation id of the push, and in the headers */
+	opts := []PubOpt{WithMessageID(msg.ID.Hex())}
+	if msg.ReqID != "" {
+		opts = append(opts, WithCorrelationID(msg.ReqID), WithHeader("x-request-id", msg.ReqID))
+	}
+	if !trace.SpanContextFromContext(ctx).IsValid() && msg.Trace != nil {
+		// retried by the relay, the trace continues from the request that made the change
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(msg.Trace))
+	}
+	ctx, span := tracer().Start(ctx, "config publish", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		attribute.String("messaging.system", "rabbitmq"),
+		attribute.String("messaging.rabbitmq.destination.routing_key", string(msg.MacID)),
+		attribute.String("messaging.message.id", msg.ID.Hex()),
+		attribute.Int("outbox.attempts", msg.Attempts),
+	))
+	opts = append(opts, WithTraceContext(ctx))
+	start := time.Now()
+	// encrypted for the device when it has a key, the signature is then over the ciphertext
+	var pubErr error
+	if len(msg.EncKey) > 0 {
+		var sealed cfgenc.Sealed
+		if sealed, pubErr = cfgenc.Encrypt(msg.EncKey, string(msg.MacID), msg.ID.Hex(), byt); pubErr == nil {
+			byt = sealed.Ciphertext
+			opts = append(opts, WithContentType("application/octet-stream"))
+			for hdr, val := range sealed.Table() {
+				opts = append(opts, WithHeader(hdr, val))
+			}
+		} else {
+			pubErr = fmt.Errorf("failed to encrypt config push: %w", pubErr)
+		}
+	}
+	if pubErr == nil {
+		// signed afresh on each attempt, devices refuse a message signed too long ago
+		var sigOpt PubOpt
+		if sigOpt, pubErr = r.signer.Sign(ctx, msg.MacID, msg.ID.Hex(), byt); pubErr != nil {
+			pubErr = fmt.Errorf("failed to sign config push: %w", pubErr)
+		} else {
+			pubErr = r.pub.Publish(ctx, msg.MacID, byt, append(opts, sigOpt)...)
+		}
+	}
+	amqpConfirmWait.Observe(time.Since(start).Seconds())
+	amqpPublishes.WithLabelValues(publishOutcome(pubErr)).Inc()
+	// marking should not fail just because the request that triggered delivery went away
+	// it stays in the trace of the publish, the span ends once the message and the push are marked
+	mctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	defer endSpan(span, pubErr)
+	var err error
+	var pushErr httperr.HttpErr
+	if pubErr != nil && r.givingUp(msg) {
+		err = r.store.GiveUp(msg.ID, pubErr, mctx)
+		pushErr = r.pushes.SetPushStatus(msg.MacID, msg.ID.Hex(), PushUpdate{
+			Status: PushExpired,
+			Reason: fmt.Sprintf("gave up after %d attempts: %s", msg.Attempts+1, pubErr),
+			From:   []string{PushPending, PushUndelivered, PushExpired},
+		}, mctx)
+		log.WithFields(log.Fields{
+			"err":      pubErr,
+			"id":       msg.ID.Hex(),
+			"mac":      msg.MacID,
+			"reqid":    msg.ReqID,
+			"attempts": msg.Attempts + 1,
+		}).Error("outbox delivery given up")
+	} else if pubErr != nil {
+		err = r.store.MarkFailed(msg.ID, pubErr, time.Now().Add(r.backoff(msg.Attempts)), mctx)
+		pushErr = r.pushes.SetPushStatus(msg.MacID, msg.ID.Hex(), PushUpdate{
+			Status: PushUndelivered,
+			Reason: pubErr.Error(),
+			From:   []string{PushPending, PushUndelivered, PushExpired},
+		}, mctx)
+	} else {
+		err = r.store.MarkDelivered(msg.ID, mctx)
+		if msg.Attempts > 0 {
+			// first attempt leaves the push pending, only a parked push needs to be moved back
+			pushErr = r.pushes.SetPushStatus(msg.MacID, msg.ID.Hex(), PushUpdate{
+				Status: PushPending,
+				From:   []string{PushUndelivered, PushExpired},
+			}, mctx)
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":   err,
+			"id":    msg.ID.Hex(),
+			"mac":   msg.MacID,
+			"reqid": msg.ReqID,
+		}).Error("failed to mark outbox message")
+	}
+	if pushErr != nil {
+		log.WithFields(log.Fields{
+			"err": pushErr,
+			"id":  msg.ID.Hex(),
+			"mac": msg.MacID,
+		}).Warn("failed to update push status on the device")
+	}
+	return pubErr
+}
+
+// relay : one round of claiming the due messages and delivering them
+// each delivery has its own timeout, messages that cant be delivered within the lease are left as they are for the next claim
+func (r *OutboxRelay) relay() {
+	leaseEnd := time.Now().Add(r.opts.Lease)
+	ctx, cancel := context.WithDeadline(context.Background(), leaseEnd)
+	msgs, err := r.store.ClaimOutbox(r.opts.Lease, r.opts.Batch, ctx)
+	cancel()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to claim outbox messages")
+	}
+	for i := range msgs {
+		select {
+		case <-r.stop:
+			// shutting down, messages left are picked up once their lease runs out
+			return
+		default:
+		}
+		if time.Until(leaseEnd) < r.opts.PublishTimeout {
+			// not attempted, so not failed either - another claim picks them up once the lease runs out
+			log.WithFields(log.Fields{
+				"left": len(msgs) - i,
+			}).Warn("outbox lease ran out, messages left for the next round")
+			return
+		}
+		dctx, cancel := context.WithTimeout(context.Background(), r.opts.PublishTimeout)
+		err := r.Deliver(dctx, &msgs[i])
+		cancel()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":      err,
+				"id":       msgs[i].ID.Hex(),
+				"mac":      msgs[i].MacID,
+				"reqid":    msgs[i].ReqID,
+				"attempts": msgs[i].Attempts + 1,
+			}).Warn("outbox delivery failed")
+		}
+	}
+}
+
+func (r *OutboxRelay) run() {
+	defer close(r.done)
+	tick := time.NewTicker(r.opts.PollEvery)
+	defer tick.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-tick.C:
+			r.relay()
+		}
+	}
+}
+
+// Close : stops the relay after the delivery in progress, pending messages stay in the outbox
+func (r *OutboxRelay) Close() {
+	close(r.stop)
+	<-r.done
+}
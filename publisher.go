@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	ErrBrokerDown     = errors.New("amqp broker connection is down")
+	ErrPublishNack    = errors.New("rejected by the rabbit mq server")
+	ErrConfirmTimeout = errors.New("rabbitmq server timedout, no acknowledgement response")
+	ErrUnroutable     = errors.New("device is not currently listening, no queue bound for its mac")
+)
+
+// CfgPublisher : pushes device configurations downstream to the devices on the ground
+// mac is the routing key, devices bind their queues with their own mac id
+// Publish returns only after the broker has confirmed the message or failed to do so
+// Messages are mandatory, when no queue is bound for the mac Publish errors with ErrUnroutable
+type CfgPublisher interface {
+	Publish(ctx context.Context, mac DevMacID, payload []byte, opts ...PubOpt) error
+}
+
+// PubOpt : sets properties on the outgoing message
+type PubOpt func(*amqp.Publishing)
+
+// WithMessageID : id of the message, devices send this back as the correlation id when they acknowledge
+func WithMessageID(id string) PubOpt {
+	return func(msg *amqp.Publishing) {
+		msg.MessageId = id
+	}
+}
+
+// WithCorrelationID : correlation id of the message, the request that made the change
+func WithCorrelationID(id string) PubOpt {
+	return func(msg *amqp.Publishing) {
+		msg.CorrelationId = id
+	}
+}
+
+// WithContentType : content type of the message, text/plain when not set
+func WithContentType(typ string) PubOpt {
+	return func(msg *amqp.Publishing) {
+		msg.ContentType = typ
+	}
+}
+
+// WithHeader : application header on the message
+func WithHeader(key string, val interface{}) PubOpt {
+	return func(msg *amqp.Publishing) {
+		if msg.Headers == nil {
+			msg.Headers = amqp.Table{}
+		}
+		msg.Headers[key] = val
+	}
+}
+
+// PublisherOpts : tuning for the amqp publisher, zero values are replaced by defaults
+type PublisherOpts struct {
+	Exchange       string        // direct exchange on which the configs are published
+	PoolSize       int           // number of confirm mode channels kept open
+	ConfirmTimeout time.Duration // how long a publish waits for the broker to confirm
+	MinBackoff     time.Duration // first wait before redialing a lost connection
+	MaxBackoff     time.Duration // waits double on each failed redial upto this
+}
+
+func (opts *PublisherOpts) defaults() {
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 4
+	}
+	if opts.ConfirmTimeout == 0 {
+		opts.ConfirmTimeout = 8 * time.Second
+	}
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff = time.Second
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+}
+
+// pubChannel : channel in confirm mode along with its confirmation and return listeners
+// a channel is used by one publish at a time, hence the next confirmation on it belongs to that publish
+// broker sends back an unroutable mandatory message before confirming it
+type pubChannel struct {
+	ch       *amqp.Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	gen      uint64 // connection generation this channel was opened on
+}
+
+// AmqpPublisher : long lived connection to the broker with a pool of confirm mode channels
+// Connection is redialed with backoff whenever the broker closes it, channels are rebuilt on the new connection
+type AmqpPublisher struct {
+	uri  string
+	opts PublisherOpts
+
+	mu     sync.RWMutex
+	conn   *amqp.Connection
+	gen    uint64
+	pool   chan *pubChannel
+	lost   chan struct{} // closed when the connection of this generation is lost, wakes the publishes waiting on its pool
+	health DepHealth
+
+	missing atomic.Int32  // channels of the pool that couldnt be replaced on release, opened again from the connection loop
+	refill  chan struct{} // asks the connection loop to open the missing channels
+
+	closing  chan struct{}  // closed on Close, no new publishes after
+	inflight sync.WaitGroup // publishes yet to get their confirmation, waited on before the connection is closed
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewAmqpPublisher : starts the publisher, connection is made in the background
+// Publish calls fail with ErrBrokerDown until the broker is reachable
+func NewAmqpPublisher(uri string, opts PublisherOpts) *AmqpPublisher {
+	opts.defaults()
+	p := &AmqpPublisher{
+		uri:     uri,
+		opts:    opts,
+		closing: make(chan struct{}),
+		refill:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// setup : declares the exchange and fills the pool with fresh channels on a new connection
+func (p *AmqpPublisher) setup(conn *amqp.Connection) error {
+	start := time.Now()
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	// NOTE: we shall be using a direct exchange with mac id specific routing key
+	err = ch.ExchangeDeclare(
+		p.opts.Exchange, // name
+		"direct",        // exhange type
+		true,            // durable
+		false,           //auto deleted
+		false,           //internal
+		false,           // nowait
+		nil,             //amqp.table
+	)
+	ch.Close()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// pool is filled aside, the publisher moves to the new generation only once all of it is open
+	gen := p.gen + 1
+	pool := make(chan *pubChannel, p.opts.PoolSize)
+	for i := 0; i < p.opts.PoolSize; i++ {
+		pc, err := openPubChannel(conn, gen)
+		if err != nil {
+			close(pool)
+			for opened := range pool {
+				opened.ch.Close()
+			}
+			return err
+		}
+		pool <- pc
+	}
+	p.gen = gen
+	p.conn = conn
+	p.pool = pool
+	p.lost = make(chan struct{})
+	p.missing.Store(0)
+	p.health = DepHealth{Healthy: true, LastCheck: time.Now(), Latency: time.Since(start)}
+	log.WithFields(log.Fields{
+		"exchange": p.opts.Exchange,
+		"channels": p.opts.PoolSize,
+	}).Info("amqp publisher ready")
+	return nil
+}
+
+// openPubChannel : new channel on the connection put in confirm mode
+func openPubChannel(conn *amqp.Connection, gen uint64) (*pubChannel, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return &pubChannel{
+		ch:       ch,
+		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:  ch.NotifyReturn(make(chan amqp.Return, 1)),
+		gen:      gen,
+	}, nil
+}
+
+// down : marks the connection as lost, channels from the pool are discarded
+func (p *AmqpPublisher) down(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conn = nil
+	p.pool = nil
+	if p.lost != nil {
+		close(p.lost)
+		p.lost = nil
+	}
+	p.health = DepHealth{Healthy: false, LastErr: err, LastCheck: time.Now()}
+}
+
+// askRefill : wakes the connection loop to open the missing channels, once is enough for any number of asks
+func (p *AmqpPublisher) askRefill() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// refillPool : opens the channels that couldnt be replaced on release, on the connection of the current generation
+// asked again after a backoff when a channel still cant be opened
+func (p *AmqpPublisher) refillPool(conn *amqp.Connection) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.conn != conn {
+		return
+	}
+	for p.missing.Load() > 0 {
+		pc, err := openPubChannel(conn, p.gen)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":     err,
+				"missing": p.missing.Load(),
+			}).Error("failed to refill amqp channel pool, will retry")
+			time.AfterFunc(p.opts.MinBackoff, p.askRefill)
+			return
+		}
+		p.missing.Add(-1)
+		p.pool <- pc
+	}
+}
+
+// run : keeps the connection alive, redials with exponential backoff when it goes down
+func (p *AmqpPublisher) run() {
+	defer close(p.done)
+	keepConnected(p.uri, p.opts.MinBackoff, p.opts.MaxBackoff, p.stop, p.setup, p.down, p.refill, p.refillPool)
+}
+
+// keepConnected : dials the broker and calls up on each fresh connection
+// when the connection is lost or up fails, down is called and the broker redialed after a backoff that doubles upto maxBackoff
+// while connected, repair is called with the connection each time fix is signalled - nil fix when there is nothing to repair
+// returns only when stop is closed, the connection is closed on the way out
+func keepConnected(uri string, minBackoff, maxBackoff time.Duration, stop <-chan struct{}, up func(*amqp.Connection) error, down func(error), fix <-chan struct{}, repair func(*amqp.Connection)) {
+	backoff := minBackoff
+	for {
+		conn, err := amqp.Dial(uri)
+		if err == nil {
+			if err = up(conn); err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			down(err)
+			log.WithFields(log.Fields{
+				"err":     err,
+				"backoff": backoff,
+			}).Error("failed to connect amqp broker, will retry")
+			select {
+			case <-stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = minBackoff
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		for connected := true; connected; {
+			select {
+			case <-stop:
+				down(fmt.Errorf("amqp connection closed on shutdown"))
+				conn.Close()
+				return
+			case <-fix:
+				repair(conn)
+			case aerr := <-closed:
+				down(fmt.Errorf("amqp connection closed: %v", aerr))
+				log.WithFields(log.Fields{
+					"err": aerr,
+				}).Warn("amqp broker connection lost, reconnecting")
+				connected = false
+			}
+		}
+	}
+}
+
+// acquire : takes a channel out of the pool, waits if all of them are busy
+// waiting is given up when the publisher is closing or the connection of the pool is lost, only publishes with a channel in hand are drained
+func (p *AmqpPublisher) acquire(ctx context.Context) (*pubChannel, error) {
+	p.mu.RLock()
+	pool, lost := p.pool, p.lost
+	p.mu.RUnlock()
+	if pool == nil {
+		return nil, ErrBrokerDown
+	}
+	select {
+	case pc := <-pool:
+		return pc, nil
+	case <-lost:
+		return nil, ErrBrokerDown
+	case <-p.closing:
+		return nil, ErrBrokerDown
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// release : puts the channel back in the pool
+// channels in doubt (failed publish, pending confirmation) are closed and replaced with a fresh one
+// channels from a previous connection are just dropped, those that cant be replaced are opened again from the connection loop
+func (p *AmqpPublisher) release(pc *pubChannel, reuse bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.conn == nil || pc.gen != p.gen {
+		pc.ch.Close()
+		return
+	}
+	if !reuse {
+		pc.ch.Close()
+		npc, err := openPubChannel(p.conn, p.gen)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("failed to replace amqp channel in the pool")
+			p.missing.Add(1)
+			p.askRefill()
+			return
+		}
+		pc = npc
+	}
+	p.pool <- pc
+}
+
+// Publish : publishes the payload with the mac as the routing key and waits for the broker to confirm
+// Errors with ErrBrokerDown when not connected, ErrPublishNack / ErrConfirmTimeout when the broker doesnt confirm
+// ErrUnroutable when the broker returned the message since the device has no queue bound
+func (p *AmqpPublisher) Publish(ctx context.Context, mac DevMacID, payload []byte, opts ...PubOpt) error {
+	p.mu.Lock()
+	select {
+	case <-p.closing:
+		p.mu.Unlock()
+		return ErrBrokerDown
+	default:
+	}
+	p.inflight.Add(1)
+	p.mu.Unlock()
+	defer p.inflight.Done()
+	pc, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	msg := amqp.Publishing{
+		ContentType: "text/plain",
+		Body:        payload,
+	}
+	for _, opt := range opts {
+		opt(&msg)
+	}
+	err = pc.ch.Publish(p.opts.Exchange, string(mac), true, false, msg)
+	if err != nil {
+		p.release(pc, false)
+		return fmt.Errorf("failed to send message to amqp server %s", err)
+	}
+	_, span := tracer().Start(ctx, "amqp confirm", trace.WithAttributes(
+		attribute.String("messaging.destination.name", p.opts.Exchange),
+		attribute.String("messaging.rabbitmq.destination.routing_key", string(mac)),
+	))
+	err = p.awaitConfirm(ctx, pc, mac)
+	endSpan(span, err)
+	return err
+}
+
+// awaitConfirm : waits for the broker to confirm the message just published on the channel, the channel is released after
+func (p *AmqpPublisher) awaitConfirm(ctx context.Context, pc *pubChannel, mac DevMacID) error {
+	select {
+	case confrm, ok := <-pc.confirms:
+		if !ok {
+			// channel closed underneath while waiting
+			p.release(pc, false)
+			return ErrBrokerDown
+		}
+		// returned message would have been dispatched before the confirmation
+		// read it before the channel goes back to the pool so the next publish doesnt see it
+		var returned *amqp.Return
+		select {
+		case ret := <-pc.returns:
+			returned = &ret
+		default:
+		}
+		p.release(pc, true)
+		if !confrm.Ack {
+			return ErrPublishNack
+		}
+		if returned != nil {
+			log.WithFields(log.Fields{
+				"mac":   mac,
+				"reply": returned.ReplyText,
+			}).Debug("config push returned by the broker")
+			return ErrUnroutable
+		}
+		return nil
+	case <-time.After(p.opts.ConfirmTimeout):
+		p.release(pc, false) // a late confirmation shouldnt be read by the next publish
+		return ErrConfirmTimeout
+	case <-ctx.Done():
+		p.release(pc, false)
+		return ctx.Err()
+	}
+}
+
+// Health : whether the publisher is connected and the last connection error if any
+func (p *AmqpPublisher) Health() DepHealth {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.health
+}
+
+// Close : stops reconnecting and closes the connection along with all the channels
+// publishes in flight are let to finish with their confirmation, bounded by the confirm timeout, new ones fail with ErrBrokerDown
+func (p *AmqpPublisher) Close() {
+	p.closeOnce.Do(func() {
+		p.mu.Lock()
+		close(p.closing)
+		p.mu.Unlock()
+		p.inflight.Wait()
+		close(p.stop)
+	})
+	<-p.done
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestAcquireOnLost : publishes waiting for a channel are turned away as soon as the connection of the pool is lost
+func TestAcquireOnLost(t *testing.T) {
+	p := &AmqpPublisher{
+		pool:    make(chan *pubChannel), // all channels busy
+		lost:    make(chan struct{}),
+		closing: make(chan struct{}),
+		refill:  make(chan struct{}, 1),
+	}
+	errs := make(chan error, 1)
+	go func() {
+		_, err := p.acquire(context.Background())
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.down(errors.New("connection reset"))
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrBrokerDown) {
+			t.Fatalf("expected broker down, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("publish still waiting on the pool of the lost connection")
+	}
+	if _, err := p.acquire(context.Background()); !errors.Is(err, ErrBrokerDown) {
+		t.Errorf("acquire after the connection is lost, expected broker down got %v", err)
+	}
+}
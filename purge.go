@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PurgeOpts : how often the trash is checked for devices past their retention
+type PurgeOpts struct {
+	Every time.Duration // interval at which the devices due are purged
+}
+
+func (opts *PurgeOpts) defaults() {
+	if opts.Every == 0 {
+		opts.Every = 10 * time.Minute
+	}
+}
+
+// Purger : purges the devices in the trash once past their purgeat
+// each goes through PurgeDevice so its revisions, api keys, signing keys and pending pushes go with it
+type Purger struct {
+	store QueryDevices
+	opts  PurgeOpts
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewPurger : starts purging the devices due
+func NewPurger(store QueryDevices, opts PurgeOpts) *Purger {
+	opts.defaults()
+	pg := &Purger{
+		store: store,
+		opts:  opts,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go pg.run()
+	return pg
+}
+
+// purge : one round of purging the devices due as of now, returns the count purged
+// devices restored / purged by the owner in the meantime are not found and are skipped
+func (pg *Purger) purge() int {
+	ctx, cancel := context.WithTimeout(context.Background(), pg.opts.Every)
+	defer cancel()
+	due := []DevMacID{}
+	if err := pg.store.DueForPurge(time.Now(), &due, ctx); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to get devices due for purge")
+		return 0
+	}
+	count := 0
+	for _, mac := range due {
+		if err := pg.store.PurgeDevice(mac, ctx); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"mac": mac,
+			}).Warn("failed to purge device from the trash")
+			continue
+		}
+		count++
+	}
+	if count > 0 {
+		log.WithFields(log.Fields{
+			"devices": count,
+		}).Info("devices purged from the trash")
+	}
+	return count
+}
+
+func (pg *Purger) run() {
+	defer close(pg.done)
+	tick := time.NewTicker(pg.opts.Every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-pg.stop:
+			return
+		case <-tick.C:
+			pg.purge()
+		}
+	}
+}
+
+// Close : stops purging
+func (pg *Purger) Close() {
+	close(pg.stop)
+	<-pg.done
+}
@@ -4,11 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/eensymachines-in/errx/httperr"
 	"github.com/eensymachines-in/patio/aquacfg"
+	"github.com/eensymachines-in/webapi-devicereg/cfgenc"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -16,27 +19,181 @@ var (
 	DevicesCollc = func(db *mongo.Database) QueryDevices {
 		return &qryDevices{Collection: db.Collection("devices")}
 	}
+	PushesCollc = func(db *mongo.Database) PushTracker {
+		return &qryDevices{Collection: db.Collection("devices")}
+	}
+	PresenceCollc = func(db *mongo.Database) PresenceStore {
+		return &qryDevices{Collection: db.Collection("devices")}
+	}
+	ShadowCollc = func(db *mongo.Database) ShadowStore {
+		return &qryDevices{Collection: db.Collection("devices")}
+	}
+	FleetCollc = func(db *mongo.Database) FleetCounter {
+		return &qryDevices{Collection: db.Collection("devices")}
+	}
 )
 
 type QueryDevices interface {
 	GetOfId(mac DevMacID, result *Device, ctx context.Context) httperr.HttpErr
 	AddNewDevice(*Device, context.Context) httperr.HttpErr
-	DeleteDevice(mac string, ctx context.Context) httperr.HttpErr
+	DeleteDevice(mac string, ifVersion *int64, retain time.Duration, ctx context.Context) httperr.HttpErr
+	TrashedDevices(userid string, result *[]Device, ctx context.Context) httperr.HttpErr
+	RestoreDevice(mac DevMacID, ctx context.Context) httperr.HttpErr
+	PurgeDevice(mac DevMacID, ctx context.Context) httperr.HttpErr
+	// DueForPurge : devices in the trash past their purgeat as of the given time
+	DueForPurge(at time.Time, result *[]DevMacID, ctx context.Context) httperr.HttpErr
 	DevicesOfUser(userid string, ctx context.Context, result *[]Device) httperr.HttpErr
 	PatchConfg(DevMacID, aquacfg.Schedule, context.Context) httperr.HttpErr
-	AppendUsers(DevMacID, []string, bool, context.Context) httperr.HttpErr
+	AppendUsers(mac DevMacID, users []Membership, replace bool, ifVersion *int64, ctx context.Context) httperr.HttpErr
+	// SetEncKey : public key the configs pushed to the device are encrypted with, empty key to push them plain
+	SetEncKey(mac DevMacID, key []byte, ifVersion *int64, ctx context.Context) httperr.HttpErr
+}
+
+// PushTracker : acknowledgement status of the config pushes kept on the device record
+type PushTracker interface {
+	SetPushStatus(mac DevMacID, msgID string, upd PushUpdate, ctx context.Context) httperr.HttpErr
+	ExpirePushes(before time.Time, ctx context.Context) (int64, error)
+}
+
+// PresenceStore : heartbeats from the devices recorded on the device record
+type PresenceStore interface {
+	Beat(hb Heartbeat, at time.Time, ctx context.Context) httperr.HttpErr
+}
+
+// ShadowStore : config reported by the devices, and devices that havent caught up with the desired config
+type ShadowStore interface {
+	Report(mac DevMacID, sched aquacfg.Schedule, at time.Time, ctx context.Context) httperr.HttpErr
+	// DriftedDevices : devices whose reported config differs from the desired one pushed before the given time
+	DriftedDevices(before time.Time, ctx context.Context) ([]Device, error)
+}
+
+// FleetCounts : counts across the registered devices, trashed ones are left out
+type FleetCounts struct {
+	Registered int64
+	Online     int64            // seen since the time given
+	Pushes     map[string]int64 // latest config pushes on the devices by status
+}
+
+// FleetCounter : counts of the devices for the metrics
+type FleetCounter interface {
+	CountFleet(onlineSince time.Time, ctx context.Context) (FleetCounts, error)
 }
 
 type qryDevices struct {
 	*mongo.Collection
 }
 
+// DeviceIndexes : creates the indexes on the devices collection, called once on startup
+// trashed devices are purged by the Purger along with their revisions and keys, not by a ttl index
+// the ttl index on purgeat of earlier versions is dropped
+func DeviceIndexes(db *mongo.Database, ctx context.Context) error {
+	idx := db.Collection("devices").Indexes()
+	cursor, err := idx.List(ctx)
+	if err != nil {
+		return err
+	}
+	specs := []bson.M{}
+	if err := cursor.All(ctx, &specs); err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if _, ttl := spec["expireAfterSeconds"]; ttl && spec["name"] == "purgeat_1" {
+			if _, err := idx.DropOne(ctx, "purgeat_1"); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = idx.CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"purgeat": 1},
+	})
+	return err
+}
+
+// MigrateDeviceUsers : users on the devices that are still plain emails are made owners, called once on startup
+// returns the count of devices migrated, devices already migrated are left as they are
+func MigrateDeviceUsers(db *mongo.Database, ctx context.Context) (int64, error) {
+	ur, err := db.Collection("devices").UpdateMany(ctx, bson.M{"users": bson.M{"$type": "string"}}, []bson.M{{"$set": bson.M{
+		"users": bson.M{"$map": bson.M{
+			"input": "$users",
+			"as":    "u",
+			"in": bson.M{"$cond": []interface{}{
+				bson.M{"$eq": []interface{}{bson.M{"$type": "$$u"}, "string"}},
+				bson.M{"email": "$$u", "role": RoleOwner, "addedat": "$$NOW"},
+				"$$u",
+			}},
+		}},
+	}}})
+	if err != nil {
+		return 0, err
+	}
+	return ur.ModifiedCount, nil
+}
+
+// live : filter for the device of mac that isnt in the trash
+func live(mac DevMacID) bson.M {
+	return bson.M{"mac": mac, "trashedat": nil}
+}
+
+// trashed : filter for the device of mac that is in the trash
+func trashed(mac DevMacID) bson.M {
+	return bson.M{"mac": mac, "trashedat": bson.M{"$ne": nil}}
+}
+
+// byVersion : filter for the live device of mac, only while its at the version when not nil
+// devices registered before versioning have no version, same as version 0
+func byVersion(mac DevMacID, ifVersion *int64) bson.M {
+	flt := live(mac)
+	if ifVersion != nil {
+		if *ifVersion == 0 {
+			flt["version"] = bson.M{"$in": []interface{}{0, nil}}
+		} else {
+			flt["version"] = *ifVersion
+		}
+	}
+	return flt
+}
+
+// transact : runs fn in a transaction on a session of its own, fn may be run again on transient errors
+// NOTE: transactions need mongo running as a replica set, same as the outbox
+func transact(ctx context.Context, db *mongo.Database, fn func(sc mongo.SessionContext) error) error {
+	sess, err := db.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession(ctx)
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// supersedeOutbox : pending outbox messages of the device are not relayed any more
+func supersedeOutbox(ctx context.Context, db *mongo.Database, mac DevMacID) error {
+	_, err := db.Collection("outbox").UpdateMany(ctx, bson.M{"mac": mac, "status": OutboxPending}, bson.M{"$set": bson.M{"status": OutboxSuperseded}})
+	return err
+}
+
+// notMatched : error when a change filtered byVersion matched no device
+// 404 when the device isnt registered, 412 when its since been changed
+func notMatched(coll *mongo.Collection, mac DevMacID, ifVersion *int64, ctx context.Context) httperr.HttpErr {
+	if ifVersion != nil {
+		count, err := coll.CountDocuments(ctx, live(mac))
+		if err != nil {
+			return httperr.ErrDBQuery(err)
+		}
+		if count > 0 {
+			return ErrPrecondition(fmt.Errorf("device %s changed since version %d", mac, *ifVersion))
+		}
+	}
+	return httperr.ErrResourceNotFound(fmt.Errorf("device not found %s", mac))
+}
+
 // GetOfId : Gets a single device of Mac ID
 // result is out param that will get hydrated with the details.
-// Errors in case  document not found, or the query fails.
+// Errors in case  document not found, or the query fails. Devices in the trash are not found
 func (qd *qryDevices) GetOfId(mac DevMacID, result *Device, ctx context.Context) httperr.HttpErr {
 	*result = Device{} // fresh instance for the output
-	sr := qd.FindOne(ctx, bson.M{"mac": mac})
+	sr := qd.FindOne(ctx, live(mac))
 	if sr.Err() != nil {
 		if errors.Is(sr.Err(), mongo.ErrNoDocuments) {
 			return httperr.ErrResourceNotFound(fmt.Errorf("device not found %s", mac))
@@ -53,6 +210,7 @@ func (qd *qryDevices) GetOfId(mac DevMacID, result *Device, ctx context.Context)
 // AddNewDevice : Adds a new device to the collection of devices
 // Will validate the device before adding, error if invalidated - includes the validation for mac, cfg, users
 // Once the device is added, mongo object id is updated on the device - json marshalling and dispatch
+// A device in the trash is a duplicate too, it has to be restored or purged
 func (qd *qryDevices) AddNewDevice(dev *Device, ctx context.Context) httperr.HttpErr {
 	if !dev.IsValid() || dev == nil {
 		return httperr.ErrInvalidParam(fmt.Errorf("one or more fields on the device is invalid"))
@@ -64,6 +222,8 @@ func (qd *qryDevices) AddNewDevice(dev *Device, ctx context.Context) httperr.Htt
 	if count > 0 {
 		return httperr.DuplicateResourceErr(fmt.Errorf("device with Mac %s already registered", dev.MacID))
 	}
+	// history and keys of an earlier registration of the same mac went with it when purged, see PurgeDevice
+	dev.SetServerFields(time.Now())
 	sr, err := qd.InsertOne(ctx, dev)
 	if err != nil {
 		return httperr.ErrDBQuery(err)
@@ -72,18 +232,116 @@ func (qd *qryDevices) AddNewDevice(dev *Device, ctx context.Context) httperr.Htt
 	return nil
 }
 
-// DeleteDevice: permanently deletes the device registration
-// Error when mac id isnt valid
-// Does NOTcheck for if the mac id exists .. silently deletes the data
-// Once deleted data cannot be recovered.
-func (qd *qryDevices) DeleteDevice(mac string, ctx context.Context) httperr.HttpErr {
+// DeleteDevice: moves the device registration to the trash, from where it is purged after retain
+// Error when mac id isnt valid, device isnt registered or has changed since ifVersion
+// Until purged the device can be restored with all its details
+func (qd *qryDevices) DeleteDevice(mac string, ifVersion *int64, retain time.Duration, ctx context.Context) httperr.HttpErr {
 	if !DevMacID(mac).IsValid() {
 		return httperr.ErrInvalidParam(fmt.Errorf("invalid MAC for the device to delete %s", mac))
 	}
-	_, err := qd.DeleteOne(ctx, bson.M{"mac": mac})
+	now := time.Now()
+	matched := false
+	err := transact(ctx, qd.Database(), func(sc mongo.SessionContext) error {
+		ur, err := qd.UpdateOne(sc, byVersion(DevMacID(mac), ifVersion), bson.M{
+			"$set": bson.M{"trashedat": now, "purgeat": now.Add(retain)},
+			"$inc": bson.M{"version": 1},
+		})
+		if err != nil {
+			return err
+		}
+		if matched = ur.MatchedCount > 0; !matched {
+			return nil
+		}
+		// config yet to be relayed isnt sent to a device in the trash
+		return supersedeOutbox(sc, qd.Database(), DevMacID(mac))
+	})
+	if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	if !matched {
+		return notMatched(qd.Collection, DevMacID(mac), ifVersion, ctx)
+	}
+	return nil
+}
+
+// TrashedDevices : devices in the trash, of the user when userid is not empty
+// result		: list of devices, wiped clean before planting results into it
+func (qd *qryDevices) TrashedDevices(userid string, result *[]Device, ctx context.Context) httperr.HttpErr {
+	*result = []Device{}
+	flt := bson.M{"trashedat": bson.M{"$ne": nil}}
+	if userid != "" {
+		flt["users.email"] = userid
+	}
+	cursor, err := qd.Find(ctx, flt, options.Find().SetSort(bson.M{"trashedat": -1}))
 	if err != nil {
 		return httperr.ErrDBQuery(err)
 	}
+	if err := cursor.All(ctx, result); err != nil {
+		return httperr.ErrBinding(err)
+	}
+	return nil
+}
+
+// RestoreDevice : brings the device back from the trash
+// Error when the device isnt in the trash
+func (qd *qryDevices) RestoreDevice(mac DevMacID, ctx context.Context) httperr.HttpErr {
+	ur, err := qd.UpdateOne(ctx, trashed(mac), bson.M{
+		"$unset": bson.M{"trashedat": "", "purgeat": ""},
+		"$inc":   bson.M{"version": 1},
+	})
+	if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	if ur.MatchedCount == 0 {
+		return httperr.ErrResourceNotFound(fmt.Errorf("device not in trash %s", mac))
+	}
+	return nil
+}
+
+// PurgeDevice : permanently deletes the device from the trash along with its config history and keys
+// Error when the device isnt in the trash, live devices have to be deleted first
+// Once purged data cannot be recovered.
+func (qd *qryDevices) PurgeDevice(mac DevMacID, ctx context.Context) httperr.HttpErr {
+	found := false
+	err := transact(ctx, qd.Database(), func(sc mongo.SessionContext) error {
+		dr, err := qd.DeleteOne(sc, trashed(mac))
+		if err != nil {
+			return err
+		}
+		if found = dr.DeletedCount > 0; !found {
+			return nil
+		}
+		for _, collc := range []string{"revisions", "apikeys", "signingkeys"} {
+			if _, err := qd.Database().Collection(collc).DeleteMany(sc, bson.M{"mac": mac}); err != nil {
+				return err
+			}
+		}
+		return supersedeOutbox(sc, qd.Database(), mac)
+	})
+	if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	if !found {
+		return httperr.ErrResourceNotFound(fmt.Errorf("device not in trash %s", mac))
+	}
+	return nil
+}
+
+// DueForPurge : devices in the trash whose purgeat is past the given time
+// result		: list of mac ids, wiped clean before planting results into it
+func (qd *qryDevices) DueForPurge(at time.Time, result *[]DevMacID, ctx context.Context) httperr.HttpErr {
+	*result = []DevMacID{}
+	cursor, err := qd.Find(ctx, bson.M{"trashedat": bson.M{"$ne": nil}, "purgeat": bson.M{"$lt": at}}, options.Find().SetProjection(bson.M{"mac": 1}))
+	if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	devs := []Device{}
+	if err := cursor.All(ctx, &devs); err != nil {
+		return httperr.ErrBinding(err)
+	}
+	for _, dev := range devs {
+		*result = append(*result, dev.MacID)
+	}
 	return nil
 }
 
@@ -95,7 +353,7 @@ func (qd *qryDevices) DevicesOfUser(userid string, ctx context.Context, result *
 		return httperr.ErrInvalidParam(fmt.Errorf("invalid user email as owner of the device %s", userid))
 	}
 	*result = []Device{} // instantiating a fresh slice
-	cursor, err := qd.Find(ctx, bson.M{"users": bson.M{"$elemMatch": bson.M{"$eq": userid}}})
+	cursor, err := qd.Find(ctx, bson.M{"users.email": userid, "trashedat": nil})
 	if err != nil {
 		return httperr.ErrDBQuery(err)
 	}
@@ -115,7 +373,7 @@ func (qd *qryDevices) PatchConfg(mac DevMacID, sched aquacfg.Schedule, ctx conte
 	if !sched.IsValid() {
 		return httperr.ErrInvalidParam(fmt.Errorf("invalid schedule for the device. Check schedule fields for rule violation"))
 	}
-	_, err := qd.UpdateOne(ctx, bson.M{"mac": mac}, bson.M{"$set": bson.M{"cfg": sched}})
+	_, err := qd.UpdateOne(ctx, live(mac), bson.M{"$set": bson.M{"cfg": sched}, "$inc": bson.M{"version": 1}})
 	if err != nil {
 		return httperr.ErrDBQuery(err)
 	}
@@ -123,19 +381,212 @@ func (qd *qryDevices) PatchConfg(mac DevMacID, sched aquacfg.Schedule, ctx conte
 }
 
 // AppendUsers:  patches (appends / replaces ) the list of legit users
-func (qd *qryDevices) AppendUsers(mac DevMacID, users []string, replace bool, ctx context.Context) httperr.HttpErr {
+// users already on the device (by email) arent appended again, nor are their roles changed - replace for that
+// Error when the users are invalid, the list replaced with has no owner, the device isnt found or has changed since ifVersion
+func (qd *qryDevices) AppendUsers(mac DevMacID, users []Membership, replace bool, ifVersion *int64, ctx context.Context) httperr.HttpErr {
 	if !mac.IsValid() {
 		return httperr.ErrInvalidParam(fmt.Errorf("invalid mac id %s for the device being patched", mac))
 	}
-	var patch bson.M
+	if !ValidMembers(users, replace) {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid users for the device %s, roles are owner / operator / viewer and atleast one is an owner", mac))
+	}
+	newUsers := interface{}(bson.M{"$literal": users})
 	if !replace {
-		patch = bson.M{"$addToSet": bson.M{"users": bson.M{"$each": users}}}
-	} else {
-		patch = bson.M{"$set": bson.M{"users": users}}
+		// of the users given, the ones whose email isnt on the device yet
+		newUsers = bson.M{"$concatArrays": []interface{}{"$users", bson.M{"$filter": bson.M{
+			"input": bson.M{"$literal": users},
+			"as":    "u",
+			"cond":  bson.M{"$not": []interface{}{bson.M{"$in": []interface{}{"$$u.email", "$users.email"}}}},
+		}}}}
+	}
+	patch := []bson.M{{"$set": bson.M{
+		"users":   newUsers,
+		"version": bson.M{"$add": []interface{}{bson.M{"$ifNull": []interface{}{"$version", 0}}, 1}},
+	}}}
+	ur, err := qd.UpdateOne(ctx, byVersion(mac, ifVersion), patch)
+	if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	if ur.MatchedCount == 0 {
+		return notMatched(qd.Collection, mac, ifVersion, ctx)
+	}
+	return nil
+}
+
+// SetEncKey : sets or clears the encryption key of the device, pushes queued from here on go by the new key
+// Error when the key isnt an X25519 public key, the device isnt found or has changed since ifVersion
+func (qd *qryDevices) SetEncKey(mac DevMacID, key []byte, ifVersion *int64, ctx context.Context) httperr.HttpErr {
+	if !mac.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid mac id %s for the device being patched", mac))
+	}
+	if !ValidEncKey(key) {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid encryption key for the device %s, has to be an X25519 public key of %d bytes", mac, cfgenc.KeySize))
 	}
-	_, err := qd.UpdateOne(ctx, bson.M{"mac": mac}, patch)
+	update := bson.M{"$set": bson.M{"enckey": key}, "$inc": bson.M{"version": 1}}
+	if len(key) == 0 {
+		update = bson.M{"$unset": bson.M{"enckey": ""}, "$inc": bson.M{"version": 1}}
+	}
+	ur, err := qd.UpdateOne(ctx, byVersion(mac, ifVersion), update)
 	if err != nil {
 		return httperr.ErrDBQuery(err)
 	}
+	if ur.MatchedCount == 0 {
+		return notMatched(qd.Collection, mac, ifVersion, ctx)
+	}
 	return nil
 }
+
+// SetPushStatus : updates the status of a config push on the device and its revision, given the message id of the push
+// Error when the device or the push (in one of the From statuses) isnt found, pushes older than the latest MaxPushes are dropped from the device
+func (qd *qryDevices) SetPushStatus(mac DevMacID, msgID string, upd PushUpdate, ctx context.Context) httperr.HttpErr {
+	match := bson.M{"msgid": msgID}
+	if len(upd.From) > 0 {
+		match["status"] = bson.M{"$in": upd.From}
+	}
+	ur, err := qd.UpdateOne(ctx, bson.M{"mac": mac, "pushes": bson.M{"$elemMatch": match}}, bson.M{
+		"$set": bson.M{"pushes.$.status": upd.Status, "pushes.$.reason": upd.Reason, "pushes.$.updatedat": time.Now()},
+	})
+	if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	if ur.MatchedCount == 0 {
+		return httperr.ErrResourceNotFound(fmt.Errorf("push %s not found on device %s", msgID, mac))
+	}
+	// revision that made the push follows the delivery status, pushes of the same config again have no revision
+	if _, err := qd.Database().Collection("revisions").UpdateOne(ctx, bson.M{"mac": mac, "msgid": msgID}, bson.M{"$set": bson.M{"delivery": upd.Status}}); err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	return nil
+}
+
+// ExpirePushes : pushes sent to the device and still pending since before the given time are marked expired
+// undelivered pushes are not expired, those are still being retried from the outbox
+// revisions that made the expired pushes are marked expired in the same transaction
+// returns the count of devices that had pushes expired
+func (qd *qryDevices) ExpirePushes(before time.Time, ctx context.Context) (int64, error) {
+	pending := bson.M{"status": PushPending, "updatedat": bson.M{"$lt": before}}
+	var count int64
+	err := transact(ctx, qd.Database(), func(sc mongo.SessionContext) error {
+		count = 0
+		cur, err := qd.Find(sc, bson.M{"pushes": bson.M{"$elemMatch": pending}}, options.Find().SetProjection(bson.M{"pushes": 1}))
+		if err != nil {
+			return err
+		}
+		devs := []Device{}
+		if err := cur.All(sc, &devs); err != nil {
+			return err
+		}
+		msgIDs := []string{}
+		for _, dev := range devs {
+			for _, p := range dev.Pushes {
+				if p.Status == PushPending && p.UpdatedAt.Before(before) {
+					msgIDs = append(msgIDs, p.MsgID)
+				}
+			}
+		}
+		if len(msgIDs) == 0 {
+			return nil
+		}
+		ur, err := qd.UpdateMany(sc, bson.M{"pushes": bson.M{"$elemMatch": pending}}, bson.M{
+			"$set": bson.M{"pushes.$[p].status": PushExpired, "pushes.$[p].updatedat": time.Now()},
+		}, options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{
+			bson.M{"p.status": PushPending, "p.updatedat": bson.M{"$lt": before}},
+		}}))
+		if err != nil {
+			return err
+		}
+		count = ur.ModifiedCount
+		_, err = qd.Database().Collection("revisions").UpdateMany(sc, bson.M{"msgid": bson.M{"$in": msgIDs}}, bson.M{"$set": bson.M{"delivery": PushExpired}})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Beat : records the heartbeat as the presence of the device
+// Error when the mac is invalid or the device isnt registered
+func (qd *qryDevices) Beat(hb Heartbeat, at time.Time, ctx context.Context) httperr.HttpErr {
+	if !hb.MacID.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid mac id %s for the heartbeat", hb.MacID))
+	}
+	ur, err := qd.UpdateOne(ctx, live(hb.MacID), bson.M{"$set": bson.M{"presence": Presence{
+		LastSeen: at,
+		Firmware: hb.Firmware,
+		Uptime:   hb.Uptime,
+		IP:       hb.IP,
+	}}})
+	if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	if ur.MatchedCount == 0 {
+		return httperr.ErrResourceNotFound(fmt.Errorf("device not found %s", hb.MacID))
+	}
+	return nil
+}
+
+// Report : records the config the device has applied
+// Error when the mac is invalid or the device isnt registered
+func (qd *qryDevices) Report(mac DevMacID, sched aquacfg.Schedule, at time.Time, ctx context.Context) httperr.HttpErr {
+	if !mac.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid mac id %s for the reported config", mac))
+	}
+	ur, err := qd.UpdateOne(ctx, live(mac), bson.M{"$set": bson.M{"reported": sched, "reportedat": at}})
+	if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	if ur.MatchedCount == 0 {
+		return httperr.ErrResourceNotFound(fmt.Errorf("device not found %s", mac))
+	}
+	return nil
+}
+
+// DriftedDevices : devices not in the trash that have reported atleast once, and the reported config isnt the desired one pushed before the given time
+func (qd *qryDevices) DriftedDevices(before time.Time, ctx context.Context) ([]Device, error) {
+	result := []Device{}
+	cursor, err := qd.Find(ctx, bson.M{
+		"trashedat": nil,
+		"reported":  bson.M{"$exists": true, "$ne": nil},
+		"cfgat":     bson.M{"$not": bson.M{"$gte": before}}, // devices registered before cfgat was recorded dont have it
+		"$expr":     bson.M{"$ne": []string{"$cfg", "$reported"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CountFleet : registered and online devices, and their pushes by status
+func (qd *qryDevices) CountFleet(onlineSince time.Time, ctx context.Context) (FleetCounts, error) {
+	counts := FleetCounts{Pushes: map[string]int64{}}
+	var err error
+	if counts.Registered, err = qd.CountDocuments(ctx, bson.M{"trashedat": nil}); err != nil {
+		return counts, err
+	}
+	if counts.Online, err = qd.CountDocuments(ctx, bson.M{"trashedat": nil, "presence.lastseen": bson.M{"$gte": onlineSince}}); err != nil {
+		return counts, err
+	}
+	cursor, err := qd.Aggregate(ctx, []bson.M{
+		{"$match": bson.M{"trashedat": nil}},
+		{"$unwind": "$pushes"},
+		{"$group": bson.M{"_id": "$pushes.status", "count": bson.M{"$sum": 1}}},
+	})
+	if err != nil {
+		return counts, err
+	}
+	byStatus := []struct {
+		Status string `bson:"_id"`
+		Count  int64  `bson:"count"`
+	}{}
+	if err := cursor.All(ctx, &byStatus); err != nil {
+		return counts, err
+	}
+	for _, bs := range byStatus {
+		counts.Pushes[bs.Status] = bs.Count
+	}
+	return counts, nil
+}
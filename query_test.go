@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"github.com/eensymachines-in/patio/aquacfg"
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/* Behaviour expected of any QueryDevices backend
+Each backend is run through the same suite, newStore gives an empty store for each test
+Mongo is run only when TEST_MONGO_URI is set, on a throwaway database dropped after */
+
+func TestQueryDevicesMemory(t *testing.T) {
+	runStoreSuites(t, func(t *testing.T) Stores {
+		ks := NewMemStore()
+		t.Cleanup(func() { ks.Close() })
+		return ks.Stores()
+	})
+}
+
+func TestQueryDevicesBolt(t *testing.T) {
+	runStoreSuites(t, func(t *testing.T) Stores {
+		ks, err := NewBoltStore(filepath.Join(t.TempDir(), "devicereg.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ks.Close() })
+		return ks.Stores()
+	})
+}
+
+// TestBoltMigrateUsers : users on a bolt file from before roles are made owners
+func TestBoltMigrateUsers(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "devicereg.db")
+	db, err := bolt.Open(fp, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sched := testSchedule()
+	legacy := bson.M{"_id": primitive.NewObjectID(), "mac": "b8:27:eb:a5:be:48", "users": []string{"niranjan@eensymachines.in"}, "cfg": &sched, "version": 1}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := boltMigrations[0](tx); err != nil {
+			return err
+		}
+		meta, _ := tx.CreateBucketIfNotExists([]byte(bktMeta))
+		if err := meta.Put([]byte("schema"), binary.BigEndian.AppendUint64(nil, 1)); err != nil {
+			return err
+		}
+		return putDoc(&boltTx{tx: tx}, bktDevices, "b8:27:eb:a5:be:48", legacy)
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := NewBoltStore(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+	devs := []Device{}
+	wantStatus(t, ks.DevicesOfUser("niranjan@eensymachines.in", context.Background(), &devs), 0)
+	if len(devs) != 1 || usersOf(devs[0].Users) != "[niranjan@eensymachines.in:owner]" || devs[0].Users[0].AddedAt.IsZero() {
+		t.Fatalf("users not migrated to owners %+v", devs)
+	}
+}
+
+func TestQueryDevicesMongo(t *testing.T) {
+	uri := os.Getenv("TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("TEST_MONGO_URI not set, skipping the suite on mongo")
+	}
+	runStoreSuites(t, func(t *testing.T) Stores {
+		pool, err := NewMongoPool(uri, fmt.Sprintf("devicereg_test_%d", time.Now().UnixNano()), MongoPoolOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			pool.Database().Drop(context.Background())
+			pool.Close(context.Background())
+		})
+		return MongoStores(pool.Database())
+	})
+}
+
+// runStoreSuites : suites of each of the stores a backend gives, on an empty backend for each test
+func runStoreSuites(t *testing.T, newStores func(t *testing.T) Stores) {
+	runQueryDevicesSuite(t, func(t *testing.T) QueryDevices { return newStores(t).Devices })
+	runPushTrackerSuite(t, newStores)
+	runShadowSuite(t, newStores)
+}
+
+func testSchedule() aquacfg.Schedule {
+	return aquacfg.Schedule{Config: aquacfg.TICK_EVERY, Interval: 100}
+}
+
+// testDevice : device with the users as its owners
+func testDevice(mac DevMacID, users ...string) *Device {
+	sched := testSchedule()
+	return &Device{Name: "aquarium", MacID: mac, Location: "18.5,73.8", Make: "rpi 3b", Users: owners(users...), Cfg: &sched}
+}
+
+func owners(emails ...string) []Membership {
+	users := []Membership{}
+	for _, email := range emails {
+		users = append(users, Membership{Email: email, Role: RoleOwner})
+	}
+	return users
+}
+
+// usersOf : email:role of each user, in order
+func usersOf(users []Membership) string {
+	list := []string{}
+	for _, m := range users {
+		list = append(list, m.Email+":"+m.Role)
+	}
+	return fmt.Sprint(list)
+}
+
+// wantStatus : fails the test unless err is of the http status, nil for no error
+func wantStatus(t *testing.T, err httperr.HttpErr, status int) {
+	t.Helper()
+	if status == 0 {
+		if err != nil {
+			t.Fatalf("unexpected error, status %d: %s", err.HttpStatusCode(), err.ClientErrData())
+		}
+		return
+	}
+	if err == nil {
+		t.Fatalf("expected error with status %d, got none", status)
+	}
+	if err.HttpStatusCode() != status {
+		t.Fatalf("expected error with status %d, got %d", status, err.HttpStatusCode())
+	}
+}
+
+func macsOf(devs []Device) []string {
+	macs := []string{}
+	for _, dev := range devs {
+		macs = append(macs, string(dev.MacID))
+	}
+	sort.Strings(macs)
+	return macs
+}
+
+func runQueryDevicesSuite(t *testing.T, newStore func(t *testing.T) QueryDevices) {
+	ctx := context.Background()
+	const mac = DevMacID("b8:27:eb:a5:be:48")
+
+	t.Run("GetOfId", func(t *testing.T) {
+		store := newStore(t)
+		got := Device{}
+		wantStatus(t, store.GetOfId(mac, &got, ctx), http.StatusNotFound)
+		wantStatus(t, store.AddNewDevice(testDevice(mac, "niranjan@eensymachines.in"), ctx), 0)
+		wantStatus(t, store.GetOfId(mac, &got, ctx), 0)
+		if got.MacID != mac || got.Name != "aquarium" || got.Cfg == nil || *got.Cfg != testSchedule() {
+			t.Fatalf("device not as registered %+v", got)
+		}
+		if got.ID.IsZero() {
+			t.Fatal("registered device has no id")
+		}
+	})
+
+	t.Run("AddNewDevice", func(t *testing.T) {
+		store := newStore(t)
+		dev := testDevice(mac, "niranjan@eensymachines.in")
+		dev.CfgRev, dev.Pushes = 7, []ConfigPush{{MsgID: "bogus"}}
+		wantStatus(t, store.AddNewDevice(dev, ctx), 0)
+		if dev.ID.IsZero() {
+			t.Fatal("id not set on the added device")
+		}
+		got := Device{}
+		wantStatus(t, store.GetOfId(mac, &got, ctx), 0)
+		if got.CfgRev != 0 || len(got.Pushes) != 0 || got.Version != 1 {
+			t.Fatalf("server fields sent along with the registration werent reset %+v", got)
+		}
+		// duplicate mac, even with the other fields different
+		wantStatus(t, store.AddNewDevice(testDevice(mac, "kneerunjun@gmail.com"), ctx), http.StatusBadRequest)
+		// trashed devices are duplicates too, till restored or purged
+		wantStatus(t, store.DeleteDevice(string(mac), nil, time.Hour, ctx), 0)
+		wantStatus(t, store.AddNewDevice(testDevice(mac, "niranjan@eensymachines.in"), ctx), http.StatusBadRequest)
+		wantStatus(t, store.PurgeDevice(mac, ctx), 0)
+		wantStatus(t, store.AddNewDevice(testDevice(mac, "niranjan@eensymachines.in"), ctx), 0)
+	})
+
+	t.Run("AddNewDevice/invalid", func(t *testing.T) {
+		store := newStore(t)
+		badSched := aquacfg.Schedule{Config: aquacfg.TICK_EVERY, Interval: 2}
+		for name, dev := range map[string]*Device{
+			"mac":      testDevice("b8:27:eb:a5:be", "niranjan@eensymachines.in"),
+			"no users": testDevice(mac),
+			"no cfg":   {MacID: mac, Users: owners("niranjan@eensymachines.in")},
+			"bad cfg":  {MacID: mac, Users: owners("niranjan@eensymachines.in"), Cfg: &badSched},
+			"no owner": {MacID: mac, Users: []Membership{{Email: "niranjan@eensymachines.in", Role: RoleOperator}}, Cfg: testDevice(mac).Cfg},
+			"bad role": {MacID: mac, Users: []Membership{{Email: "niranjan@eensymachines.in", Role: "admin"}}, Cfg: testDevice(mac).Cfg},
+			"dup user": {MacID: mac, Users: owners("niranjan@eensymachines.in", "niranjan@eensymachines.in"), Cfg: testDevice(mac).Cfg},
+		} {
+			t.Run(name, func(t *testing.T) {
+				wantStatus(t, store.AddNewDevice(dev, ctx), http.StatusBadRequest)
+			})
+		}
+		got := Device{}
+		wantStatus(t, store.GetOfId(mac, &got, ctx), http.StatusNotFound)
+	})
+
+	t.Run("DeleteDevice", func(t *testing.T) {
+		store := newStore(t)
+		wantStatus(t, store.DeleteDevice("b8:27:eb", nil, time.Hour, ctx), http.StatusBadRequest)
+		wantStatus(t, store.DeleteDevice(string(mac), nil, time.Hour, ctx), http.StatusNotFound)
+		wantStatus(t, store.AddNewDevice(testDevice(mac, "niranjan@eensymachines.in"), ctx), 0)
+		stale := int64(0)
+		wantStatus(t, store.DeleteDevice(string(mac), &stale, time.Hour, ctx), http.StatusPreconditionFailed)
+		current := int64(1)
+		wantStatus(t, store.DeleteDevice(string(mac), &current, time.Hour, ctx), 0)
+		got := Device{}
+		wantStatus(t, store.GetOfId(mac, &got, ctx), http.StatusNotFound)
+		wantStatus(t, store.DeleteDevice(string(mac), nil, time.Hour, ctx), http.StatusNotFound)
+	})
+
+	t.Run("Trash", func(t *testing.T) {
+		store := newStore(t)
+		wantStatus(t, store.AddNewDevice(testDevice(mac, "niranjan@eensymachines.in"), ctx), 0)
+		wantStatus(t, store.AddNewDevice(testDevice("b8:27:eb:a5:be:49", "kneerunjun@gmail.com"), ctx), 0)
+		wantStatus(t, store.RestoreDevice(mac, ctx), http.StatusNotFound)
+		wantStatus(t, store.PurgeDevice(mac, ctx), http.StatusNotFound)
+		wantStatus(t, store.DeleteDevice(string(mac), nil, time.Hour, ctx), 0)
+		wantStatus(t, store.DeleteDevice("b8:27:eb:a5:be:49", nil, time.Hour, ctx), 0)
+		trashed := []Device{}
+		wantStatus(t, store.TrashedDevices("", &trashed, ctx), 0)
+		if len(trashed) != 2 {
+			t.Fatalf("expected 2 devices in the trash, got %d", len(trashed))
+		}
+		wantStatus(t, store.TrashedDevices("niranjan@eensymachines.in", &trashed, ctx), 0)
+		if len(trashed) != 1 || trashed[0].MacID != mac || trashed[0].TrashAt == nil || trashed[0].PurgeAt == nil {
+			t.Fatalf("trashed devices of the user not as expected %+v", trashed)
+		}
+		due := []DevMacID{}
+		wantStatus(t, store.DueForPurge(time.Now(), &due, ctx), 0)
+		if len(due) != 0 {
+			t.Fatalf("devices due for purge before their time %v", due)
+		}
+		wantStatus(t, store.DueForPurge(time.Now().Add(2*time.Hour), &due, ctx), 0)
+		if len(due) != 2 {
+			t.Fatalf("expected 2 devices due for purge, got %v", due)
+		}
+		wantStatus(t, store.RestoreDevice(mac, ctx), 0)
+		got := Device{}
+		wantStatus(t, store.GetOfId(mac, &got, ctx), 0)
+		if got.TrashAt != nil || got.PurgeAt != nil {
+			t.Fatalf("restored device still marked trashed %+v", got)
+		}
+		wantStatus(t, store.PurgeDevice("b8:27:eb:a5:be:49", ctx), 0)
+		wantStatus(t, store.TrashedDevices("", &trashed, ctx), 0)
+		if len(trashed) != 0 {
+			t.Fatalf("expected empty trash, got %d", len(trashed))
+		}
+	})
+
+	t.Run("DevicesOfUser", func(t *testing.T) {
+		store := newStore(t)
+		result := []Device{}
+		wantStatus(t, store.DevicesOfUser("", ctx, &result), http.StatusBadRequest)
+		wantStatus(t, store.AddNewDevice(testDevice("b8:27:eb:a5:be:48", "niranjan@eensymachines.in"), ctx), 0)
+		wantStatus(t, store.AddNewDevice(testDevice("b8:27:eb:a5:be:49", "niranjan@eensymachines.in", "kneerunjun@gmail.com"), ctx), 0)
+		wantStatus(t, store.AddNewDevice(testDevice("b8:27:eb:a5:be:50", "kneerunjun@gmail.com"), ctx), 0)
+		wantStatus(t, store.DevicesOfUser("niranjan@eensymachines.in", ctx, &result), 0)
+		if got := macsOf(result); fmt.Sprint(got) != "[b8:27:eb:a5:be:48 b8:27:eb:a5:be:49]" {
+			t.Fatalf("devices of user not as expected %v", got)
+		}
+		wantStatus(t, store.DevicesOfUser("nobody@eensymachines.in", ctx, &result), 0)
+		if result == nil || len(result) != 0 {
+			t.Fatalf("expected empty list for unknown user, got %v", result)
+		}
+		// trashed devices arent listed
+		wantStatus(t, store.DeleteDevice("b8:27:eb:a5:be:49", nil, time.Hour, ctx), 0)
+		wantStatus(t, store.DevicesOfUser("kneerunjun@gmail.com", ctx, &result), 0)
+		if got := macsOf(result); fmt.Sprint(got) != "[b8:27:eb:a5:be:50]" {
+			t.Fatalf("devices of user not as expected %v", got)
+		}
+	})
+
+	t.Run("PatchConfg", func(t *testing.T) {
+		store := newStore(t)
+		wantStatus(t, store.AddNewDevice(testDevice(mac, "niranjan@eensymachines.in"), ctx), 0)
+		for name, sched := range map[string]aquacfg.Schedule{
+			"short interval":      {Config: aquacfg.TICK_EVERY, Interval: 5},
+			"pulse over interval": {Config: aquacfg.PULSE_EVERY, Interval: 20, PulseGap: 30},
+			"no time of day":      {Config: aquacfg.TICK_EVERY_DAYAT},
+		} {
+			t.Run(name, func(t *testing.T) {
+				wantStatus(t, store.PatchConfg(mac, sched, ctx), http.StatusBadRequest)
+			})
+		}
+		wantStatus(t, store.PatchConfg("b8:27:eb", testSchedule(), ctx), http.StatusBadRequest)
+		got := Device{}
+		wantStatus(t, store.GetOfId(mac, &got, ctx), 0)
+		if *got.Cfg != testSchedule() {
+			t.Fatalf("config changed by an invalid patch %+v", got.Cfg)
+		}
+		sched := aquacfg.Schedule{Config: aquacfg.TICK_EVERY, Interval: 300}
+		wantStatus(t, store.PatchConfg(mac, sched, ctx), 0)
+		wantStatus(t, store.GetOfId(mac, &got, ctx), 0)
+		if *got.Cfg != sched || got.Version != 2 {
+			t.Fatalf("config not patched %+v version %d", got.Cfg, got.Version)
+		}
+	})
+
+	t.Run("AppendUsers", func(t *testing.T) {
+		store := newStore(t)
+		wantStatus(t, store.AppendUsers("b8:27:eb", owners("kneerunjun@gmail.com"), false, nil, ctx), http.StatusBadRequest)
+		wantStatus(t, store.AppendUsers(mac, owners("kneerunjun@gmail.com"), false, nil, ctx), http.StatusNotFound)
+		wantStatus(t, store.AddNewDevice(testDevice(mac, "niranjan@eensymachines.in"), ctx), 0)
+		got := Device{}
+		// append adds only the users not already there, roles of those there stay as they are
+		wantStatus(t, store.AppendUsers(mac, []Membership{
+			{Email: "niranjan@eensymachines.in", Role: RoleViewer},
+			{Email: "kneerunjun@gmail.com", Role: RoleOperator},
+		}, false, nil, ctx), 0)
+		wantStatus(t, store.GetOfId(mac, &got, ctx), 0)
+		if usersOf(got.Users) != "[niranjan@eensymachines.in:owner kneerunjun@gmail.com:operator]" {
+			t.Fatalf("users not appended as a set %v", got.Users)
+		}
+		wantStatus(t, store.AppendUsers(mac, owners("kneerunjun@gmail.com", "kneerunjun@gmail.com"), false, nil, ctx), http.StatusBadRequest)
+		wantStatus(t, store.AppendUsers(mac, []Membership{{Email: "kneerunjun@gmail.com", Role: "admin"}}, false, nil, ctx), http.StatusBadRequest)
+		// replace sets the list as is, never without an owner
+		wantStatus(t, store.AppendUsers(mac, []Membership{{Email: "aquaponics@eensymachines.in", Role: RoleOperator}}, true, nil, ctx), http.StatusBadRequest)
+		wantStatus(t, store.AppendUsers(mac, owners("aquaponics@eensymachines.in"), true, nil, ctx), 0)
+		wantStatus(t, store.GetOfId(mac, &got, ctx), 0)
+		if usersOf(got.Users) != "[aquaponics@eensymachines.in:owner]" {
+			t.Fatalf("users not replaced %v", got.Users)
+		}
+		// changes only at the version the caller has seen
+		stale := got.Version - 1
+		wantStatus(t, store.AppendUsers(mac, owners("kneerunjun@gmail.com"), false, &stale, ctx), http.StatusPreconditionFailed)
+		wantStatus(t, store.AppendUsers(mac, owners("kneerunjun@gmail.com"), false, &got.Version, ctx), 0)
+		wantStatus(t, store.GetOfId(mac, &got, ctx), 0)
+		if usersOf(got.Users) != "[aquaponics@eensymachines.in:owner kneerunjun@gmail.com:owner]" || got.Version != 4 {
+			t.Fatalf("users not appended at version %v %d", got.Users, got.Version)
+		}
+	})
+}
+
+// runPushTrackerSuite : status of the pushes on the device as acked / nacked by it or expired, followed by the revision that made the push
+func runPushTrackerSuite(t *testing.T, newStores func(t *testing.T) Stores) {
+	ctx := context.Background()
+	mac := DevMacID("b8:27:eb:a5:be:48")
+	other := DevMacID("b8:27:eb:a5:be:49")
+	// push : config changed on the device, its push as queued on the outbox
+	push := func(t *testing.T, stores Stores, mac DevMacID, tickAt string) string {
+		t.Helper()
+		sched := testSchedule()
+		sched.TickAt = tickAt
+		msg, err := stores.Outbox.PatchConfgOutbox(mac, sched, CfgChange{By: "kneerunjun@gmail.com"}, time.Minute, ctx)
+		wantStatus(t, err, 0)
+		return msg.ID.Hex()
+	}
+	// statusOf : status of the push on the device and delivery on its revision
+	statusOf := func(t *testing.T, stores Stores, mac DevMacID, msgID string) (string, string) {
+		t.Helper()
+		dev := Device{}
+		wantStatus(t, stores.Devices.GetOfId(mac, &dev, ctx), 0)
+		status := ""
+		for _, p := range dev.Pushes {
+			if p.MsgID == msgID {
+				status = p.Status
+			}
+		}
+		revs := []CfgRevision{}
+		wantStatus(t, stores.Revisions.Revisions(mac, &revs, ctx), 0)
+		for _, rev := range revs {
+			if rev.MsgID == msgID {
+				return status, rev.Delivery
+			}
+		}
+		return status, ""
+	}
+
+	t.Run("SetPushStatus", func(t *testing.T) {
+		stores := newStores(t)
+		wantStatus(t, stores.Devices.AddNewDevice(testDevice(mac, "kneerunjun@gmail.com"), ctx), 0)
+		wantStatus(t, stores.Devices.AddNewDevice(testDevice(other, "kneerunjun@gmail.com"), ctx), 0)
+		acked, nacked := push(t, stores, mac, "05:00"), push(t, stores, mac, "06:00")
+		if status, delivery := statusOf(t, stores, mac, acked); status != PushPending || delivery != PushPending {
+			t.Fatalf("queued push, expected pending got %s / %s", status, delivery)
+		}
+		wantStatus(t, stores.Pushes.SetPushStatus(mac, acked, PushUpdate{Status: PushAcked}, ctx), 0)
+		wantStatus(t, stores.Pushes.SetPushStatus(mac, nacked, PushUpdate{Status: PushNacked}, ctx), 0)
+		if status, delivery := statusOf(t, stores, mac, acked); status != PushAcked || delivery != PushAcked {
+			t.Errorf("expected acked got %s / %s", status, delivery)
+		}
+		if status, delivery := statusOf(t, stores, mac, nacked); status != PushNacked || delivery != PushNacked {
+			t.Errorf("expected nacked got %s / %s", status, delivery)
+		}
+		// only from the statuses given, on the device the push is of
+		wantStatus(t, stores.Pushes.SetPushStatus(mac, acked, PushUpdate{Status: PushUndelivered, From: []string{PushPending}}, ctx), http.StatusNotFound)
+		wantStatus(t, stores.Pushes.SetPushStatus(other, acked, PushUpdate{Status: PushNacked}, ctx), http.StatusNotFound)
+		wantStatus(t, stores.Pushes.SetPushStatus(mac, primitive.NewObjectID().Hex(), PushUpdate{Status: PushAcked}, ctx), http.StatusNotFound)
+		if status, delivery := statusOf(t, stores, mac, acked); status != PushAcked || delivery != PushAcked {
+			t.Errorf("push changed by a status not applied, got %s / %s", status, delivery)
+		}
+	})
+	t.Run("ExpirePushes", func(t *testing.T) {
+		stores := newStores(t)
+		wantStatus(t, stores.Devices.AddNewDevice(testDevice(mac, "kneerunjun@gmail.com"), ctx), 0)
+		wantStatus(t, stores.Devices.AddNewDevice(testDevice(other, "kneerunjun@gmail.com"), ctx), 0)
+		acked, pending, ofOther := push(t, stores, mac, "05:00"), push(t, stores, mac, "06:00"), push(t, stores, other, "05:00")
+		wantStatus(t, stores.Pushes.SetPushStatus(mac, acked, PushUpdate{Status: PushAcked}, ctx), 0)
+		if n, err := stores.Pushes.ExpirePushes(time.Now().Add(-time.Minute), ctx); err != nil || n != 0 {
+			t.Fatalf("pushes expired before their time %d %v", n, err)
+		}
+		n, err := stores.Pushes.ExpirePushes(time.Now().Add(time.Minute), ctx)
+		if err != nil || n != 2 {
+			t.Fatalf("expected pushes on 2 devices expired, got %d %v", n, err)
+		}
+		for msgID, want := range map[string]string{acked: PushAcked, pending: PushExpired} {
+			if status, delivery := statusOf(t, stores, mac, msgID); status != want || delivery != want {
+				t.Errorf("push %s, expected %s got %s / %s", msgID, want, status, delivery)
+			}
+		}
+		if status, delivery := statusOf(t, stores, other, ofOther); status != PushExpired || delivery != PushExpired {
+			t.Errorf("push on the other device, expected expired got %s / %s", status, delivery)
+		}
+		if n, _ := stores.Pushes.ExpirePushes(time.Now().Add(time.Minute), ctx); n != 0 {
+			t.Errorf("expired pushes expired again on %d devices", n)
+		}
+	})
+}
+
+// runShadowSuite : devices whose reported config hasnt caught up with the desired one pushed a while back
+func runShadowSuite(t *testing.T, newStores func(t *testing.T) Stores) {
+	ctx := context.Background()
+	t.Run("DriftedDevices", func(t *testing.T) {
+		stores := newStores(t)
+		desired, other := testSchedule(), testSchedule()
+		other.Interval = 200
+		macs := map[string]DevMacID{
+			"drifted":  "b8:27:eb:a5:be:41",
+			"in sync":  "b8:27:eb:a5:be:42",
+			"silent":   "b8:27:eb:a5:be:43", // never reported
+			"trashed":  "b8:27:eb:a5:be:44",
+			"repushed": "b8:27:eb:a5:be:45",
+		}
+		for what, mac := range macs {
+			wantStatus(t, stores.Devices.AddNewDevice(testDevice(mac, "kneerunjun@gmail.com"), ctx), 0)
+			reported := other
+			if what == "in sync" {
+				reported = desired
+			}
+			if what != "silent" {
+				wantStatus(t, stores.Shadows.Report(mac, reported, time.Now(), ctx), 0)
+			}
+		}
+		wantStatus(t, stores.Devices.DeleteDevice(string(macs["trashed"]), nil, time.Hour, ctx), 0)
+		time.Sleep(10 * time.Millisecond)
+		before := time.Now()
+		time.Sleep(10 * time.Millisecond)
+		// pushing the desired config again resets the drift clock
+		if _, err := stores.Outbox.RepushConfg(macs["repushed"], time.Minute, ctx); err != nil {
+			t.Fatal(err)
+		}
+		drifted, err := stores.Shadows.DriftedDevices(before, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(macsOf(drifted)); got != fmt.Sprint([]string{string(macs["drifted"])}) {
+			t.Fatalf("expected only the drifted device, got %s", got)
+		}
+		if drifted[0].Reported == nil || drifted[0].Reported.Interval != 200 {
+			t.Errorf("drifted device without its reported config %+v", drifted[0].Reported)
+		}
+		if drifted, _ := stores.Shadows.DriftedDevices(before.Add(-time.Hour), ctx); len(drifted) != 0 {
+			t.Errorf("devices drifted before their config was pushed %v", macsOf(drifted))
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestRequestID(t *testing.T) {
+	newCfg := gin.H{"tickat": "05:00", "config": 1, "interval": 60, "pulsegap": 1800}
+	path := "/api/devices/" + string(test200MacID) + "?path=config&action=replace"
+
+	t.Run("carried to the push", func(t *testing.T) {
+		ts := newTestServer(t)
+		ts.register(t, test200MacID)
+		rec := ts.do("PATCH", path, newCfg, RequestIDHeader, "req-4f1c.9")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get(RequestIDHeader); got != "req-4f1c.9" {
+			t.Errorf("expected the request id sent back, got %s", got)
+		}
+		msg := ts.pub.msgs[len(ts.pub.msgs)-1]
+		if msg.CorrelationId != "req-4f1c.9" || msg.Headers["x-request-id"] != "req-4f1c.9" {
+			t.Errorf("request id not on the push: correlation %s, headers %v", msg.CorrelationId, msg.Headers)
+		}
+		if msg.MessageId == "" || msg.MessageId == msg.CorrelationId {
+			t.Errorf("message id should stay that of the outbox message, got %s", msg.MessageId)
+		}
+	})
+	t.Run("generated", func(t *testing.T) {
+		ts := newTestServer(t)
+		hex := regexp.MustCompile(`^[0-9a-f]{32}$`)
+		for _, sent := range []string{"", "has spaces in it", "a\nb"} {
+			rec := ts.do("GET", "/api/devices/"+string(test404MacID), nil, RequestIDHeader, sent)
+			if got := rec.Header().Get(RequestIDHeader); !hex.MatchString(got) {
+				t.Errorf("expected a generated id for %q, got %q", sent, got)
+			}
+		}
+	})
+	t.Run("on the log entries", func(t *testing.T) {
+		hook := test.NewGlobal()
+		defer log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+		ts := newTestServer(t)
+		ts.do("GET", "/api/devices/"+string(test404MacID), nil, RequestIDHeader, "trace-me")
+		entries := hook.AllEntries()
+		if len(entries) == 0 {
+			t.Fatal("nothing logged for the request")
+		}
+		for _, entry := range entries {
+			if entry.Data["reqid"] != "trace-me" {
+				t.Errorf("log entry %q without the request id", entry.Message)
+			}
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	RevisionsCollc = func(db *mongo.Database) RevisionStore {
+		return &qryRevisions{Collection: db.Collection("revisions")}
+	}
+)
+
+// RevisionStore : history of the config changes on the devices
+// revisions are written along with the config change, see ConfigOutbox
+type RevisionStore interface {
+	Revisions(mac DevMacID, result *[]CfgRevision, ctx context.Context) httperr.HttpErr
+	RevisionOf(mac DevMacID, rev int, result *CfgRevision, ctx context.Context) httperr.HttpErr
+}
+
+type qryRevisions struct {
+	*mongo.Collection
+}
+
+// Revisions : all the revisions of the device config, latest first
+// result		: list of revisions, wiped clean before planting results into it
+func (qr *qryRevisions) Revisions(mac DevMacID, result *[]CfgRevision, ctx context.Context) httperr.HttpErr {
+	if !mac.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid mac id %s for revisions", mac))
+	}
+	*result = []CfgRevision{}
+	cursor, err := qr.Find(ctx, bson.M{"mac": mac}, options.Find().SetSort(bson.M{"rev": -1}))
+	if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	if err := cursor.All(ctx, result); err != nil {
+		return httperr.ErrBinding(err)
+	}
+	return nil
+}
+
+// RevisionOf : single revision of the device config
+// Errors when the revision isnt found
+func (qr *qryRevisions) RevisionOf(mac DevMacID, rev int, result *CfgRevision, ctx context.Context) httperr.HttpErr {
+	*result = CfgRevision{}
+	sr := qr.FindOne(ctx, bson.M{"mac": mac, "rev": rev})
+	if sr.Err() != nil {
+		if errors.Is(sr.Err(), mongo.ErrNoDocuments) {
+			return httperr.ErrResourceNotFound(fmt.Errorf("revision %d not found for device %s", rev, mac))
+		}
+		return httperr.ErrDBQuery(sr.Err())
+	}
+	if err := sr.Decode(result); err != nil {
+		return httperr.ErrBinding(err)
+	}
+	return nil
+}
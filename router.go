@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/eensymachines-in/utilities"
+	"github.com/gin-gonic/gin"
+)
+
+// NewRouter : routes of the api over the handlers of the app
+func NewRouter(app *App) *gin.Engine {
+	r := gin.New()
+	r.Use(gin.Recovery(), RequestID, AccessLog, Metered, Traced)
+
+	// Probes for kubernetes and the status of the dependencies
+	r.GET("/healthz", app.HndlHealthz)
+	r.GET("/readyz", app.HndlReadyz)
+	r.GET("/status", app.HndlStatus)
+	r.GET("/metrics", app.HndlMetrics)
+
+	// Every device route needs a bearer token, the user of the token has to be on the device
+	// api keys of a device (X-API-Key) are good only on the routes of that device
+	devices := r.Group("/api/devices").Use(utilities.CORS, ExposeHeaders, app.Authenticated)
+
+	// Posting a new device registrations
+	// Getting a list of devices filtered on a field
+	devices.OPTIONS("", utilities.Preflight)
+	devices.POST("", UsersOnly, app.HndlLstDvcs)
+	devices.GET("", UsersOnly, app.HndlLstDvcs) //?filter=users&status=online, devices of the user of the token
+
+	devices.OPTIONS("/:deviceid", utilities.Preflight)
+	// Getting a single device details , either on mac or mongo oid
+	devices.GET("/:deviceid", app.DeviceOfID, app.HndlOneDvc)
+	// Patching device details  - config or users
+	// ?path=users&action=append
+	// ?path=config
+	devices.PATCH("/:deviceid", app.DeviceOfID, app.HndlOneDvc)
+	// Removing a device registration, device is moved to the trash
+	devices.DELETE("/:deviceid", app.DeviceOfID, app.HndlOneDvc)
+	// Trashed devices, restoring one or purging it for good
+	devices.GET("/trash", UsersOnly, app.HndlTrash) // of the user of the token
+	devices.POST("/trash/:deviceid/restore", UsersOnly, app.HndlTrash)
+	devices.DELETE("/trash/:deviceid", UsersOnly, app.HndlTrash)
+	// Api keys of the device, issuing, rotating and revoking - by the owners
+	devices.GET("/:deviceid/keys", UsersOnly, app.DeviceOfID, app.HndlApiKeys)
+	devices.POST("/:deviceid/keys", UsersOnly, app.DeviceOfID, app.HndlApiKeys)
+	devices.POST("/:deviceid/keys/:keyid/rotate", UsersOnly, app.DeviceOfID, app.HndlApiKeys)
+	devices.DELETE("/:deviceid/keys/:keyid", UsersOnly, app.DeviceOfID, app.HndlApiKeys)
+	// Keys the config pushes to the device are signed with - by the owners
+	devices.GET("/:deviceid/signingkeys", UsersOnly, app.DeviceOfID, app.HndlSigningKeys)
+	devices.POST("/:deviceid/signingkeys", UsersOnly, app.DeviceOfID, app.HndlSigningKeys)
+	devices.DELETE("/:deviceid/signingkeys/:keyid", UsersOnly, app.DeviceOfID, app.HndlSigningKeys)
+	// Heartbeat from the device when it cannot reach the broker
+	devices.POST("/:deviceid/heartbeat", Reporting, app.DeviceOfID, app.HndlHeartbeat)
+	// Desired vs reported config, device reports the config it has applied
+	devices.GET("/:deviceid/shadow", app.DeviceOfID, app.HndlShadow)
+	devices.POST("/:deviceid/reported", Reporting, app.DeviceOfID, app.HndlShadow)
+	// Config history, diff of 2 revisions and rolling back to one
+	// /revisions/diff?from=2&to=5
+	devices.GET("/:deviceid/revisions", app.DeviceOfID, app.HndlRevisions)
+	devices.GET("/:deviceid/revisions/diff", app.DeviceOfID, app.HndlRevisions)
+	devices.POST("/:deviceid/revisions/:rev/rollback", app.DeviceOfID, app.HndlRollback)
+	return r
+}
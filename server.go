@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServerOpt : dependencies handed to the server instead of the ones it would make from the config
+type ServerOpt func(*Server)
+
+// WithStores : server runs on the stores given, the caller closes them
+func WithStores(stores Stores) ServerOpt {
+	return func(srv *Server) {
+		srv.stores = &stores
+	}
+}
+
+// WithPublisher : config pushes go out on the publisher given, the caller closes it
+func WithPublisher(pub CfgPublisher) ServerOpt {
+	return func(srv *Server) {
+		srv.pub = pub
+	}
+}
+
+// Server : the api with all its dependencies, made from the config
+// Nothing here exits the process, errors are returned for the caller to decide on
+type Server struct {
+	cfg    Config
+	stores *Stores
+	pub    CfgPublisher
+
+	App      *App
+	Mongo    *MongoPool    // nil when not on mongo
+	Consumer *AmqpConsumer // nil when there is no amqp uri
+	Router   *gin.Engine
+
+	closers  []func() // dependencies the server made and has to close, in the order made
+	http     *http.Server
+	listener net.Listener
+	served   chan error
+	downOnce sync.Once
+}
+
+// NewServer : connects the store and broker as per the config, unless given as options, and wires up the app
+// Errors when a dependency cannot be made, anything made till then is closed
+func NewServer(cfg Config, opts ...ServerOpt) (*Server, error) {
+	srv := &Server{cfg: cfg, served: make(chan error, 1)}
+	for _, opt := range opts {
+		opt(srv)
+	}
+	if cfg.GinMode != "" {
+		gin.SetMode(cfg.GinMode)
+	}
+	// tracing is closed last, flushing the spans of everything closed before it
+	shutdownTracing, err := NewTracing(cfg.Trace)
+	if err != nil {
+		return nil, err
+	}
+	srv.closers = append(srv.closers, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownTracing(ctx)
+	})
+	auth, err := NewAuthenticator(cfg.Auth)
+	if err != nil {
+		srv.close()
+		return nil, err
+	}
+	if srv.stores == nil {
+		if err := srv.openStores(); err != nil {
+			srv.close()
+			return nil, err
+		}
+	}
+	if srv.pub == nil {
+		if cfg.AmqpURI == "" {
+			srv.close()
+			return nil, fmt.Errorf("empty amqp uri and no publisher given")
+		}
+		pub := NewAmqpPublisher(cfg.AmqpURI, cfg.Publisher)
+		srv.closers = append(srv.closers, pub.Close)
+		srv.pub = pub
+	}
+	if cfg.App.Relay.PublishTimeout == 0 && cfg.Publisher.ConfirmTimeout > 0 {
+		// a delivery waits for the broker's confirmation and then marks the outbox
+		cfg.App.Relay.PublishTimeout = cfg.Publisher.ConfirmTimeout + 2*time.Second
+	}
+	srv.App = NewApp(srv.Mongo, *srv.stores, srv.pub, cfg.App)
+	srv.App.Auth = auth
+	srv.closers = append(srv.closers, srv.App.Close)
+	if cfg.AmqpURI != "" {
+		srv.Consumer = NewAmqpConsumer(cfg.AmqpURI, ConsumerOpts{}, srv.App.Subscriptions()...)
+		// acks, heartbeats and reports are late while its down, the api can still serve
+		srv.App.Health.Watch("amqp-consumer", srv.Consumer, false)
+		srv.closers = append(srv.closers, srv.Consumer.Close)
+	}
+	srv.Router = NewRouter(srv.App)
+	srv.http = &http.Server{Addr: cfg.Listen, Handler: srv.Router}
+	return srv, nil
+}
+
+// openStores : stores on the backend in the config
+func (srv *Server) openStores() error {
+	var stores Stores
+	switch srv.cfg.Store {
+	case "memory":
+		mem := NewMemStore()
+		srv.closers = append(srv.closers, func() { mem.Close() })
+		stores = mem.Stores()
+		log.Warn("running on in memory store, nothing is saved")
+	case "bolt":
+		bs, err := NewBoltStore(srv.cfg.BoltPath)
+		if err != nil {
+			return err
+		}
+		srv.closers = append(srv.closers, func() { bs.Close() })
+		stores = bs.Stores()
+		log.WithFields(log.Fields{
+			"path": srv.cfg.BoltPath,
+		}).Info("running on bolt store")
+	case "mongo":
+		pool, err := NewMongoPool(srv.cfg.MongoURI, srv.cfg.MongoDB, srv.cfg.Mongo)
+		if err != nil {
+			return err
+		}
+		srv.closers = append(srv.closers, func() { pool.Close(context.Background()) })
+		log.Info("database is reachable..")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := OutboxIndexes(pool.Database(), ctx); err != nil {
+			log.Warnf("failed to create outbox indexes, %s", err)
+		}
+		if err := DeviceIndexes(pool.Database(), ctx); err != nil {
+			log.Warnf("failed to create device indexes, %s", err)
+		}
+		if err := ApiKeyIndexes(pool.Database(), ctx); err != nil {
+			log.Warnf("failed to create api key indexes, %s", err)
+		}
+		if err := SigningKeyIndexes(pool.Database(), ctx); err != nil {
+			log.Warnf("failed to create signing key indexes, %s", err)
+		}
+		if count, err := MigrateDeviceUsers(pool.Database(), ctx); err != nil {
+			log.Warnf("failed to migrate device users to roles, %s", err)
+		} else if count > 0 {
+			log.WithFields(log.Fields{
+				"devices": count,
+			}).Info("device users migrated to owners")
+		}
+		srv.Mongo = pool
+		stores = MongoStores(pool.Database())
+	default:
+		return fmt.Errorf("invalid store backend %s", srv.cfg.Store)
+	}
+	srv.stores = &stores
+	return nil
+}
+
+// Start : listens on the address in the config and serves in the background
+// Errors when the address cannot be listened on, errors from serving thereafter come out of Wait
+func (srv *Server) Start() error {
+	ln, err := net.Listen("tcp", srv.http.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", srv.http.Addr, err)
+	}
+	srv.listener = ln
+	log.WithFields(log.Fields{
+		"addr": ln.Addr().String(),
+	}).Info("serving webapi-devicereg")
+	go func() {
+		err := srv.http.Serve(ln)
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+		srv.served <- err
+	}()
+	return nil
+}
+
+// Addr : address the server is listening on, of use when the config had port 0
+func (srv *Server) Addr() string {
+	if srv.listener == nil {
+		return srv.http.Addr
+	}
+	return srv.listener.Addr().String()
+}
+
+// Wait : blocks till the server stops serving, nil when it was shut down
+func (srv *Server) Wait() error {
+	return <-srv.served
+}
+
+// Shutdown : stops taking requests and waits for the ones in hand till ctx is done
+// then closes the app and the dependencies the server made, not the ones given as options
+// consumer goes first so no more acks come in, then the relay, the publisher after its publishes in flight and the store last
+func (srv *Server) Shutdown(ctx context.Context) error {
+	err := srv.http.Shutdown(ctx)
+	srv.close()
+	log.Info("server shut down")
+	return err
+}
+
+// close : closes the dependencies in the reverse order of making them
+func (srv *Server) close() {
+	srv.downOnce.Do(func() {
+		for i := len(srv.closers) - 1; i >= 0; i-- {
+			srv.closers[i]()
+		}
+	})
+}
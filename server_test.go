@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowPublisher : publish blocks till released, as when waiting on the broker's confirmation
+type slowPublisher struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (sp *slowPublisher) Publish(ctx context.Context, mac DevMacID, payload []byte, opts ...PubOpt) error {
+	sp.entered <- struct{}{}
+	<-sp.release
+	return nil
+}
+
+// startTestServer : server on a random port over an in memory store and the publisher given
+func startTestServer(t *testing.T, pub CfgPublisher) *Server {
+	t.Helper()
+	store := NewMemStore()
+	t.Cleanup(func() { store.Close() })
+	cfg := DefaultConfig()
+	cfg.Listen = "127.0.0.1:0"
+	cfg.GinMode = "test"
+	cfg.App.Relay.PollEvery = time.Hour
+	cfg.Auth.Secret = testJWTSecret
+	srv, err := NewServer(cfg, WithStores(store.Stores()), WithPublisher(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func TestServerStartShutdown(t *testing.T) {
+	srv := startTestServer(t, &fakePublisher{})
+	if srv.Consumer != nil {
+		t.Error("consumer made without an amqp uri")
+	}
+	req, _ := http.NewRequest("GET", "http://"+srv.Addr()+"/api/devices/5a:6b:7c:8d:9e:af", nil)
+	req.Header.Set("Authorization", bearer(testUser))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for a device not registered, got %d", resp.StatusCode)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Wait(); err != nil {
+		t.Errorf("expected nil from Wait after Shutdown, got %s", err)
+	}
+}
+
+// TestShutdownDrains : config push waiting on the broker when shutdown begins gets to finish and respond
+func TestShutdownDrains(t *testing.T) {
+	pub := &slowPublisher{entered: make(chan struct{}), release: make(chan struct{})}
+	srv := startTestServer(t, pub)
+	base := "http://" + srv.Addr() + "/api/devices"
+	ts := &testServer{router: srv.Router}
+	if rec := ts.do("POST", "/api/devices", registration(test200MacID)); rec.Code != http.StatusOK {
+		t.Fatalf("failed to register device: %d %s", rec.Code, rec.Body)
+	}
+
+	patched := make(chan int, 1)
+	go func() {
+		body := `{"tickat": "05:00", "config": 1, "interval": 60, "pulsegap": 1800}`
+		req, _ := http.NewRequest("PATCH", base+"/"+string(test200MacID)+"?path=config&action=replace", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", bearer(testUser))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			patched <- 0
+			return
+		}
+		resp.Body.Close()
+		patched <- resp.StatusCode
+	}()
+	<-pub.entered
+
+	shut := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shut <- srv.Shutdown(ctx)
+	}()
+	select {
+	case <-shut:
+		t.Fatal("shutdown did not wait for the push in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(pub.release)
+	if code := <-patched; code != http.StatusOK {
+		t.Errorf("expected the push in flight to complete with 200, got %d", code)
+	}
+	if err := <-shut; err != nil {
+		t.Errorf("expected clean shutdown, got %s", err)
+	}
+	if _, err := http.Get(base); err == nil {
+		t.Error("server still taking requests after shutdown")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"github.com/eensymachines-in/patio/aquacfg"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// ShadowOpts : where the devices report their applied config and how soon a drift is reconciled
+type ShadowOpts struct {
+	Exchange       string        // fanout exchange devices publish CfgReport on
+	Queue          string        // durable queue the registry consumes reports from, shared across replicas
+	DriftAfter     time.Duration // desired config is pushed again if the device hasnt reported it within this
+	ReconcileEvery time.Duration // interval at which the devices are checked for drift
+}
+
+func (opts *ShadowOpts) defaults() {
+	if opts.Exchange == "" {
+		opts.Exchange = "configs_reported"
+	}
+	if opts.Queue == "" {
+		opts.Queue = "devicereg_reported"
+	}
+	if opts.DriftAfter == 0 {
+		opts.DriftAfter = 5 * time.Minute
+	}
+	if opts.ReconcileEvery == 0 {
+		opts.ReconcileEvery = time.Minute
+	}
+}
+
+// Shadows : ingests the config reported by the devices and reconciles them with the desired config
+// Devices that stay out of sync longer than DriftAfter have their desired config pushed again through the outbox
+type Shadows struct {
+	store  ShadowStore
+	outbox ConfigOutbox
+	opts   ShadowOpts
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewShadows : starts the reconciliation loop, reports are received through the Subscription
+func NewShadows(store ShadowStore, outbox ConfigOutbox, opts ShadowOpts) *Shadows {
+	opts.defaults()
+	sh := &Shadows{
+		store:  store,
+		outbox: outbox,
+		opts:   opts,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go sh.run()
+	return sh
+}
+
+// Report : records the config applied by the device as of now
+func (sh *Shadows) Report(mac DevMacID, sched aquacfg.Schedule, ctx context.Context) httperr.HttpErr {
+	return sh.store.Report(mac, sched, time.Now(), ctx)
+}
+
+// Subscription : consumes CfgReport from the devices on the reported exchange
+func (sh *Shadows) Subscription() Subscription {
+	return Subscription{
+		Name: "reported",
+		Setup: func(ch *amqp.Channel) (string, error) {
+			if err := ch.ExchangeDeclare(sh.opts.Exchange, "fanout", true, false, false, false, nil); err != nil {
+				return "", err
+			}
+			q, err := ch.QueueDeclare(sh.opts.Queue, true, false, false, false, nil)
+			if err != nil {
+				return "", err
+			}
+			return q.Name, ch.QueueBind(q.Name, "", sh.opts.Exchange, false, nil)
+		},
+		Handle: func(d amqp.Delivery) error {
+			rpt := CfgReport{}
+			if err := json.Unmarshal(d.Body, &rpt); err != nil {
+				return fmt.Errorf("invalid config report payload %s", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := sh.Report(rpt.MacID, rpt.Cfg, ctx); err != nil {
+				return fmt.Errorf("failed to record reported config, %v", err)
+			}
+			return nil
+		},
+	}
+}
+
+// reconcile : pushes the desired config again to all the devices that have drifted
+// pushing through the outbox also resets the drift clock on the device
+func (sh *Shadows) reconcile() {
+	ctx, cancel := context.WithTimeout(context.Background(), sh.opts.ReconcileEvery)
+	defer cancel()
+	drifted, err := sh.store.DriftedDevices(time.Now().Add(-sh.opts.DriftAfter), ctx)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to get devices with drifted config")
+		return
+	}
+	for _, dev := range drifted {
+		if dev.Cfg == nil {
+			continue
+		}
+		if _, err := sh.outbox.RepushConfg(dev.MacID, 0, ctx); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"mac": dev.MacID,
+			}).Error("failed to push desired config again")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"mac":   dev.MacID,
+			"delta": ShadowOf(&dev).Delta,
+		}).Warn("device config drifted, desired config pushed again")
+	}
+}
+
+func (sh *Shadows) run() {
+	defer close(sh.done)
+	tick := time.NewTicker(sh.opts.ReconcileEvery)
+	defer tick.Stop()
+	for {
+		select {
+		case <-sh.stop:
+			return
+		case <-tick.C:
+			sh.reconcile()
+		}
+	}
+}
+
+// Close : stops the reconciliation loop
+func (sh *Shadows) Close() {
+	close(sh.stop)
+	<-sh.done
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"github.com/eensymachines-in/webapi-devicereg/cfgsig"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	SigningKeysCollc = func(db *mongo.Database) SigningKeyStore {
+		return &qrySigningKeys{Collection: db.Collection("signingkeys")}
+	}
+)
+
+// signedBy : keys made by the registry on the first push to a device that has none
+const signedBy = "registry"
+
+// SigningKeyStore : keys the config pushes are signed with, one active per device
+type SigningKeyStore interface {
+	// AddSigningKey : key becomes the active one of the device, the one active till now is retired
+	// errors with 404 when the device isnt registered or is in the trash
+	AddSigningKey(key *SigningKey, ctx context.Context) httperr.HttpErr
+	SigningKeysOf(mac DevMacID, result *[]SigningKey, ctx context.Context) httperr.HttpErr
+	// ActiveSigningKey : errors with 404 when the device has no active key
+	ActiveSigningKey(mac DevMacID, result *SigningKey, ctx context.Context) httperr.HttpErr
+	// RetireSigningKey : errors when the key isnt the device's or is already retired
+	RetireSigningKey(mac DevMacID, id string, at time.Time, ctx context.Context) httperr.HttpErr
+}
+
+// SigningKeyIndexes : creates the indexes on the signingkeys collection, called once on startup
+// a device has atmost one active key - retiredat is null on the active one
+func SigningKeyIndexes(db *mongo.Database, ctx context.Context) error {
+	_, err := db.Collection("signingkeys").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"mac": 1}},
+		{
+			Keys:    primitive.D{{Key: "mac", Value: 1}, {Key: "retiredat", Value: 1}},
+			Options: options.Index().SetName("active_of_mac").SetUnique(true).SetPartialFilterExpression(bson.M{"retiredat": bson.M{"$type": "null"}}),
+		},
+	})
+	return err
+}
+
+type qrySigningKeys struct {
+	*mongo.Collection
+}
+
+// createdAfter : time the key is created at, kept after the latest key of the device
+// times are stored to the millisecond, keys made within the same one would otherwise be out of order
+func createdAfter(at time.Time, latest *SigningKey) time.Time {
+	at = at.Truncate(time.Millisecond)
+	if latest != nil && !at.After(latest.CreatedAt) {
+		return latest.CreatedAt.Add(time.Millisecond)
+	}
+	return at
+}
+
+// AddSigningKey : retires the active key and adds the new one in a single transaction
+// keys added at the same time for a device run into the unique index on the active key, the transaction is tried again then
+func (qs *qrySigningKeys) AddSigningKey(key *SigningKey, ctx context.Context) httperr.HttpErr {
+	if key == nil || !key.MacID.IsValid() || key.ID == "" || len(key.Secret) == 0 {
+		return httperr.ErrInvalidParam(fmt.Errorf("one or more fields on the signing key is invalid"))
+	}
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		err = transact(ctx, qs.Database(), func(sc mongo.SessionContext) error {
+			count, err := qs.Database().Collection("devices").CountDocuments(sc, live(key.MacID))
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				return txAbort{httperr.ErrResourceNotFound(fmt.Errorf("device not found %s", key.MacID))}
+			}
+			latest := &SigningKey{}
+			if err := qs.FindOne(sc, bson.M{"mac": key.MacID}, options.FindOne().SetSort(bson.M{"createdat": -1})).Decode(latest); err != nil {
+				if !errors.Is(err, mongo.ErrNoDocuments) {
+					return err
+				}
+				latest = nil
+			}
+			key.CreatedAt = createdAfter(key.CreatedAt, latest)
+			_, err = qs.UpdateMany(sc, bson.M{"mac": key.MacID, "retiredat": nil}, bson.M{"$set": bson.M{"retiredat": key.CreatedAt}})
+			if err != nil {
+				return err
+			}
+			_, err = qs.InsertOne(sc, key)
+			return err
+		})
+		if !mongo.IsDuplicateKeyError(err) {
+			break
+		}
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return httperr.DuplicateResourceErr(fmt.Errorf("signing key %s or another active key of %s already exists", key.ID, key.MacID))
+	}
+	return asHttpErr(err)
+}
+
+// SigningKeysOf : keys of the device, retired ones included, latest first
+// result		: list of keys, wiped clean before planting results into it
+func (qs *qrySigningKeys) SigningKeysOf(mac DevMacID, result *[]SigningKey, ctx context.Context) httperr.HttpErr {
+	if !mac.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid mac id %s for signing keys", mac))
+	}
+	*result = []SigningKey{}
+	cursor, err := qs.Find(ctx, bson.M{"mac": mac}, options.Find().SetSort(bson.M{"createdat": -1}))
+	if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	if err := cursor.All(ctx, result); err != nil {
+		return httperr.ErrBinding(err)
+	}
+	return nil
+}
+
+func (qs *qrySigningKeys) ActiveSigningKey(mac DevMacID, result *SigningKey, ctx context.Context) httperr.HttpErr {
+	*result = SigningKey{}
+	sr := qs.FindOne(ctx, bson.M{"mac": mac, "retiredat": nil}, options.FindOne().SetSort(bson.M{"createdat": -1}))
+	if sr.Err() != nil {
+		if errors.Is(sr.Err(), mongo.ErrNoDocuments) {
+			return httperr.ErrResourceNotFound(fmt.Errorf("no active signing key for device %s", mac))
+		}
+		return httperr.ErrDBQuery(sr.Err())
+	}
+	if err := sr.Decode(result); err != nil {
+		return httperr.ErrBinding(err)
+	}
+	return nil
+}
+
+func (qs *qrySigningKeys) RetireSigningKey(mac DevMacID, id string, at time.Time, ctx context.Context) httperr.HttpErr {
+	ur, err := qs.UpdateOne(ctx, bson.M{"_id": id, "mac": mac, "retiredat": nil}, bson.M{"$set": bson.M{"retiredat": at}})
+	if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	if ur.MatchedCount == 0 {
+		return httperr.ErrResourceNotFound(fmt.Errorf("active signing key %s not found for device %s", id, mac))
+	}
+	return nil
+}
+
+// newSigningKey : fresh key of the algorithm for the device, ed25519 when alg is empty
+func newSigningKey(mac DevMacID, alg, by string, now time.Time) (*SigningKey, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	key := &SigningKey{ID: id, MacID: mac, Alg: alg, CreatedBy: by, CreatedAt: now}
+	switch alg {
+	case "", cfgsig.AlgEd25519:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key.Alg, key.Secret, key.PubKey = cfgsig.AlgEd25519, priv.Seed(), pub
+	case cfgsig.AlgHMACSHA256:
+		key.Secret = make([]byte, 32)
+		if _, err := rand.Read(key.Secret); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown signing algorithm %s, has to be %s or %s", alg, cfgsig.AlgEd25519, cfgsig.AlgHMACSHA256)
+	}
+	return key, nil
+}
+
+// Signer : signs the config pushes with the active key of the device
+// devices that have no key yet get an ed25519 key on their first push, so every push goes out signed
+// pushes to devices deleted since are not signed, no key is made for a device that isnt registered
+type Signer struct {
+	keys SigningKeyStore
+}
+
+func NewSigner(keys SigningKeyStore) *Signer {
+	return &Signer{keys: keys}
+}
+
+// Sign : signature headers for the message of msgID with the payload, to the device of mac
+func (s *Signer) Sign(ctx context.Context, mac DevMacID, msgID string, payload []byte) (PubOpt, error) {
+	key := SigningKey{}
+	if err := s.keys.ActiveSigningKey(mac, &key, ctx); err != nil {
+		if err.HttpStatusCode() != http.StatusNotFound {
+			return nil, fmt.Errorf("failed to get the signing key of %s: %v", mac, err)
+		}
+		fresh, err := newSigningKey(mac, cfgsig.AlgEd25519, signedBy, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if err := s.keys.AddSigningKey(fresh, ctx); err != nil {
+			if err.HttpStatusCode() == http.StatusNotFound {
+				return nil, fmt.Errorf("device %s not registered, push not signed", mac)
+			}
+			return nil, fmt.Errorf("failed to add a signing key for %s: %v", mac, err)
+		}
+		log.WithFields(log.Fields{
+			"mac":   mac,
+			"keyid": fresh.ID,
+		}).Info("signing key made for the device")
+		key = *fresh
+	}
+	sig, err := cfgsig.Sign(key.Alg, key.ID, key.Secret, string(mac), msgID, payload, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return func(msg *amqp.Publishing) {
+		for hdr, val := range sig.Table() {
+			WithHeader(hdr, val)(msg)
+		}
+	}, nil
+}
+
+// NewSigningKey : key as sent out when made, hmac secret is seen only here
+type NewSigningKey struct {
+	SigningKey
+	Secret []byte `json:"secret,omitempty"` // base64
+}
+
+// HndlSigningKeys : keys the config pushes to the device are signed with, only the owners manage them
+// GET lists the keys, latest first - the public key of ed25519 keys is on the list
+// POST makes a new key {"alg": "ed25519" | "hmac-sha256"}, the pushes are signed with it from then on
+// DELETE /:keyid retires the key, a fresh ed25519 key is made on the next push if it was the active one
+func (app *App) HndlSigningKeys(c *gin.Context) {
+	ctx, cancel := app.opCtx(c.Request.Context())
+	defer cancel()
+	val, _ := c.Get("device")
+	deviceDetails, _ := val.(*Device)
+	if !permitted(c, deviceDetails, RoleOwner, "HndlSigningKeys") {
+		return
+	}
+	keyID := c.Param("keyid")
+	switch {
+	case c.Request.Method == "GET":
+		result := []SigningKey{}
+		if err := app.Signing.SigningKeysOf(deviceDetails.MacID, &result, ctx); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+				"stack_trace": "HndlSigningKeys/GET",
+				"mac":         deviceDetails.MacID,
+			}))
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusOK, result)
+		return
+	case c.Request.Method == "POST":
+		payload := struct {
+			Alg string `json:"alg"`
+		}{}
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBind(&payload); err != nil {
+				httperr.HttpErrOrOkDispatch(c, httperr.ErrBinding(err), reqLog(c).WithFields(log.Fields{
+					"stack_trace": "HndlSigningKeys/POST",
+				}))
+				return
+			}
+		}
+		key, err := newSigningKey(deviceDetails.MacID, payload.Alg, actorOf(c), time.Now())
+		if err != nil {
+			httperr.HttpErrOrOkDispatch(c, httperr.ErrInvalidParam(err), reqLog(c).WithFields(log.Fields{
+				"stack_trace": "HndlSigningKeys/POST",
+			}))
+			return
+		}
+		if err := app.Signing.AddSigningKey(key, ctx); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+				"stack_trace": "HndlSigningKeys/POST",
+				"mac":         deviceDetails.MacID,
+			}))
+			return
+		}
+		made := NewSigningKey{SigningKey: *key}
+		if key.Alg == cfgsig.AlgHMACSHA256 {
+			made.Secret = key.Secret
+		}
+		c.AbortWithStatusJSON(http.StatusCreated, made)
+		return
+	case c.Request.Method == "DELETE" && keyID != "":
+		if err := app.Signing.RetireSigningKey(deviceDetails.MacID, keyID, time.Now(), ctx); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, reqLog(c).WithFields(log.Fields{
+				"stack_trace": "HndlSigningKeys/DELETE",
+				"mac":         deviceDetails.MacID,
+				"keyid":       keyID,
+			}))
+			return
+		}
+		c.AbortWithStatus(http.StatusOK)
+		return
+	}
+	c.AbortWithStatus(http.StatusMethodNotAllowed)
+}
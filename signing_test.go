@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eensymachines-in/webapi-devicereg/cfgsig"
+	"github.com/gin-gonic/gin"
+	"github.com/streadway/amqp"
+)
+
+// verify : last push to the device verified with the key
+func (ts *testServer) verify(t *testing.T, key cfgsig.Key) (amqp.Publishing, error) {
+	t.Helper()
+	if len(ts.pub.msgs) == 0 {
+		t.Fatal("nothing pushed")
+	}
+	msg := ts.pub.msgs[len(ts.pub.msgs)-1]
+	return msg, cfgsig.NewVerifier(time.Minute, key).Verify(string(test200MacID), msg.MessageId, msg.Headers, msg.Body)
+}
+
+func TestSignedPushes(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, test200MacID)
+	path := "/api/devices/" + string(test200MacID)
+	newCfg := gin.H{"tickat": "05:00", "config": 1, "interval": 60, "pulsegap": 1800}
+	signingKeys := func() []SigningKey {
+		rec := ts.do("GET", path+"/signingkeys", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body)
+		}
+		keys := []SigningKey{}
+		json.Unmarshal(rec.Body.Bytes(), &keys)
+		return keys
+	}
+
+	t.Run("ed25519 made on the first push", func(t *testing.T) {
+		if rec := ts.do("PATCH", path+"?path=config&action=replace", newCfg); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body)
+		}
+		keys := signingKeys()
+		if len(keys) != 1 || keys[0].Alg != cfgsig.AlgEd25519 || len(keys[0].PubKey) == 0 || keys[0].CreatedBy != signedBy {
+			t.Fatalf("unexpected signing keys %+v", keys)
+		}
+		msg, err := ts.verify(t, cfgsig.Key{ID: keys[0].ID, Alg: keys[0].Alg, Key: keys[0].PubKey})
+		if err != nil {
+			t.Fatalf("push not verified with the public key, %s", err)
+		}
+		if msg.Headers["x-request-id"] == nil {
+			t.Error("signature replaced the other headers")
+		}
+	})
+	t.Run("hmac by the owner", func(t *testing.T) {
+		rec := ts.do("POST", path+"/signingkeys", gin.H{"alg": cfgsig.AlgHMACSHA256})
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d %s", rec.Code, rec.Body)
+		}
+		made := NewSigningKey{}
+		json.Unmarshal(rec.Body.Bytes(), &made)
+		if len(made.Secret) != 32 {
+			t.Fatalf("hmac secret not sent out %+v", made)
+		}
+		ts.do("PATCH", path+"?path=config&action=replace", gin.H{"tickat": "06:00", "config": 1, "interval": 60, "pulsegap": 1800})
+		if _, err := ts.verify(t, cfgsig.Key{ID: made.ID, Alg: cfgsig.AlgHMACSHA256, Key: made.Secret}); err != nil {
+			t.Fatalf("push not verified with the hmac secret, %s", err)
+		}
+		keys := signingKeys()
+		if len(keys) != 2 || keys[0].ID != made.ID || keys[0].RetiredAt != nil || keys[1].RetiredAt == nil {
+			t.Errorf("ed25519 key not retired for the hmac one %+v", keys)
+		}
+		if rec := ts.do("GET", path+"/signingkeys", nil); strings.Contains(rec.Body.String(), `"secret"`) {
+			t.Errorf("secret on the list %s", rec.Body)
+		}
+	})
+	t.Run("retired", func(t *testing.T) {
+		keys := signingKeys()
+		if rec := ts.do("DELETE", path+"/signingkeys/"+keys[0].ID, nil); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body)
+		}
+		if rec := ts.do("DELETE", path+"/signingkeys/"+keys[0].ID, nil); rec.Code != http.StatusNotFound {
+			t.Errorf("retiring again, expected 404 got %d", rec.Code)
+		}
+		ts.do("PATCH", path+"?path=config&action=replace", newCfg)
+		if _, err := ts.verify(t, cfgsig.Key{ID: keys[0].ID, Alg: cfgsig.AlgHMACSHA256, Key: []byte{}}); err == nil {
+			t.Error("push signed with the retired key")
+		}
+		if keys := signingKeys(); len(keys) != 3 || keys[0].Alg != cfgsig.AlgEd25519 || keys[0].RetiredAt != nil {
+			t.Errorf("fresh key not made after retiring %+v", keys)
+		}
+	})
+	t.Run("device deleted", func(t *testing.T) {
+		ts.register(t, test404MacID)
+		if rec := ts.do("DELETE", "/api/devices/"+string(test404MacID), nil); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if _, err := ts.app.Relay.signer.Sign(context.Background(), test404MacID, "6617e5c2a1b2c3d4e5f60718", []byte("{}")); err == nil {
+			t.Error("push signed for a device in the trash")
+		}
+		keys := []SigningKey{}
+		ts.store.SigningKeysOf(test404MacID, &keys, context.Background())
+		if len(keys) != 0 {
+			t.Errorf("signing key made for a device in the trash %+v", keys)
+		}
+	})
+	t.Run("owners only", func(t *testing.T) {
+		if rec := ts.do("POST", path+"/signingkeys", nil, "Authorization", bearer("stranger@eensymachines.in")); rec.Code != http.StatusForbidden {
+			t.Errorf("stranger making a key, expected 403 got %d", rec.Code)
+		}
+		if rec := ts.do("POST", path+"/signingkeys", gin.H{"alg": "rsa"}); rec.Code != http.StatusBadRequest {
+			t.Errorf("unknown algorithm, expected 400 got %d", rec.Code)
+		}
+	})
+}
+
+// TestSigningKeysAtOnce : keys added for a device at the same time leave it with exactly one active key, in order
+func TestSigningKeysAtOnce(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, test200MacID)
+	ctx := context.Background()
+	now := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, _ := newSigningKey(test200MacID, cfgsig.AlgEd25519, signedBy, now)
+			if err := ts.store.AddSigningKey(key, ctx); err != nil {
+				t.Errorf("failed to add signing key, status %d", err.HttpStatusCode())
+			}
+		}()
+	}
+	wg.Wait()
+	keys := []SigningKey{}
+	ts.store.SigningKeysOf(test200MacID, &keys, ctx)
+	if len(keys) != 8 || keys[0].RetiredAt != nil {
+		t.Fatalf("latest key not the active one %+v", keys)
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i].RetiredAt == nil || !keys[i].CreatedAt.Before(keys[i-1].CreatedAt) {
+			t.Fatalf("keys made at the same time not retired in order %+v", keys)
+		}
+	}
+	active := SigningKey{}
+	if err := ts.store.ActiveSigningKey(test200MacID, &active, ctx); err != nil || active.ID != keys[0].ID {
+		t.Errorf("active key %s not the latest %s", active.ID, keys[0].ID)
+	}
+}
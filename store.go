@@ -0,0 +1,32 @@
+package main
+
+import "go.mongodb.org/mongo-driver/mongo"
+
+// Stores : persistence the app runs on, all of it over the same backend
+// Mongo in production, in memory for tests and offline development
+type Stores struct {
+	Devices   QueryDevices
+	Outbox    ConfigOutbox
+	Revisions RevisionStore
+	Pushes    PushTracker
+	Presence  PresenceStore
+	Shadows   ShadowStore
+	Fleet     FleetCounter
+	Keys      ApiKeyStore
+	Signing   SigningKeyStore
+}
+
+// MongoStores : stores over the collections of the mongo database
+func MongoStores(db *mongo.Database) Stores {
+	return Stores{
+		Devices:   DevicesCollc(db),
+		Outbox:    OutboxCollc(db),
+		Revisions: RevisionsCollc(db),
+		Pushes:    PushesCollc(db),
+		Presence:  PresenceCollc(db),
+		Shadows:   ShadowCollc(db),
+		Fleet:     FleetCollc(db),
+		Keys:      ApiKeysCollc(db),
+		Signing:   SigningKeysCollc(db),
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/eensymachines-in/webapi-devicereg"
+
+// TraceOpts : where the spans go, zero values are replaced by defaults
+type TraceOpts struct {
+	Exporter string  // none / stdout / file, none when empty
+	File     string  // spans are appended to this file when the exporter is file
+	Sample   float64 // ratio of the traces sampled, traces continued from the caller follow the caller's decision
+	Service  string  // service.name on the spans
+}
+
+func (opts *TraceOpts) defaults() {
+	if opts.Exporter == "" {
+		opts.Exporter = "none"
+	}
+	if opts.File == "" {
+		opts.File = "traces.json"
+	}
+	if opts.Sample <= 0 || opts.Sample > 1 {
+		opts.Sample = 1
+	}
+	if opts.Service == "" {
+		opts.Service = "webapi-devicereg"
+	}
+}
+
+// NewTracing : sets the process wide tracer provider and the w3c trace context propagator
+// spans are dropped when the exporter is none, the trace context is still passed on to the devices
+// returns the shutdown that flushes the spans yet to be exported, call it on the way out
+func NewTracing(opts TraceOpts) (func(context.Context) error, error) {
+	opts.defaults()
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	var out io.Writer
+	var file *os.File
+	switch opts.Exporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		out = os.Stdout
+	case "file":
+		f, err := os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file %s: %w", opts.File, err)
+		}
+		out, file = f, f
+	default:
+		return nil, fmt.Errorf("invalid trace exporter %s, expected none, stdout or file", opts.Exporter)
+	}
+	exp, err := stdouttrace.New(stdouttrace.WithWriter(out))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", opts.Service),
+		attribute.String("service.version", version),
+	))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.Sample))),
+	)
+	otel.SetTracerProvider(tp)
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}, nil
+}
+
+// tracer : from the provider set at the time of the call, a noop one till NewTracing
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Traced : span for each request, continued from the caller's traceparent if any
+// the request's context carries the span on to the store and the broker
+func Traced(c *gin.Context) {
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	ctx, span := tracer().Start(ctx, c.Request.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("http.request.method", c.Request.Method),
+		attribute.String("http.route", route),
+		attribute.String("url.path", c.Request.URL.Path),
+		attribute.String("request.id", requestID(c)),
+	))
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+	status := c.Writer.Status()
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, strconv.Itoa(status))
+	}
+}
+
+// amqpHeaders : amqp message headers as the carrier of the trace context
+type amqpHeaders amqp.Table
+
+func (ah amqpHeaders) Get(key string) string {
+	val, _ := ah[key].(string)
+	return val
+}
+
+func (ah amqpHeaders) Set(key, val string) {
+	ah[key] = val
+}
+
+func (ah amqpHeaders) Keys() []string {
+	keys := make([]string, 0, len(ah))
+	for key := range ah {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// WithTraceContext : trace context of ctx in the message headers, traceparent / tracestate as per w3c
+// devices and downstream consumers continue the trace from these
+func WithTraceContext(ctx context.Context) PubOpt {
+	return func(msg *amqp.Publishing) {
+		if msg.Headers == nil {
+			msg.Headers = amqp.Table{}
+		}
+		otel.GetTextMapPropagator().Inject(ctx, amqpHeaders(msg.Headers))
+	}
+}
+
+// traceCarrier : trace context of ctx to be saved along with the outbox message, nil when there is no span
+func traceCarrier(ctx context.Context) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// endSpan : records the error if any on the span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans : spans ended during the test are recorded, the provider before is put back after
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	rec := tracetest.NewSpanRecorder()
+	prev, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		tp.Shutdown(context.Background())
+		otel.SetTracerProvider(prev)
+		otel.SetTextMapPropagator(prevProp)
+	})
+	return rec
+}
+
+func spanNamed(spans []sdktrace.ReadOnlySpan, name string) sdktrace.ReadOnlySpan {
+	for _, span := range spans {
+		if span.Name() == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	t.Run("request to push", func(t *testing.T) {
+		spans := recordSpans(t)
+		ts := newTestServer(t)
+		ts.register(t, test200MacID)
+		newCfg := gin.H{"tickat": "05:00", "config": 1, "interval": 60, "pulsegap": 1800}
+		rec := ts.do("PATCH", "/api/devices/"+string(test200MacID)+"?path=config&action=replace", newCfg,
+			"traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body)
+		}
+		ended := spans.Ended()
+		for _, name := range []string{"PATCH /api/devices/:deviceid", "QueryDevices.GetOfId", "config publish"} {
+			span := spanNamed(ended, name)
+			if span == nil {
+				t.Errorf("no span %s", name)
+				continue
+			}
+			if span.SpanContext().TraceID().String() != traceID {
+				t.Errorf("span %s not continued from the caller's trace", name)
+			}
+		}
+		msg := ts.pub.msgs[len(ts.pub.msgs)-1]
+		if tp, _ := msg.Headers["traceparent"].(string); !strings.Contains(tp, traceID) {
+			t.Errorf("trace context not in the push headers: %v", msg.Headers)
+		}
+	})
+	t.Run("retry continues the trace", func(t *testing.T) {
+		spans := recordSpans(t)
+		ts := newTestServer(t)
+		ts.register(t, test200MacID)
+		msg := OutboxMsg{
+			ID:    primitive.NewObjectID(),
+			MacID: test200MacID,
+			Trace: map[string]string{"traceparent": "00-" + traceID + "-00f067aa0ba902b7-01"},
+		}
+		if err := ts.app.Relay.Deliver(context.Background(), &msg); err != nil {
+			t.Fatal(err)
+		}
+		span := spanNamed(spans.Ended(), "config publish")
+		if span == nil || span.SpanContext().TraceID().String() != traceID {
+			t.Errorf("publish from the relay not continued from the saved trace")
+		}
+	})
+}
+
+// TestStoreSpans : calls on the stores made for a request or a push are spans in its trace
+func TestStoreSpans(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	traceparent := "00-" + traceID + "-00f067aa0ba902b7-01"
+	spans := recordSpans(t)
+	ts := newTestServer(t)
+	ts.register(t, test200MacID)
+	key := ts.issueKey(t, test200MacID)
+	path := "/api/devices/" + string(test200MacID)
+	newCfg := gin.H{"tickat": "05:00", "config": 1, "interval": 60, "pulsegap": 1800}
+	if rec := ts.do("PATCH", path+"?path=config&action=replace", newCfg, "traceparent", traceparent); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body)
+	}
+	ts.do("GET", path+"/revisions", nil, "traceparent", traceparent)
+	ts.do("POST", path+"/heartbeat", gin.H{}, "X-API-Key", key.Key, "traceparent", traceparent)
+	ended := spans.Ended()
+	for _, name := range []string{
+		"ConfigOutbox.PatchConfgOutbox",
+		"SigningKeyStore.ActiveSigningKey",
+		"ConfigOutbox.MarkDelivered",
+		"RevisionStore.Revisions",
+		"ApiKeyStore.KeyOf",
+	} {
+		span := spanNamed(ended, name)
+		if span == nil {
+			t.Errorf("no span %s", name)
+			continue
+		}
+		if span.SpanContext().TraceID().String() != traceID {
+			t.Errorf("span %s not in the trace of the request", name)
+		}
+	}
+	// marked once published, within the publish
+	publish, marked := spanNamed(ended, "config publish"), spanNamed(ended, "ConfigOutbox.MarkDelivered")
+	if publish != nil && marked != nil && marked.Parent().SpanID() != publish.SpanContext().SpanID() {
+		t.Error("outbox message not marked within the publish span")
+	}
+}
+
+func TestTracingFileExporter(t *testing.T) {
+	prev, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	defer func() {
+		otel.SetTracerProvider(prev)
+		otel.SetTextMapPropagator(prevProp)
+	}()
+	fp := filepath.Join(t.TempDir(), "traces.json")
+	shutdown, err := NewTracing(TraceOpts{Exporter: "file", File: fp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := tracer().Start(context.Background(), "config publish")
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	byt, err := os.ReadFile(fp)
+	if err != nil || !strings.Contains(string(byt), `"Name":"config publish"`) {
+		t.Errorf("span not exported to the file: %v %s", err, byt)
+	}
+	if _, err := NewTracing(TraceOpts{Exporter: "jaeger"}); err == nil {
+		t.Error("expected error for an exporter not supported")
+	}
+}